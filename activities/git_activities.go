@@ -2,11 +2,15 @@ package activities
 
 import (
   "context"
+  "errors"
   "fmt"
   "log"
 
   "hammer/services"
   "hammer/shared"
+
+  "github.com/go-git/go-git/v5/plumbing"
+  "go.temporal.io/sdk/temporal"
 )
 
 const (
@@ -17,10 +21,34 @@ const (
   ActivityName_WriteFilesAndCommit  = "WriteFilesAndCommitActivity"
   ActivityName_CreateBranch         = "CreateBranchActivity"
   ActivityName_PushBranch           = "PushBranchActivity"
+  ActivityName_DiffChangesGit       = "DiffChangesGitActivity"
+  ActivityName_ApplyBranchStrategy  = "ApplyBranchStrategyActivity"
+  ActivityName_CheckMergeConflicts  = "CheckMergeConflictsActivity"
+  ActivityName_ReadConflictFile     = "ReadConflictFileActivity"
+  ActivityName_MergeUpstream        = "MergeUpstreamActivity"
+  ActivityName_SummarizeDirectories = "SummarizeDirectoriesActivity"
+  ActivityName_RelatedFiles         = "RelatedFilesActivity"
+  ActivityName_SearchFiles          = "SearchFilesActivity"
+  ActivityName_AgentTool            = "AgentToolActivity"
+  ActivityName_PendingChanges       = "PendingChangesActivity"
+  ActivityName_CommitPending        = "CommitPendingActivity"
+  ActivityName_SummarizeCommit      = "SummarizeCommitActivity"
+  ActivityName_ScanBranch           = "ScanBranchActivity"
 )
 
 type GitActivities struct {
   gitServiceMap map[string]*services.GitService
+  commitSigner  *services.CommitSigner // Optional; shared by every workflow's GitService
+  toolOptions   services.AgentToolOptions // Worker-wide settings for the agent's tools
+  writePolicy   services.WritePolicy      // Worker-wide limits on files the agents may write
+  repoPrompts   bool                      // Use prompt templates from the target repository; see SetRepoPromptsAllowed
+}
+
+// SetRepoPromptsAllowed lets target repositories replace the prompt templates
+// with files in services.RepoPromptsDir. Those templates become the model's
+// instructions, so only enable it for repositories whose committers are trusted.
+func (a *GitActivities) SetRepoPromptsAllowed(allowed bool) {
+  a.repoPrompts = allowed
 }
 
 // ApplyChangesActivityInput - defines how changes are passed
@@ -67,19 +95,67 @@ func (ga *GitActivities) getServiceForWorkflow(workflowID string) (*services.Git
   return service, nil
 }
 
-func (a *GitActivities) InitGitActivity(ctx context.Context, input shared.InitGitActivityInput) error {
+func (a *GitActivities) InitGitActivity(ctx context.Context, input shared.InitGitActivityInput) (*shared.InitGitActivityResult, error) {
   log.Printf("Attempting to initialize GitService for workflow %s", input.WorkflowID)
   if _, exists := a.gitServiceMap[input.WorkflowID]; exists {
     log.Printf("Warning: GitService already exists for workflow %s. Re-initializing.", input.WorkflowID)
   }
-  gitService, err := services.NewGitService(input.RepoURL, input.Credentials)
+  gitService, err := services.NewGitService(input.RepoURL, input.Credentials, a.commitSigner)
   if err != nil {
     log.Printf("Error initializing GitService for workflow %s: %v", input.WorkflowID, err)
-    return err
+    return nil, err
+  }
+  gitService.SetWritePolicy(a.writePolicy)
+  gitService.SetCommitTrailers(input.CommitTrailers)
+  result := &shared.InitGitActivityResult{
+    SigningKeyFingerprint: gitService.SigningKeyFingerprint(),
+  }
+  if input.FollowUpBranch != "" {
+    state, err := gitService.CheckoutFollowUpBranch(input.FollowUpBranch)
+    if err != nil {
+      log.Printf("Error checking out follow-up branch %s for workflow %s: %v", input.FollowUpBranch, input.WorkflowID, err)
+      if errors.Is(err, services.ErrInvalidBranch) {
+        return nil, temporal.NewNonRetryableApplicationError(err.Error(), "INVALID_BRANCH", err)
+      }
+      return nil, err
+    }
+    result.PriorSteps = state.PriorSteps
+    result.PriorDiff = state.PriorDiff
+  }
+  if input.OutputBranch != "" && input.OutputBranch != input.FollowUpBranch {
+    if err := gitService.ValidateOutputBranch(input.OutputBranch); err != nil {
+      return nil, temporal.NewNonRetryableApplicationError(err.Error(), "INVALID_BRANCH", err)
+    }
+    // Remember where the branch is now so a force-with-lease push cannot
+    // overwrite commits pushed to it while the run was working.
+    if err := gitService.RecordRemoteBranch(input.OutputBranch); err != nil {
+      return nil, err
+    }
+  }
+  result.RepoConfig, err = gitService.LoadRepoConfig()
+  if err != nil {
+    log.Printf("Error loading %s for workflow %s: %v", services.RepoConfigFile, input.WorkflowID, err)
+    if errors.Is(err, services.ErrInvalidRepoConfig) {
+      return nil, temporal.NewNonRetryableApplicationError(err.Error(), "INVALID_REPO_CONFIG", err)
+    }
+    return nil, err
+  }
+  overrides, err := gitService.ReadPromptOverrides()
+  switch {
+  case err != nil:
+    log.Printf("Warning: could not read repository prompt overrides for workflow %s: %v", input.WorkflowID, err)
+  case !a.repoPrompts && len(overrides) > 0:
+    log.Printf("Ignoring %d prompt template(s) in %s for workflow %s; set ALLOW_REPO_PROMPTS=true to use them", len(overrides), services.RepoPromptsDir, input.WorkflowID)
+  default:
+    result.PromptOverrides = overrides
+  }
+  if _, err := gitService.SearchIndex(); err != nil {
+    // Search is an aid to evaluation; the index is retried on the first query.
+    log.Printf("Warning: could not build search index for workflow %s: %v", input.WorkflowID, err)
   }
   a.RegisterGitServiceForWorkflow(input.WorkflowID, gitService)
   log.Printf("Successfully initialized GitService for workflow %s", input.WorkflowID)
-  return nil
+  return result, nil
 }
 
 func (a *GitActivities) CleanupGitActivity(ctx context.Context, input shared.CleanupGitActivityInput) error {
@@ -100,25 +176,243 @@ func (a *GitActivities) ReadFilesGitActivity(ctx context.Context, input shared.R
     gitService, err := a.getServiceForWorkflow(input.WorkflowID)
      if err != nil { return nil, err }
      contents := make(map[string]string)
+     var totalBytes int64
      for _, p := range input.FilePaths {
+         if input.MaxFiles > 0 && len(contents) >= input.MaxFiles {
+             log.Printf("ReadFilesGitActivity reached the %d file budget for workflow %s; dropping remaining files", input.MaxFiles, input.WorkflowID)
+             break
+         }
+         reason, err := gitService.FilterReason(p)
+         if err != nil {
+             log.Printf("Warning: ReadFilesGitActivity could not check '%s' for workflow %s: %v", p, input.WorkflowID, err)
+             continue
+         }
+         if reason != "" {
+             log.Printf("ReadFilesGitActivity skipping '%s' for workflow %s: %s", p, input.WorkflowID, reason)
+             continue
+         }
          content, err := gitService.ReadFile(p)
          if err != nil {
              log.Printf("Warning: ReadFilesGitActivity could not read '%s' for workflow %s: %v", p, input.WorkflowID, err)
              // Skip file on error
              continue
          }
+         if input.MaxBytes > 0 && totalBytes+int64(len(content)) > input.MaxBytes {
+             log.Printf("ReadFilesGitActivity skipping '%s' for workflow %s: would exceed the %d byte budget", p, input.WorkflowID, input.MaxBytes)
+             continue
+         }
+         totalBytes += int64(len(content))
          contents[p] = content
      }
      return contents, nil
 }
 
+// SummarizeDirectoriesActivity returns per-directory summaries of the given files for
+// hierarchical file selection. Summaries are cached on the workflow's GitService, so
+// later steps only rebuild directories whose files changed.
+func (a *GitActivities) SummarizeDirectoriesActivity(ctx context.Context, input shared.SummarizeDirectoriesInput) ([]shared.DirectorySummary, error) {
+  gitService, err := a.getServiceForWorkflow(input.WorkflowID)
+  if err != nil { return nil, err }
+  return gitService.SummarizeDirectories(input.Files)
+}
+
+// RelatedFilesActivity returns files the selection depends on or that depend on it,
+// according to the symbol index, so they can be added to the generator's context.
+func (a *GitActivities) RelatedFilesActivity(ctx context.Context, input shared.RelatedFilesInput) ([]string, error) {
+  gitService, err := a.getServiceForWorkflow(input.WorkflowID)
+  if err != nil { return nil, err }
+  index, err := gitService.SymbolIndex()
+  if err != nil {
+    return nil, fmt.Errorf("failed to build symbol index for workflow %s: %w", input.WorkflowID, err)
+  }
+  return index.RelatedFiles(input.Files, input.MaxFiles), nil
+}
+
+// SearchFilesActivity ranks the worktree's files by how well their contents match a query.
+func (a *GitActivities) SearchFilesActivity(ctx context.Context, input shared.SearchFilesInput) ([]shared.SearchHit, error) {
+  gitService, err := a.getServiceForWorkflow(input.WorkflowID)
+  if err != nil { return nil, err }
+  hits, err := gitService.SearchFiles(input.Query, input.Limit)
+  if err != nil {
+    return nil, fmt.Errorf("search failed for workflow %s: %w", input.WorkflowID, err)
+  }
+  return hits, nil
+}
+
+// AgentToolActivity executes one tool call from the tool-calling agent. Mistakes the
+// model can fix are returned as the tool output, not as activity errors.
+func (a *GitActivities) AgentToolActivity(ctx context.Context, input shared.AgentToolActivityInput) (string, error) {
+  gitService, err := a.getServiceForWorkflow(input.WorkflowID)
+  if err != nil { return "", err }
+  log.Printf("Agent tool call %s for workflow %s: %s", input.Call.Name, input.WorkflowID, input.Call.Arguments)
+  output, err := gitService.ExecuteAgentTool(ctx, input.Call.Name, input.Call.Arguments, a.toolOptions)
+  if err != nil {
+    return "", fmt.Errorf("tool %s failed for workflow %s: %w", input.Call.Name, input.WorkflowID, err)
+  }
+  return output, nil
+}
+
+// PendingChangesActivity returns the uncommitted file contents in the worktree and
+// the writes the policy refused since the last call.
+func (a *GitActivities) PendingChangesActivity(ctx context.Context, input shared.PendingChangesInput) (*shared.PendingChangesResult, error) {
+  gitService, err := a.getServiceForWorkflow(input.WorkflowID)
+  if err != nil { return nil, err }
+  written, deleted, err := gitService.PendingChanges()
+  if err != nil {
+    return nil, fmt.Errorf("failed to read pending changes for workflow %s: %w", input.WorkflowID, err)
+  }
+  return &shared.PendingChangesResult{Written: written, Deleted: deleted, Rejected: gitService.TakeRejectedWrites()}, nil
+}
+
+// CommitPendingActivity commits the changes the agent staged in the worktree.
+// Changes over the per-step file limit are reverted and returned as rejected
+// writes. The hash is empty if there was nothing to commit.
+func (a *GitActivities) CommitPendingActivity(ctx context.Context, input shared.CommitPendingInput) (*shared.CommitPendingResult, error) {
+  gitService, err := a.getServiceForWorkflow(input.WorkflowID)
+  if err != nil { return nil, err }
+  written, deleted, err := gitService.PendingChanges()
+  if err != nil {
+    return nil, fmt.Errorf("failed to read pending changes for workflow %s: %w", input.WorkflowID, err)
+  }
+  changed := append([]string(nil), deleted...)
+  for f := range written {
+    changed = append(changed, f)
+  }
+  if len(changed) == 0 {
+    log.Printf("No pending changes to commit for workflow %s", input.WorkflowID)
+    return &shared.CommitPendingResult{}, nil
+  }
+  result := &shared.CommitPendingResult{}
+  kept, rejected := gitService.LimitStepFiles(changed)
+  if len(rejected) > 0 {
+    log.Printf("Warning: reverting %d change(s) over the per-step file limit for workflow %s", len(rejected), input.WorkflowID)
+    excess := make([]string, len(rejected))
+    for i, r := range rejected {
+      excess[i] = r.Path
+    }
+    if err := gitService.RevertPaths(excess); err != nil {
+      return nil, fmt.Errorf("failed to revert changes over the file limit for workflow %s: %w", input.WorkflowID, err)
+    }
+    result.Rejected = rejected
+  }
+  log.Printf("Committing %d pending change(s) for workflow %s", len(kept), input.WorkflowID)
+  commitHash, err := gitService.Commit(input.CommitMessage)
+  if err != nil {
+    return nil, fmt.Errorf("failed to commit changes for workflow %s: %w", input.WorkflowID, err)
+  }
+  result.CommitHash = commitHash.String()
+  return result, nil
+}
+
+// SummarizeCommitActivity describes what a step's commit changed, for the run's change log.
+func (a *GitActivities) SummarizeCommitActivity(ctx context.Context, input shared.SummarizeCommitInput) ([]shared.FileChangeSummary, error) {
+  gitService, err := a.getServiceForWorkflow(input.WorkflowID)
+  if err != nil { return nil, err }
+  files, err := gitService.SummarizeCommit(plumbing.NewHash(input.CommitHash))
+  if err != nil {
+    return nil, fmt.Errorf("failed to summarize commit %s for workflow %s: %w", input.CommitHash, input.WorkflowID, err)
+  }
+  return files, nil
+}
+
+// DiffChangesGitActivity renders a unified diff of pending changes against HEAD.
+func (a *GitActivities) DiffChangesGitActivity(ctx context.Context, input shared.DiffChangesGitActivityInput) (string, error) {
+  gitService, err := a.getServiceForWorkflow(input.WorkflowID)
+  if err != nil { return "", err }
+  diff, err := gitService.DiffChanges(input.Changes)
+  if err != nil {
+    return "", fmt.Errorf("failed to diff changes for workflow %s: %w", input.WorkflowID, err)
+  }
+  return diff, nil
+}
+
+// ApplyBranchStrategyActivity reshapes the generated commits before the output branch is
+// created: squashing them into one commit or rebasing them onto the latest base.
+func (a *GitActivities) ApplyBranchStrategyActivity(ctx context.Context, input shared.ApplyBranchStrategyInput) (*shared.ApplyBranchStrategyResult, error) {
+  gitService, err := a.getServiceForWorkflow(input.WorkflowID)
+  if err != nil { return nil, err }
+
+  result := &shared.ApplyBranchStrategyResult{}
+  switch input.Strategy {
+  case "", shared.BranchStrategyCommits:
+    head, err := gitService.RepoHeadHash()
+    if err != nil { return nil, err }
+    result.HeadHash = head.String()
+  case shared.BranchStrategySquash:
+    head, err := gitService.SquashSinceBase(input.SquashMessage)
+    if err != nil {
+      return nil, fmt.Errorf("failed to squash commits for workflow %s: %w", input.WorkflowID, err)
+    }
+    result.HeadHash = head.String()
+  case shared.BranchStrategyRebase:
+    head, conflicts, err := gitService.RebaseOntoLatestBase()
+    if err != nil {
+      return nil, fmt.Errorf("failed to rebase commits for workflow %s: %w", input.WorkflowID, err)
+    }
+    result.HeadHash = head.String()
+    result.Conflicts = conflicts
+  default:
+    return nil, temporal.NewNonRetryableApplicationError(fmt.Sprintf("unknown branch strategy %q", input.Strategy), "INVALID_BRANCH_STRATEGY", nil)
+  }
+  log.Printf("Applied branch strategy %q for workflow %s, HEAD %s", input.Strategy, input.WorkflowID, result.HeadHash)
+  return result, nil
+}
+
+// CheckMergeConflictsActivity fetches the latest base branch and reports files that
+// conflict with the generated commits, without modifying the repository.
+func (a *GitActivities) CheckMergeConflictsActivity(ctx context.Context, input shared.CheckMergeConflictsInput) (*shared.CheckMergeConflictsResult, error) {
+  gitService, err := a.getServiceForWorkflow(input.WorkflowID)
+  if err != nil { return nil, err }
+  check, err := gitService.CheckMergeConflicts()
+  if err != nil {
+    return nil, fmt.Errorf("failed to check merge conflicts for workflow %s: %w", input.WorkflowID, err)
+  }
+  return &shared.CheckMergeConflictsResult{
+    UpstreamHash: check.Upstream.String(),
+    BaseMoved:    check.BaseMoved,
+    Conflicts:    check.Conflicts,
+  }, nil
+}
+
+// ReadConflictFileActivity returns the base, branch and upstream versions of a conflicting file.
+func (a *GitActivities) ReadConflictFileActivity(ctx context.Context, input shared.ReadConflictFileInput) (*shared.ConflictFile, error) {
+  gitService, err := a.getServiceForWorkflow(input.WorkflowID)
+  if err != nil { return nil, err }
+  file, err := gitService.ConflictVersions(input.Path, plumbing.NewHash(input.UpstreamHash))
+  if err != nil {
+    return nil, fmt.Errorf("failed to read conflict versions of '%s' for workflow %s: %w", input.Path, input.WorkflowID, err)
+  }
+  return file, nil
+}
+
+// MergeUpstreamActivity merges the latest base into HEAD using the given conflict resolutions.
+func (a *GitActivities) MergeUpstreamActivity(ctx context.Context, input shared.MergeUpstreamInput) (string, error) {
+  gitService, err := a.getServiceForWorkflow(input.WorkflowID)
+  if err != nil { return "", err }
+  hash, err := gitService.MergeUpstream(plumbing.NewHash(input.UpstreamHash), input.Resolutions, input.CommitMessage)
+  if err != nil {
+    return "", fmt.Errorf("failed to merge latest base for workflow %s: %w", input.WorkflowID, err)
+  }
+  return hash.String(), nil
+}
+
 func (a *GitActivities) PushBranchActivity(ctx context.Context, input shared.PushBranchActivityInput) error {
   gitService, err := a.getServiceForWorkflow(input.WorkflowID)
   if err != nil {
     return fmt.Errorf("failed to get git service for push activity (workflow %s): %w", input.WorkflowID, err)
   }
 
-  err = gitService.PushBranch(input.BranchName)
+  // Never push credentials, even if the workflow did not check first.
+  findings, err := gitService.ScanBranch()
+  if err != nil {
+    return fmt.Errorf("secret scan failed for workflow %s: %w", input.WorkflowID, err)
+  }
+  if len(findings) > 0 {
+    msg := fmt.Sprintf("refusing to push %s: %d potential secret(s), first in %s:%d (%s)", input.BranchName, len(findings), findings[0].File, findings[0].Line, findings[0].Rule)
+    return temporal.NewNonRetryableApplicationError(msg, "SECRETS_FOUND", services.ErrSecretsFound)
+  }
+
+  err = gitService.PushBranch(input.BranchName, input.ForceWithLease)
   if err != nil {
     // Error is already logged in PushBranch, just bubble it up
     return fmt.Errorf("push branch activity failed for workflow %s, branch %s: %w", input.WorkflowID, input.BranchName, err)
@@ -128,9 +422,25 @@ func (a *GitActivities) PushBranchActivity(ctx context.Context, input shared.Pus
   return nil
 }
 
-func NewGitActivities() *GitActivities {
+// ScanBranchActivity scans everything the run changed for potential secrets.
+func (a *GitActivities) ScanBranchActivity(ctx context.Context, input shared.ScanBranchInput) ([]shared.SecretFinding, error) {
+  gitService, err := a.getServiceForWorkflow(input.WorkflowID)
+  if err != nil { return nil, err }
+  findings, err := gitService.ScanBranch()
+  if err != nil {
+    return nil, fmt.Errorf("secret scan failed for workflow %s: %w", input.WorkflowID, err)
+  }
+  return findings, nil
+}
+
+// NewGitActivities creates the git activity set. commitSigner may be nil, in
+// which case generated commits are left unsigned.
+func NewGitActivities(commitSigner *services.CommitSigner, toolOptions services.AgentToolOptions, writePolicy services.WritePolicy) *GitActivities {
   return &GitActivities{
     gitServiceMap: make(map[string]*services.GitService),
+    commitSigner:  commitSigner,
+    toolOptions:   toolOptions,
+    writePolicy:   writePolicy,
   }
 }
 
@@ -157,10 +467,13 @@ func (a *GitActivities) ReadFilesActivity(ctx context.Context, input shared.Read
   return contents, nil
 }
 
-func (a *GitActivities) WriteFilesAndCommitActivity(ctx context.Context, input WriteAndCommitInput) (string, error) {
+// WriteFilesAndCommitActivity writes the step's generated files and commits them.
+// Writes refused by the write policy are skipped and returned in the result, as
+// are potential secrets the step adds.
+func (a *GitActivities) WriteFilesAndCommitActivity(ctx context.Context, input WriteAndCommitInput) (*shared.WriteAndCommitResult, error) {
     gitService, err := a.getServiceForWorkflow(input.WorkflowID)
     if err != nil {
-        return "", err
+        return nil, err
     }
 
     if len(input.Changes) == 0 {
@@ -169,25 +482,52 @@ func (a *GitActivities) WriteFilesAndCommitActivity(ctx context.Context, input W
         headRef, err := gitService.RepoHeadHash() // Assumes RepoHeadHash() exists in service
          if err != nil {
              log.Printf("Warning: Could not get HEAD hash for no-op commit: %v", err)
-             return "", nil // Or return specific indicator
+             return &shared.WriteAndCommitResult{}, nil // Or return specific indicator
          }
-         return headRef.String(), nil
+         return &shared.WriteAndCommitResult{CommitHash: headRef.String()}, nil
     }
 
 
-    for filePath, content := range input.Changes {
-        err := gitService.WriteFile(filePath, content) // WriteFile now also stages
-        if err != nil {
-            return "", fmt.Errorf("failed to write/stage file '%s' for workflow %s: %w", filePath, input.WorkflowID, err)
+    // Writes the policy refuses don't count toward the per-step limit; files over
+    // the limit are reported like other policy violations.
+    accepted := gitService.CheckWrites(input.Changes)
+    if n := len(input.Changes) - len(accepted); n > 0 {
+        log.Printf("Warning: rejected %d write(s) for workflow %s", n, input.WorkflowID)
+    }
+    paths := make([]string, 0, len(accepted))
+    for filePath := range accepted {
+        paths = append(paths, filePath)
+    }
+    kept, overLimit := gitService.LimitStepFiles(paths)
+    if len(overLimit) > 0 {
+        log.Printf("Warning: skipping %d file(s) over the per-step limit for workflow %s", len(overLimit), input.WorkflowID)
+    }
+
+    written := make(map[string]string, len(kept))
+    for _, filePath := range kept {
+        content := accepted[filePath]
+        if err := gitService.WriteFile(filePath, content); err != nil { // WriteFile now also stages
+            return nil, fmt.Errorf("failed to write/stage file '%s' for workflow %s: %w", filePath, input.WorkflowID, err)
         }
+        written[filePath] = content
     }
+    result := &shared.WriteAndCommitResult{Rejected: append(gitService.TakeRejectedWrites(), overLimit...)}
 
-    commitHash, err := gitService.Commit(input.CommitMessage)
+    // Scan before committing, while HEAD still has the previous content of each file.
+    result.SecretFindings, err = gitService.ScanChanges(written)
     if err != nil {
-         return "", fmt.Errorf("failed to commit changes for workflow %s: %w", input.WorkflowID, err)
+        return nil, fmt.Errorf("secret scan failed for workflow %s: %w", input.WorkflowID, err)
+    }
+    if len(result.SecretFindings) > 0 {
+        log.Printf("Warning: %d potential secret(s) in step changes for workflow %s", len(result.SecretFindings), input.WorkflowID)
     }
 
-    return commitHash.String(), nil
+    commitHash, err := gitService.Commit(input.CommitMessage)
+    if err != nil {
+         return nil, fmt.Errorf("failed to commit changes for workflow %s: %w", input.WorkflowID, err)
+    }
+    result.CommitHash = commitHash.String()
+    return result, nil
 }
 
 
@@ -198,6 +538,9 @@ func (a *GitActivities) CreateBranchActivity(ctx context.Context, input CreateBr
     }
 
     err = gitService.CreateBranch(input.BranchName)
+    if errors.Is(err, services.ErrInvalidBranch) {
+        return temporal.NewNonRetryableApplicationError(err.Error(), "INVALID_BRANCH", err)
+    }
     if err != nil {
          return fmt.Errorf("failed to create branch '%s' for workflow %s: %w", input.BranchName, input.WorkflowID, err)
     }
@@ -2,16 +2,24 @@ package activities
 
 import (
   "context"
+  "errors"
   "fmt"
 
   "hammer/services"
   "hammer/shared"
+
+  "go.temporal.io/sdk/temporal"
 )
 
 const (
   ActivityName_PlanSteps      = "PlanStepsActivity"
   ActivityName_EvaluateFiles  = "EvaluateFilesActivity"
   ActivityName_GenerateCode   = "GenerateCodeActivity"
+  ActivityName_GenerateCommitMessage = "GenerateCommitMessageActivity"
+  ActivityName_ResolveConflict = "ResolveConflictActivity"
+  ActivityName_SelectDirectories = "SelectDirectoriesActivity"
+  ActivityName_AgentTurn       = "AgentTurnActivity"
+  ActivityName_ReviewCode      = "ReviewCodeActivity"
 )
 
 type LLMActivities struct {
@@ -22,26 +30,106 @@ func NewLLMActivities(llmService *services.LLMService) *LLMActivities {
   return &LLMActivities{LLMService: llmService}
 }
 
-func (a *LLMActivities) PlanStepsActivity(ctx context.Context, userPrompt string) ([]string, error) {
-  steps, err := a.LLMService.PlanSteps(ctx, userPrompt)
+func (a *LLMActivities) PlanStepsActivity(ctx context.Context, input shared.PlanStepsActivityInput) (*shared.PlanStepsActivityResult, error) {
+  ctx, usage := services.TrackUsage(ctx)
+  steps, err := a.LLMService.PlanSteps(ctx, input.UserPrompt, input.FollowUp, input.Conventions, input.PromptOverrides)
   if err != nil {
-    return nil, fmt.Errorf("PlanStepsActivity failed: %w", err)
+    return nil, withUsage(fmt.Errorf("PlanStepsActivity failed: %w", err), usage)
   }
-  return steps, nil
+  return &shared.PlanStepsActivityResult{Steps: steps, Usage: usage.Calls()}, nil
 }
 
 func (a *LLMActivities) EvaluateFilesActivity(ctx context.Context, input shared.EvaluateFilesActivityInput) (*shared.EvaluateFilesActivityResult, error) {
-  relevantFiles, err := a.LLMService.EvaluateRelevantFiles(ctx, input.StepDescription, input.AllFiles)
+  ctx, usage := services.TrackUsage(ctx)
+  relevantFiles, err := a.LLMService.EvaluateRelevantFiles(ctx, input.StepDescription, input.AllFiles, input.SearchHits, input.PriorChanges, input.PromptOverrides)
+  if err != nil {
+    return nil, withUsage(fmt.Errorf("EvaluateFilesActivity failed: %w", err), usage)
+  }
+  return &shared.EvaluateFilesActivityResult{RelevantFiles: relevantFiles, Usage: usage.Calls()}, nil
+}
+
+// SelectDirectoriesActivity picks the directories to evaluate files from in large repositories.
+func (a *LLMActivities) SelectDirectoriesActivity(ctx context.Context, input shared.SelectDirectoriesActivityInput) (*shared.SelectDirectoriesActivityResult, error) {
+  ctx, usage := services.TrackUsage(ctx)
+  dirs, err := a.LLMService.SelectDirectories(ctx, input.StepDescription, input.Directories, input.MaxDirectories, input.PromptOverrides)
+  if err != nil {
+    return nil, withUsage(fmt.Errorf("SelectDirectoriesActivity failed: %w", err), usage)
+  }
+  return &shared.SelectDirectoriesActivityResult{Directories: dirs, Usage: usage.Calls()}, nil
+}
+
+// AgentTurnActivity asks the tool-calling agent for its next message.
+func (a *LLMActivities) AgentTurnActivity(ctx context.Context, input shared.AgentTurnActivityInput) (*shared.AgentTurnActivityResult, error) {
+  ctx, usage := services.TrackUsage(ctx)
+  result, err := a.LLMService.AgentTurn(ctx, input)
   if err != nil {
-    return nil, fmt.Errorf("EvaluateFilesActivity failed: %w", err)
+    return nil, withUsage(fmt.Errorf("AgentTurnActivity failed: %w", err), usage)
   }
-  return &shared.EvaluateFilesActivityResult{RelevantFiles: relevantFiles}, nil
+  result.Usage = usage.Calls()
+  return result, nil
 }
 
 func (a *LLMActivities) GenerateCodeActivity(ctx context.Context, input shared.GenerateCodeActivityInput) (*shared.GenerateCodeActivityResult, error) {
-  generatedFiles, err := a.LLMService.GenerateCodeChanges(ctx, input.StepDescription, input.RelevantFilesContent, input.OriginalUserPrompt)
+  ctx, usage := services.TrackUsage(ctx)
+  result, err := a.LLMService.GenerateCodeChanges(ctx, input.StepDescription, input.RelevantFilesContent, input.FilePriority, input.OriginalUserPrompt, input.Conventions, input.PriorChanges, input.Revision, input.PromptOverrides)
+  if err != nil {
+    return nil, withUsage(fmt.Errorf("GenerateCodeActivity failed: %w", err), usage)
+  }
+  result.Usage = usage.Calls()
+  return result, nil
+}
+
+// ReviewCodeActivity critiques a step's generated changes before they are committed.
+// A reply that is not valid review JSON is reported as non-retryable so the
+// workflow can carry on without the review.
+func (a *LLMActivities) ReviewCodeActivity(ctx context.Context, input shared.ReviewCodeActivityInput) (*shared.ReviewCodeActivityResult, error) {
+  ctx, usage := services.TrackUsage(ctx)
+  result, err := a.LLMService.ReviewCode(ctx, input)
+  if err != nil {
+    if errors.Is(err, services.ErrInvalidReview) {
+      usage.DiscardCached()
+      return nil, temporal.NewNonRetryableApplicationError(err.Error(), "INVALID_REVIEW", err, usage.Calls())
+    }
+    return nil, withUsage(fmt.Errorf("ReviewCodeActivity failed: %w", err), usage)
+  }
+  return &shared.ReviewCodeActivityResult{Review: *result, Usage: usage.Calls()}, nil
+}
+
+// GenerateCommitMessageActivity writes a Conventional Commits message from the step's diff.
+// A message that fails validation is reported as non-retryable so the workflow can
+// fall back to its template message right away.
+func (a *LLMActivities) GenerateCommitMessageActivity(ctx context.Context, input shared.GenerateCommitMessageActivityInput) (*shared.GenerateCommitMessageActivityResult, error) {
+  ctx, usage := services.TrackUsage(ctx)
+  message, err := a.LLMService.GenerateCommitMessage(ctx, input.StepDescription, input.Diff, input.OriginalUserPrompt, input.PromptOverrides)
+  if err != nil {
+    if errors.Is(err, services.ErrInvalidCommitMessage) {
+      usage.DiscardCached()
+      return nil, temporal.NewNonRetryableApplicationError(err.Error(), "INVALID_COMMIT_MESSAGE", err, usage.Calls())
+    }
+    return nil, withUsage(fmt.Errorf("GenerateCommitMessageActivity failed: %w", err), usage)
+  }
+  return &shared.GenerateCommitMessageActivityResult{Message: message, Usage: usage.Calls()}, nil
+}
+
+// ResolveConflictActivity merges the branch and upstream versions of one conflicting file.
+func (a *LLMActivities) ResolveConflictActivity(ctx context.Context, input shared.ResolveConflictActivityInput) (*shared.ResolveConflictActivityResult, error) {
+  ctx, usage := services.TrackUsage(ctx)
+  merged, err := a.LLMService.ResolveConflict(ctx, input.File, input.OriginalUserPrompt, input.PromptOverrides)
   if err != nil {
-    return nil, fmt.Errorf("GenerateCodeActivity failed: %w", err)
+    return nil, withUsage(fmt.Errorf("ResolveConflictActivity failed: %w", err), usage)
+  }
+  return &shared.ResolveConflictActivityResult{Merged: merged, Usage: usage.Calls()}, nil
+}
+
+// withUsage attaches the usage of a failed attempt's LLM calls to its error, so
+// the workflow still counts tokens spent on a reply that could not be used. The
+// error stays retryable, and cached responses the attempt used are discarded so
+// the retry asks the model again.
+func withUsage(err error, usage *services.UsageRecorder) error {
+  usage.DiscardCached()
+  calls := usage.Calls()
+  if len(calls) == 0 {
+    return err
   }
-  return &shared.GenerateCodeActivityResult{GeneratedFiles: generatedFiles}, nil
+  return temporal.NewApplicationErrorWithCause(err.Error(), "LLM_CALL_FAILED", err, calls)
 }
@@ -0,0 +1,346 @@
+package handlers
+
+import (
+  "context"
+  "crypto/hmac"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "net/url"
+  "os"
+  "slices"
+  "strings"
+  "time"
+
+  "hammer/shared"
+
+  "github.com/go-chi/chi/v5"
+  "golang.org/x/crypto/bcrypt"
+  "gopkg.in/yaml.v3"
+)
+
+// Permissions checked by the handlers.
+const (
+  PermView    = "view"
+  PermSubmit  = "submit"
+  PermApprove = "approve"
+  PermCancel  = "cancel" // Anyone's runs; submitters may always cancel their own
+)
+
+// roleRank orders the roles; each role has the permissions of the roles below it.
+var roleRank = map[string]int{
+  shared.RoleViewer:    1,
+  shared.RoleSubmitter: 2,
+  shared.RoleApprover:  3,
+  shared.RoleAdmin:     4,
+}
+
+// permissionRank is the lowest role rank holding each permission.
+var permissionRank = map[string]int{
+  PermView:    1,
+  PermSubmit:  2,
+  PermApprove: 3,
+  PermCancel:  3,
+}
+
+// ErrInvalidCredentials is returned when a request carries credentials that do
+// not match any user.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator identifies the user behind a request. It returns a nil user and
+// nil error when the request carries no credentials of its kind.
+type Authenticator interface {
+  Authenticate(r *http.Request) (*shared.User, error)
+}
+
+// HasPermission reports whether any of the user's roles grants perm.
+func HasPermission(user *shared.User, perm string) bool {
+  if user == nil {
+    return false
+  }
+  need, ok := permissionRank[perm]
+  if !ok {
+    return false
+  }
+  for _, role := range user.Roles {
+    if roleRank[role] >= need {
+      return true
+    }
+  }
+  return false
+}
+
+type userContextKey struct{}
+
+// UserFromContext returns the authenticated user, or nil.
+func UserFromContext(ctx context.Context) *shared.User {
+  user, _ := ctx.Value(userContextKey{}).(*shared.User)
+  return user
+}
+
+// anonymousUser is used when authentication is disabled. Its empty ID keeps it
+// out of commit trailers and search attributes.
+var anonymousUser = &shared.User{Name: "anonymous", Roles: []string{shared.RoleAdmin}}
+
+// Auth authenticates requests with the configured authenticators, tried in order.
+type Auth struct {
+  authenticators []Authenticator
+  oidc           *OIDCAuthenticator // Nil unless OIDC login is enabled
+  basic          bool               // Challenge with WWW-Authenticate: Basic
+}
+
+// Enabled reports whether requests must authenticate.
+func (a *Auth) Enabled() bool {
+  return a != nil && len(a.authenticators) > 0
+}
+
+// LoadAuthFromEnv builds the authenticators named in AUTH_MODE (a comma-separated
+// list of token, basic and oidc). An empty AUTH_MODE disables authentication.
+func LoadAuthFromEnv() (*Auth, error) {
+  auth := &Auth{}
+  mode := strings.TrimSpace(os.Getenv("AUTH_MODE"))
+  if mode == "" || mode == "none" {
+    log.Println("Warning: AUTH_MODE not set; the web UI is open to anyone who can reach it")
+    return auth, nil
+  }
+  var users []userRecord
+  for _, m := range strings.Split(mode, ",") {
+    switch m = strings.TrimSpace(m); m {
+    case "token", "basic":
+      if users == nil {
+        var err error
+        if users, err = loadUsersFile(os.Getenv("AUTH_USERS_FILE")); err != nil {
+          return nil, err
+        }
+      }
+      if m == "token" {
+        auth.authenticators = append(auth.authenticators, newTokenAuthenticator(users))
+      } else {
+        auth.authenticators = append(auth.authenticators, newBasicAuthenticator(users))
+        auth.basic = true
+      }
+    case "oidc":
+      oidc, err := NewOIDCAuthenticatorFromEnv()
+      if err != nil {
+        return nil, err
+      }
+      auth.oidc = oidc
+      auth.authenticators = append(auth.authenticators, oidc)
+    default:
+      return nil, fmt.Errorf("unknown AUTH_MODE entry %q (want token, basic or oidc)", m)
+    }
+  }
+  log.Printf("Authentication enabled: %s", mode)
+  return auth, nil
+}
+
+// RegisterRoutes adds the login routes, which must stay reachable without a session.
+func (a *Auth) RegisterRoutes(r chi.Router) {
+  if a != nil && a.oidc != nil {
+    a.oidc.RegisterRoutes(r)
+  }
+}
+
+// Middleware stores the authenticated user in the request context. Browsers are
+// sent to the OIDC login when it is enabled; other requests get a 401.
+func (a *Auth) Middleware(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if !a.Enabled() {
+      next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, anonymousUser)))
+      return
+    }
+    for _, authenticator := range a.authenticators {
+      user, err := authenticator.Authenticate(r)
+      if err != nil {
+        log.Printf("Authentication failed for %s %s: %v", r.Method, r.URL.Path, err)
+        a.challenge(w)
+        return
+      }
+      if user != nil {
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+        return
+      }
+    }
+    if a.oidc != nil && r.Method == http.MethodGet && r.Header.Get("HX-Request") == "" {
+      http.Redirect(w, r, "/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+      return
+    }
+    a.challenge(w)
+  })
+}
+
+func (a *Auth) challenge(w http.ResponseWriter) {
+  if a.basic {
+    w.Header().Set("WWW-Authenticate", `Basic realm="Hammer", charset="UTF-8"`)
+  }
+  http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// RequirePermission rejects requests whose user lacks perm with 403.
+func RequirePermission(perm string) func(http.Handler) http.Handler {
+  return func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      if !HasPermission(UserFromContext(r.Context()), perm) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+      }
+      next.ServeHTTP(w, r)
+    })
+  }
+}
+
+// userRecord is one entry of AUTH_USERS_FILE.
+type userRecord struct {
+  ID           string   `yaml:"id"`
+  Name         string   `yaml:"name"`
+  Email        string   `yaml:"email"`
+  Roles        []string `yaml:"roles"`
+  Teams        []string `yaml:"teams"`
+  PasswordHash string   `yaml:"password_hash"` // bcrypt, for basic auth
+  Tokens       []string `yaml:"tokens"`        // SHA-256 hex of each API token
+}
+
+func (u userRecord) user() *shared.User {
+  return &shared.User{ID: u.ID, Name: u.Name, Email: u.Email, Roles: u.Roles, Teams: u.Teams}
+}
+
+func loadUsersFile(path string) ([]userRecord, error) {
+  if path == "" {
+    return nil, errors.New("AUTH_USERS_FILE must be set for token and basic authentication")
+  }
+  content, err := os.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("failed to read AUTH_USERS_FILE: %w", err)
+  }
+  var file struct {
+    Users []userRecord `yaml:"users"`
+  }
+  if err := yaml.Unmarshal(content, &file); err != nil {
+    return nil, fmt.Errorf("failed to parse AUTH_USERS_FILE: %w", err)
+  }
+  seen := make(map[string]bool)
+  for _, u := range file.Users {
+    if u.ID == "" {
+      return nil, errors.New("AUTH_USERS_FILE: every user needs an id")
+    }
+    if seen[u.ID] {
+      return nil, fmt.Errorf("AUTH_USERS_FILE: duplicate user id %q", u.ID)
+    }
+    seen[u.ID] = true
+    for _, role := range u.Roles {
+      if _, ok := roleRank[role]; !ok {
+        return nil, fmt.Errorf("AUTH_USERS_FILE: user %q has unknown role %q", u.ID, role)
+      }
+    }
+  }
+  return file.Users, nil
+}
+
+// HashToken returns the form of an API token stored in AUTH_USERS_FILE.
+func HashToken(token string) string {
+  sum := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(sum[:])
+}
+
+// HashPassword returns the bcrypt hash of a basic-auth password for AUTH_USERS_FILE.
+func HashPassword(password string) (string, error) {
+  hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+  return string(hash), err
+}
+
+// tokenAuthenticator accepts "Authorization: Bearer <token>".
+type tokenAuthenticator struct {
+  users map[string]*shared.User // Keyed by token hash
+}
+
+func newTokenAuthenticator(users []userRecord) *tokenAuthenticator {
+  a := &tokenAuthenticator{users: make(map[string]*shared.User)}
+  for _, u := range users {
+    for _, hash := range u.Tokens {
+      a.users[strings.ToLower(hash)] = u.user()
+    }
+  }
+  return a
+}
+
+func (a *tokenAuthenticator) Authenticate(r *http.Request) (*shared.User, error) {
+  header := r.Header.Get("Authorization")
+  token, ok := strings.CutPrefix(header, "Bearer ")
+  if !ok {
+    return nil, nil
+  }
+  if user, ok := a.users[HashToken(strings.TrimSpace(token))]; ok {
+    return user, nil
+  }
+  return nil, ErrInvalidCredentials
+}
+
+// basicAuthenticator checks HTTP basic credentials against bcrypt hashes.
+type basicAuthenticator struct {
+  users []userRecord
+}
+
+func newBasicAuthenticator(users []userRecord) *basicAuthenticator {
+  return &basicAuthenticator{users: users}
+}
+
+func (a *basicAuthenticator) Authenticate(r *http.Request) (*shared.User, error) {
+  id, password, ok := r.BasicAuth()
+  if !ok {
+    return nil, nil
+  }
+  i := slices.IndexFunc(a.users, func(u userRecord) bool { return u.ID == id })
+  if i < 0 || a.users[i].PasswordHash == "" {
+    return nil, ErrInvalidCredentials
+  }
+  if bcrypt.CompareHashAndPassword([]byte(a.users[i].PasswordHash), []byte(password)) != nil {
+    return nil, ErrInvalidCredentials
+  }
+  return a.users[i].user(), nil
+}
+
+// cookieSigner signs cookie values with HMAC-SHA256 so they cannot be forged.
+type cookieSigner struct {
+  key []byte
+}
+
+// encode returns v as JSON, base64-encoded, followed by its signature.
+func (c cookieSigner) encode(v any) (string, error) {
+  payload, err := json.Marshal(v)
+  if err != nil {
+    return "", err
+  }
+  encoded := base64.RawURLEncoding.EncodeToString(payload)
+  return encoded + "." + c.sign(encoded), nil
+}
+
+// decode verifies value and unmarshals its payload into v.
+func (c cookieSigner) decode(value string, v any) error {
+  encoded, sig, ok := strings.Cut(value, ".")
+  if !ok || subtle.ConstantTimeCompare([]byte(sig), []byte(c.sign(encoded))) != 1 {
+    return errors.New("bad cookie signature")
+  }
+  payload, err := base64.RawURLEncoding.DecodeString(encoded)
+  if err != nil {
+    return err
+  }
+  return json.Unmarshal(payload, v)
+}
+
+func (c cookieSigner) sign(encoded string) string {
+  mac := hmac.New(sha256.New, c.key)
+  mac.Write([]byte(encoded))
+  return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// session is the payload of the session cookie set after an OIDC login.
+type session struct {
+  User    shared.User
+  Expires time.Time
+}
@@ -0,0 +1,479 @@
+package handlers
+
+import (
+  "context"
+  "crypto"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "math/big"
+  "net/http"
+  "net/url"
+  "os"
+  "strings"
+  "sync"
+  "time"
+
+  "hammer/shared"
+
+  "github.com/go-chi/chi/v5"
+)
+
+// Cookie names used by the OIDC login.
+const (
+  sessionCookie    = "hammer_session"
+  loginStateCookie = "hammer_oidc_login"
+)
+
+// OIDCAuthenticator logs browsers in with the OpenID Connect authorization code
+// flow and keeps them signed in with a signed session cookie. Only RS256 ID
+// tokens are accepted.
+type OIDCAuthenticator struct {
+  issuer       string
+  clientID     string
+  clientSecret string
+  redirectURL  string
+  rolesClaim   string // Claim listing the user's roles, e.g. "groups"
+  defaultRole  string // Used when the claim names no known role
+  teamsClaim   string // Claim listing the user's teams; empty means no teams
+  sessionTTL   time.Duration
+  cookies      cookieSigner
+  httpClient   *http.Client
+
+  mu        sync.Mutex
+  discovery *oidcDiscovery // Fetched on first use
+  keys      map[string]*rsa.PublicKey
+}
+
+type oidcDiscovery struct {
+  Issuer                string `json:"issuer"`
+  AuthorizationEndpoint string `json:"authorization_endpoint"`
+  TokenEndpoint         string `json:"token_endpoint"`
+  JWKSURI               string `json:"jwks_uri"`
+}
+
+// loginState is kept in a short-lived cookie between the redirect to the
+// provider and the callback.
+type loginState struct {
+  State   string
+  Nonce   string
+  Next    string
+  Expires time.Time
+}
+
+// NewOIDCAuthenticatorFromEnv configures OIDC from OIDC_ISSUER_URL, OIDC_CLIENT_ID,
+// OIDC_CLIENT_SECRET, OIDC_REDIRECT_URL, OIDC_ROLES_CLAIM, OIDC_DEFAULT_ROLE,
+// OIDC_TEAMS_CLAIM, AUTH_SESSION_KEY and AUTH_SESSION_TTL.
+func NewOIDCAuthenticatorFromEnv() (*OIDCAuthenticator, error) {
+  a := &OIDCAuthenticator{
+    issuer:       strings.TrimSuffix(os.Getenv("OIDC_ISSUER_URL"), "/"),
+    clientID:     os.Getenv("OIDC_CLIENT_ID"),
+    clientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+    redirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+    rolesClaim:   os.Getenv("OIDC_ROLES_CLAIM"),
+    defaultRole:  os.Getenv("OIDC_DEFAULT_ROLE"),
+    teamsClaim:   os.Getenv("OIDC_TEAMS_CLAIM"),
+    sessionTTL:   12 * time.Hour,
+    httpClient:   &http.Client{Timeout: 10 * time.Second},
+  }
+  if a.issuer == "" || a.clientID == "" {
+    return nil, errors.New("OIDC_ISSUER_URL and OIDC_CLIENT_ID must be set for OIDC authentication")
+  }
+  if a.redirectURL == "" {
+    a.redirectURL = "http://localhost:3000/auth/callback"
+  }
+  if a.rolesClaim == "" {
+    a.rolesClaim = "groups"
+  }
+  if a.defaultRole == "" {
+    a.defaultRole = shared.RoleSubmitter
+  }
+  if _, ok := roleRank[a.defaultRole]; !ok {
+    return nil, fmt.Errorf("unknown OIDC_DEFAULT_ROLE %q", a.defaultRole)
+  }
+  key := os.Getenv("AUTH_SESSION_KEY")
+  if len(key) < 32 {
+    return nil, errors.New("AUTH_SESSION_KEY must be at least 32 characters for OIDC authentication")
+  }
+  a.cookies = cookieSigner{key: []byte(key)}
+  if ttl := os.Getenv("AUTH_SESSION_TTL"); ttl != "" {
+    d, err := time.ParseDuration(ttl)
+    if err != nil {
+      return nil, fmt.Errorf("invalid AUTH_SESSION_TTL: %w", err)
+    }
+    a.sessionTTL = d
+  }
+  return a, nil
+}
+
+// RegisterRoutes adds /auth/login, /auth/callback and /auth/logout.
+func (a *OIDCAuthenticator) RegisterRoutes(r chi.Router) {
+  r.Get("/auth/login", a.HandleLogin)
+  r.Get("/auth/callback", a.HandleCallback)
+  r.Get("/auth/logout", a.HandleLogout)
+}
+
+// Authenticate reads the session cookie.
+func (a *OIDCAuthenticator) Authenticate(r *http.Request) (*shared.User, error) {
+  cookie, err := r.Cookie(sessionCookie)
+  if err != nil {
+    return nil, nil
+  }
+  var s session
+  if err := a.cookies.decode(cookie.Value, &s); err != nil || time.Now().After(s.Expires) {
+    return nil, nil // Treat a stale or foreign cookie as no session, so the user can log in again
+  }
+  return &s.User, nil
+}
+
+// HandleLogin redirects to the provider's authorization endpoint.
+func (a *OIDCAuthenticator) HandleLogin(w http.ResponseWriter, r *http.Request) {
+  disc, err := a.discover(r.Context())
+  if err != nil {
+    log.Printf("OIDC discovery failed: %v", err)
+    http.Error(w, "Login provider unavailable", http.StatusBadGateway)
+    return
+  }
+  next := r.URL.Query().Get("next")
+  if !isLocalRedirect(next) {
+    next = "/" // Only local redirects after login
+  }
+  state := loginState{State: randomString(), Nonce: randomString(), Next: next, Expires: time.Now().Add(10 * time.Minute)}
+  value, err := a.cookies.encode(state)
+  if err != nil {
+    http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+    return
+  }
+  a.setCookie(w, loginStateCookie, value, state.Expires)
+  query := url.Values{
+    "response_type": {"code"},
+    "client_id":     {a.clientID},
+    "redirect_uri":  {a.redirectURL},
+    "scope":         {"openid profile email"},
+    "state":         {state.State},
+    "nonce":         {state.Nonce},
+  }
+  http.Redirect(w, r, disc.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+}
+
+// HandleCallback exchanges the authorization code, verifies the ID token and
+// starts a session.
+func (a *OIDCAuthenticator) HandleCallback(w http.ResponseWriter, r *http.Request) {
+  var state loginState
+  cookie, err := r.Cookie(loginStateCookie)
+  if err != nil || a.cookies.decode(cookie.Value, &state) != nil || time.Now().After(state.Expires) {
+    http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+    return
+  }
+  a.setCookie(w, loginStateCookie, "", time.Unix(0, 0))
+  if r.URL.Query().Get("state") != state.State {
+    http.Error(w, "Login state mismatch", http.StatusBadRequest)
+    return
+  }
+  if e := r.URL.Query().Get("error"); e != "" {
+    http.Error(w, "Login failed: "+e, http.StatusUnauthorized)
+    return
+  }
+  user, err := a.exchange(r.Context(), r.URL.Query().Get("code"), state.Nonce)
+  if err != nil {
+    log.Printf("OIDC login failed: %v", err)
+    http.Error(w, "Login failed", http.StatusUnauthorized)
+    return
+  }
+  s := session{User: *user, Expires: time.Now().Add(a.sessionTTL)}
+  value, err := a.cookies.encode(s)
+  if err != nil {
+    http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+    return
+  }
+  a.setCookie(w, sessionCookie, value, s.Expires)
+  log.Printf("User %s logged in via OIDC with roles %v", user.ID, user.Roles)
+  http.Redirect(w, r, state.Next, http.StatusFound)
+}
+
+// HandleLogout ends the session.
+func (a *OIDCAuthenticator) HandleLogout(w http.ResponseWriter, r *http.Request) {
+  a.setCookie(w, sessionCookie, "", time.Unix(0, 0))
+  http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (a *OIDCAuthenticator) setCookie(w http.ResponseWriter, name, value string, expires time.Time) {
+  http.SetCookie(w, &http.Cookie{
+    Name:     name,
+    Value:    value,
+    Path:     "/",
+    Expires:  expires,
+    HttpOnly: true,
+    Secure:   strings.HasPrefix(a.redirectURL, "https://"),
+    SameSite: http.SameSiteLaxMode,
+  })
+}
+
+// exchange redeems the code at the token endpoint and returns the user from the
+// verified ID token.
+func (a *OIDCAuthenticator) exchange(ctx context.Context, code, nonce string) (*shared.User, error) {
+  if code == "" {
+    return nil, errors.New("callback has no code")
+  }
+  disc, err := a.discover(ctx)
+  if err != nil {
+    return nil, err
+  }
+  form := url.Values{
+    "grant_type":    {"authorization_code"},
+    "code":          {code},
+    "redirect_uri":  {a.redirectURL},
+    "client_id":     {a.clientID},
+    "client_secret": {a.clientSecret},
+  }
+  req, err := http.NewRequestWithContext(ctx, http.MethodPost, disc.TokenEndpoint, strings.NewReader(form.Encode()))
+  if err != nil {
+    return nil, err
+  }
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  var tokens struct {
+    IDToken string `json:"id_token"`
+  }
+  if err := a.getJSON(req, &tokens); err != nil {
+    return nil, fmt.Errorf("token request failed: %w", err)
+  }
+  claims, err := a.verifyIDToken(ctx, tokens.IDToken)
+  if err != nil {
+    return nil, err
+  }
+  if claims["nonce"] != nonce {
+    return nil, errors.New("ID token nonce mismatch")
+  }
+  return a.userFromClaims(claims)
+}
+
+// isLocalRedirect reports whether next is a path on this site. Browsers read
+// "//host" and "/\host" as protocol-relative URLs, so both are refused, as are
+// backslashes and control characters anywhere in the path.
+func isLocalRedirect(next string) bool {
+  u, err := url.Parse(next)
+  if err != nil || u.Scheme != "" || u.Host != "" || u.Opaque != "" {
+    return false
+  }
+  return strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\") && !strings.ContainsAny(next, "\\\r\n\t")
+}
+
+// verifyIDToken checks the signature, issuer, audience and expiry of an RS256
+// ID token and returns its claims.
+func (a *OIDCAuthenticator) verifyIDToken(ctx context.Context, token string) (map[string]any, error) {
+  parts := strings.Split(token, ".")
+  if len(parts) != 3 {
+    return nil, errors.New("malformed ID token")
+  }
+  var header struct {
+    Alg string `json:"alg"`
+    Kid string `json:"kid"`
+  }
+  if err := decodeJWTPart(parts[0], &header); err != nil {
+    return nil, fmt.Errorf("bad ID token header: %w", err)
+  }
+  if header.Alg != "RS256" {
+    return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+  }
+  key, err := a.publicKey(ctx, header.Kid)
+  if err != nil {
+    return nil, err
+  }
+  sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+  if err != nil {
+    return nil, fmt.Errorf("bad ID token signature encoding: %w", err)
+  }
+  digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+  if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+    return nil, errors.New("ID token signature is invalid")
+  }
+
+  var claims map[string]any
+  if err := decodeJWTPart(parts[1], &claims); err != nil {
+    return nil, fmt.Errorf("bad ID token claims: %w", err)
+  }
+  disc, err := a.discover(ctx)
+  if err != nil {
+    return nil, err
+  }
+  if claims["iss"] != disc.Issuer {
+    return nil, fmt.Errorf("ID token issuer %v does not match %s", claims["iss"], disc.Issuer)
+  }
+  if !audienceContains(claims["aud"], a.clientID) {
+    return nil, errors.New("ID token audience does not include the client ID")
+  }
+  exp, _ := claims["exp"].(float64)
+  if time.Now().After(time.Unix(int64(exp), 0).Add(time.Minute)) {
+    return nil, errors.New("ID token has expired")
+  }
+  return claims, nil
+}
+
+// userFromClaims maps ID token claims to a user. Roles come from the roles claim,
+// limited to Hammer's role names, falling back to the default role. Teams come
+// from the teams claim, if configured.
+func (a *OIDCAuthenticator) userFromClaims(claims map[string]any) (*shared.User, error) {
+  str := func(name string) string {
+    s, _ := claims[name].(string)
+    return s
+  }
+  user := &shared.User{ID: str("preferred_username"), Name: str("name"), Email: str("email")}
+  if user.ID == "" {
+    user.ID = user.Email
+  }
+  if user.ID == "" {
+    user.ID = str("sub")
+  }
+  if user.ID == "" {
+    return nil, errors.New("ID token has no usable subject")
+  }
+  for _, role := range claimStrings(claims, a.rolesClaim) {
+    if _, known := roleRank[role]; known {
+      user.Roles = append(user.Roles, role)
+    }
+  }
+  if len(user.Roles) == 0 {
+    user.Roles = []string{a.defaultRole}
+  }
+  if a.teamsClaim != "" {
+    user.Teams = claimStrings(claims, a.teamsClaim)
+  }
+  return user, nil
+}
+
+// claimStrings returns a claim holding a string or a list of strings.
+func claimStrings(claims map[string]any, name string) []string {
+  var values []string
+  switch v := claims[name].(type) {
+  case []any:
+    for _, c := range v {
+      if s, ok := c.(string); ok {
+        values = append(values, s)
+      }
+    }
+  case string:
+    values = []string{v}
+  }
+  return values
+}
+
+// discover fetches the provider configuration once.
+func (a *OIDCAuthenticator) discover(ctx context.Context) (*oidcDiscovery, error) {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  if a.discovery != nil {
+    return a.discovery, nil
+  }
+  req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.issuer+"/.well-known/openid-configuration", nil)
+  if err != nil {
+    return nil, err
+  }
+  var disc oidcDiscovery
+  if err := a.getJSON(req, &disc); err != nil {
+    return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+  }
+  if disc.AuthorizationEndpoint == "" || disc.TokenEndpoint == "" || disc.JWKSURI == "" {
+    return nil, errors.New("OIDC discovery document is missing endpoints")
+  }
+  if strings.TrimSuffix(disc.Issuer, "/") != a.issuer {
+    return nil, fmt.Errorf("OIDC issuer %q does not match OIDC_ISSUER_URL", disc.Issuer)
+  }
+  a.discovery = &disc
+  return a.discovery, nil
+}
+
+// publicKey returns the signing key with the given ID, refetching the key set
+// once when the ID is unknown (the provider may have rotated keys).
+func (a *OIDCAuthenticator) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+  disc, err := a.discover(ctx)
+  if err != nil {
+    return nil, err
+  }
+  a.mu.Lock()
+  key, ok := a.keys[kid]
+  a.mu.Unlock()
+  if ok {
+    return key, nil
+  }
+  req, err := http.NewRequestWithContext(ctx, http.MethodGet, disc.JWKSURI, nil)
+  if err != nil {
+    return nil, err
+  }
+  var set struct {
+    Keys []struct {
+      Kty string `json:"kty"`
+      Kid string `json:"kid"`
+      N   string `json:"n"`
+      E   string `json:"e"`
+    } `json:"keys"`
+  }
+  if err := a.getJSON(req, &set); err != nil {
+    return nil, fmt.Errorf("failed to fetch OIDC signing keys: %w", err)
+  }
+  keys := make(map[string]*rsa.PublicKey)
+  for _, k := range set.Keys {
+    if k.Kty != "RSA" {
+      continue
+    }
+    n, errN := base64.RawURLEncoding.DecodeString(k.N)
+    e, errE := base64.RawURLEncoding.DecodeString(k.E)
+    if errN != nil || errE != nil {
+      continue
+    }
+    keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+  }
+  a.mu.Lock()
+  a.keys = keys
+  a.mu.Unlock()
+  if key, ok := keys[kid]; ok {
+    return key, nil
+  }
+  return nil, fmt.Errorf("no OIDC signing key with id %q", kid)
+}
+
+func (a *OIDCAuthenticator) getJSON(req *http.Request, v any) error {
+  resp, err := a.httpClient.Do(req)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return fmt.Errorf("%s returned %s", req.URL.Redacted(), resp.Status)
+  }
+  return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func decodeJWTPart(part string, v any) error {
+  data, err := base64.RawURLEncoding.DecodeString(part)
+  if err != nil {
+    return err
+  }
+  return json.Unmarshal(data, v)
+}
+
+func audienceContains(aud any, clientID string) bool {
+  switch v := aud.(type) {
+  case string:
+    return v == clientID
+  case []any:
+    for _, a := range v {
+      if a == clientID {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+func randomString() string {
+  b := make([]byte, 24)
+  if _, err := rand.Read(b); err != nil {
+    panic(fmt.Sprintf("crypto/rand failed: %v", err))
+  }
+  return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -1,30 +1,53 @@
 package handlers
 
 import (
+  "context"
+  "errors"
   "fmt"
   "html/template"
   "log"
   "net/http"
+  "net/url"
   "os"
+  "strings"
   "time"
+  "unicode"
+  "unicode/utf8"
 
+  "hammer/services"
   "hammer/workflows"
   "hammer/shared" // Adjust 'project_name'
   "github.com/go-chi/chi/v5"
+  "github.com/go-git/go-git/v5/plumbing"
   "go.temporal.io/sdk/client"
+  "go.temporal.io/sdk/converter"
+  "go.temporal.io/sdk/temporal"
   temporalApiEnums "go.temporal.io/api/enums/v1"
+  "go.temporal.io/api/workflowservice/v1"
+  "go.temporal.io/api/serviceerror"
 )
 
 type PageHandler struct {
-  TemporalClient client.Client
-  Template       *template.Template
-  TaskQueue      string
-  RepoURL        string
-  BranchPrefix   string
+  TemporalClient  client.Client
+  Template        *template.Template
+  TaskQueue       string
+  RepoURL         string
+  BranchPrefix    string
+  Auth            *Auth
+  Quotas          *services.QuotaService
+  Budgets         *services.BudgetService
+  RunBudget       shared.RunBudget // Limits of each run; capped by the submitter's remaining monthly budget
+  RunSettings     shared.RunSettings // Worker settings passed to each run
+  RequireApproval bool   // Runs by users without PermApprove wait for approval before pushing
+  UserAttribute   string // Keyword search attribute recording the submitter; empty disables it
+  Limits          RequestLimits
 }
 
-func NewPageHandler(client client.Client) (*PageHandler, error) {
-  tmpl, err := template.ParseFiles("templates/index.html.tmpl")
+// memoRequestedBy is the memo key holding the submitter's user ID.
+const memoRequestedBy = "requestedBy"
+
+func NewPageHandler(client client.Client, auth *Auth, quotas *services.QuotaService, budgets *services.BudgetService) (*PageHandler, error) {
+  tmpl, err := template.New("index.html.tmpl").Funcs(template.FuncMap{"join": strings.Join}).ParseFiles("templates/index.html.tmpl")
   if err != nil {
     return nil, fmt.Errorf("failed to parse template: %w", err)
   }
@@ -41,25 +64,71 @@ func NewPageHandler(client client.Client) (*PageHandler, error) {
     branchPrefix := os.Getenv("BRANCH_PREFIX") // Optional, workflow uses default if empty
 
 
+    // The search attribute must be registered in the namespace; see README.
+    userAttribute, ok := os.LookupEnv("USER_SEARCH_ATTRIBUTE")
+    if !ok {
+        userAttribute = "HammerUser"
+    }
+    limits, err := LoadRequestLimitsFromEnv()
+    if err != nil {
+        return nil, err
+    }
+    runBudget, err := services.LoadRunBudgetFromEnv()
+    if err != nil {
+        return nil, err
+    }
+    // Each run reserves its dollar limit of the monthly caps while it is in flight.
+    if budgets.Capped() && runBudget.MaxCostUSD == 0 {
+        return nil, fmt.Errorf("BUDGETS_FILE sets monthly budgets, so RUN_BUDGET_USD must be set to the amount each run may spend")
+    }
+
   return &PageHandler{
-    TemporalClient: client,
-    Template:       tmpl,
-    TaskQueue:      taskQueue,
-    RepoURL:        repoURL,
-    BranchPrefix:   branchPrefix, // Store prefix if needed elsewhere
+    TemporalClient:  client,
+    Template:        tmpl,
+    TaskQueue:       taskQueue,
+    RepoURL:         repoURL,
+    BranchPrefix:    branchPrefix, // Store prefix if needed elsewhere
+    Auth:            auth,
+    Quotas:          quotas,
+    Budgets:         budgets,
+    RunBudget:       runBudget,
+    RunSettings:     services.LoadRunSettingsFromEnv(),
+    RequireApproval: os.Getenv("AUTH_REQUIRE_APPROVAL") == "true",
+    UserAttribute:   userAttribute,
+    Limits:          limits,
   }, nil
 }
 
 func (h *PageHandler) RegisterRoutes(r *chi.Mux) {
-  r.Get("/", h.HandleIndex)
-  r.Post("/submit", h.HandleSubmit)
+  h.Auth.RegisterRoutes(r)
+  r.Group(func(r chi.Router) {
+    r.Use(LimitRequestBody(h.Limits.MaxRequestBytes), h.Auth.Middleware, CSRFProtect)
+    r.With(RequirePermission(PermView)).Get("/", h.HandleIndex)
+    r.With(RequirePermission(PermSubmit)).Post("/submit", h.HandleSubmit)
     // Add a route to check workflow status (optional but useful)
-    r.Get("/status/{workflowID}", h.HandleStatus)
+    r.With(RequirePermission(PermView)).Get("/status/{workflowID}", h.HandleStatus)
+    r.With(RequirePermission(PermView)).Get("/queue/{ticketID}", h.HandleQueue)
+    r.With(RequirePermission(PermApprove)).Post("/approve/{workflowID}", h.HandleApprove)
+    r.With(RequirePermission(PermSubmit)).Post("/cancel/{workflowID}", h.HandleCancel)
+  })
 }
 
 // HandleIndex serves the main page.
 func (h *PageHandler) HandleIndex(w http.ResponseWriter, r *http.Request) {
-  err := h.Template.Execute(w, nil)
+  data := struct {
+    User           *shared.User
+    Logout         bool
+    CSRFToken      string
+    CSPNonce       string
+    MaxPromptChars int
+  }{
+    User:           UserFromContext(r.Context()),
+    Logout:         h.Auth != nil && h.Auth.oidc != nil,
+    CSRFToken:      CSRFToken(r.Context()),
+    CSPNonce:       CSPNonce(r.Context()),
+    MaxPromptChars: h.Limits.MaxPromptChars,
+  }
+  err := h.Template.Execute(w, data)
   if err != nil {
     log.Printf("Error executing template: %v", err)
     http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -70,61 +139,274 @@ func (h *PageHandler) HandleIndex(w http.ResponseWriter, r *http.Request) {
 func (h *PageHandler) HandleSubmit(w http.ResponseWriter, r *http.Request) {
   if err := r.ParseForm(); err != nil {
     log.Printf("Error parsing form: %v", err)
-    http.Error(w, "Bad Request", http.StatusBadRequest)
+    writeFormError(w, err)
     return
   }
 
   prompt := r.FormValue("prompt")
-  if prompt == "" {
-    http.Error(w, "Prompt cannot be empty", http.StatusBadRequest)
+  if strings.TrimSpace(prompt) == "" {
+    writeError(w, "Prompt cannot be empty", http.StatusBadRequest)
+    return
+  }
+  if !utf8.ValidString(prompt) || strings.ContainsRune(prompt, 0) {
+    writeError(w, "Prompt contains invalid characters", http.StatusBadRequest)
+    return
+  }
+  if n := utf8.RuneCountInString(prompt); n > h.Limits.MaxPromptChars {
+    writeError(w, fmt.Sprintf("Prompt is too long (%d characters, the limit is %d)", n, h.Limits.MaxPromptChars), http.StatusBadRequest)
+    return
+  }
+  for _, field := range []string{"branch_name", "follow_up"} {
+    if value := r.FormValue(field); utf8.RuneCountInString(value) > maxFieldChars || strings.ContainsFunc(value, unicode.IsControl) {
+      writeError(w, fmt.Sprintf("Invalid %s: at most %d characters, no control characters", strings.ReplaceAll(field, "_", " "), maxFieldChars), http.StatusBadRequest)
+      return
+    }
+    if value := strings.TrimSpace(r.FormValue(field)); value != "" && plumbing.NewBranchReferenceName(value).Validate() != nil {
+      writeError(w, fmt.Sprintf("Invalid %s: %q is not a valid git branch name", strings.ReplaceAll(field, "_", " "), value), http.StatusBadRequest)
+      return
+    }
+  }
+
+  branchStrategy := r.FormValue("branch_strategy")
+  switch branchStrategy {
+  case "", shared.BranchStrategyCommits, shared.BranchStrategySquash, shared.BranchStrategyRebase:
+  default:
+    writeError(w, "Unknown branch strategy", http.StatusBadRequest)
+    return
+  }
+
+  conflictMode := r.FormValue("conflict_mode")
+  switch conflictMode {
+  case shared.ConflictModeOff, shared.ConflictModeReport, shared.ConflictModeResolve:
+  default:
+    writeError(w, "Unknown conflict mode", http.StatusBadRequest)
+    return
+  }
+
+  agentMode := r.FormValue("agent_mode")
+  switch agentMode {
+  case shared.AgentModePipeline, shared.AgentModeTools:
+  default:
+    writeError(w, "Unknown agent mode", http.StatusBadRequest)
+    return
+  }
+
+  followUp, err := h.resolveFollowUp(r, strings.TrimSpace(r.FormValue("follow_up")))
+  if err != nil {
+    log.Printf("Error resolving follow-up target: %v", err)
+    writeError(w, fmt.Sprintf("Could not resolve follow-up target: %s", err.Error()), http.StatusBadRequest)
     return
   }
 
   // Start Workflow
+  user := UserFromContext(r.Context())
   options := client.StartWorkflowOptions{
     ID:        fmt.Sprintf("codegen-%d", time.Now().UnixNano()), // Unique workflow ID
     TaskQueue: h.TaskQueue,
     // Potentially set WorkflowExecutionTimeout, WorkflowRunTimeout
   }
+  // The run's dollar limit stays reserved until waitForRun charges its actual cost.
+  budgetStatus, err := h.Budgets.Reserve(options.ID, user.ID, user.Teams, h.RunBudget.MaxCostUSD)
+  if err != nil {
+    log.Printf("Rejected submission from user %q: %v", user.ID, err)
+    writeError(w, "Submission rejected: "+strings.TrimPrefix(err.Error(), services.ErrBudgetExceeded.Error()+": "), http.StatusTooManyRequests)
+    return
+  }
+  runBudget := h.RunBudget
+  runBudget.MaxCostUSD = budgetStatus.ReservedUSD
+  if user.ID != "" {
+    options.Memo = map[string]interface{}{memoRequestedBy: user.ID}
+    if h.UserAttribute != "" {
+      options.TypedSearchAttributes = temporal.NewSearchAttributes(temporal.NewSearchAttributeKeyKeyword(h.UserAttribute).ValueSet(user.ID))
+    }
+  }
 
   wfInput := shared.WorkflowInput{
-    UserPrompt: prompt,
-    RepoURL:    h.RepoURL,
+    UserPrompt:     prompt,
+    RepoURL:        h.RepoURL,
+    BranchStrategy: branchStrategy,
+    BranchName:     strings.TrimSpace(r.FormValue("branch_name")),
+    ForceUpdate:    r.FormValue("force_update") == "on",
+    ConflictMode:   conflictMode,
+    AgentMode:      agentMode,
+    SelfReview:     r.FormValue("self_review") == "on",
+    PushPartial:    r.FormValue("push_partial") == "on",
+    Budget:         runBudget,
+    Settings:       h.RunSettings,
+    FollowUpBranch: followUp.BranchName,
+    PriorPrompt:    followUp.UserPrompt,
+    PriorPlan:      followUp.PlannedSteps,
+    Requester:      *user,
+    RequireApproval: h.RequireApproval && !HasPermission(user, PermApprove),
     // BranchPrefix is read from env within the workflow now
   }
 
-  log.Printf("Starting workflow %s for prompt: %s", options.ID, prompt)
-  wfRun, err := h.TemporalClient.ExecuteWorkflow(
-    r.Context(),
-    options,
-    workflows.CodeGenWorkflow, // Workflow function reference
-    wfInput,
-  )
+  // Queued runs start after this request has ended, so they must not use its context.
+  start := func() (string, func(), error) {
+    log.Printf("Starting workflow %s for user %q, prompt: %s", options.ID, user.ID, prompt)
+    wfRun, err := h.TemporalClient.ExecuteWorkflow(
+      context.Background(),
+      options,
+      workflows.CodeGenWorkflow, // Workflow function reference
+      wfInput,
+    )
+    if err != nil {
+      h.Budgets.Settle(options.ID, 0) // Never ran
+      return "", nil, err
+    }
+    log.Printf("Workflow started successfully: ID=%s, RunID=%s", wfRun.GetID(), wfRun.GetRunID())
+    return wfRun.GetID(), func() { h.waitForRun(wfRun) }, nil
+  }
 
+  workflowID, ticket, err := h.Quotas.Submit(user.ID, h.RepoURL, start)
+  if err != nil {
+    h.Budgets.Settle(options.ID, 0)
+  }
+  if errors.Is(err, services.ErrQuotaExceeded) {
+    log.Printf("Rejected submission from user %q: %v", user.ID, err)
+    writeError(w, "Submission rejected: "+strings.TrimPrefix(err.Error(), services.ErrQuotaExceeded.Error()+": "), http.StatusTooManyRequests)
+    return
+  }
   if err != nil {
     log.Printf("Error starting workflow: %v", err)
-    http.Error(w, "Failed to start generation task", http.StatusInternalServerError)
+    writeError(w, "Failed to start generation task", http.StatusInternalServerError)
     return
   }
+  if budgetStatus.Warning != "" {
+    fmt.Fprintf(w, `<div class="warning">Budget warning: %s.</div>`, template.HTMLEscapeString(budgetStatus.Warning))
+  }
+  if ticket != nil {
+    writeQueuedHTML(w, *ticket)
+    return
+  }
+  writeStartedHTML(w, workflowID)
+}
 
-  log.Printf("Workflow started successfully: ID=%s, RunID=%s", wfRun.GetID(), wfRun.GetRunID())
+// HandleQueue reports on a submission waiting for capacity, and switches to the
+// run's status once it has started.
+func (h *PageHandler) HandleQueue(w http.ResponseWriter, r *http.Request) {
+  ticket, ok := h.Quotas.Ticket(chi.URLParam(r, "ticketID"))
+  switch {
+  case !ok:
+    fmt.Fprint(w, `<div class="error">Queued submission not found.</div>`)
+  case ticket.Err != nil:
+    fmt.Fprintf(w, `<div class="error">Queued submission %s failed to start: %s</div>`, template.HTMLEscapeString(ticket.ID), template.HTMLEscapeString(ticket.Err.Error()))
+  case ticket.WorkflowID != "":
+    writeStartedHTML(w, ticket.WorkflowID)
+  default:
+    writeQueuedHTML(w, ticket)
+  }
+}
 
+// writeStartedHTML responds with an HTMX snippet that polls the run's status.
+func writeStartedHTML(w http.ResponseWriter, workflowID string) {
   // Respond with HTMX snippet indicating success and providing workflow ID
   // Include HX-Trigger header for polling if desired
-  statusURL := fmt.Sprintf("/status/%s", wfRun.GetID())
-   w.Header().Set("HX-Trigger", fmt.Sprintf(`{"pollStatus": {"url": "%s", "interval": "3s"}}`, statusURL)) // Trigger polling
+  pollURL := statusURL(workflowID)
+   w.Header().Set("HX-Trigger", pollTrigger(pollURL, "3s")) // Trigger polling
+   id := template.HTMLEscapeString(workflowID)
    fmt.Fprintf(w, `<div class="processing" id="workflow-%s">
-                      Task submitted. Workflow ID: %s (RunID: %s). Checking status...
+                      Task submitted. Workflow ID: %s. Checking status...
                       <div hx-get="%s" hx-trigger="load, pollStatus from:body" hx-swap="outerHTML"></div>
                    </div>`,
-                   wfRun.GetID(), wfRun.GetID(), wfRun.GetRunID(), statusURL)
+                   id, id, template.HTMLEscapeString(pollURL))
+}
 
+// writeQueuedHTML responds with an HTMX snippet that polls a queued submission.
+func writeQueuedHTML(w http.ResponseWriter, ticket services.QueueTicket) {
+  fmt.Fprintf(w, `<div class="processing" hx-get="/queue/%s" hx-trigger="every 5s" hx-swap="outerHTML">
+                    Concurrency limit reached; submission queued (position %d). It starts when one of the running tasks finishes.
+                 </div>`,
+                 template.HTMLEscapeString(url.PathEscape(ticket.ID)), ticket.Position)
 }
 
+// waitForRun blocks until the run has ended and settles its budget reservation
+// with its LLM cost. A failed long poll is retried while the run is still
+// running, so a Temporal hiccup does not free its quota slot.
+func (h *PageHandler) waitForRun(run client.WorkflowRun) {
+  for {
+    var result shared.WorkflowOutput
+    err := run.Get(context.Background(), &result)
+    if err == nil {
+      cost := 0.0
+      if result.Usage != nil {
+        cost = result.Usage.Total.CostUSD
+      }
+      h.Budgets.Settle(run.GetID(), cost)
+      return
+    }
+    resp, describeErr := h.TemporalClient.DescribeWorkflowExecution(context.Background(), run.GetID(), run.GetRunID())
+    var notFound *serviceerror.NotFound
+    if errors.As(describeErr, &notFound) {
+      h.Budgets.Settle(run.GetID(), 0) // Never started, e.g. queued when the server stopped
+      return
+    }
+    if describeErr == nil && resp.GetWorkflowExecutionInfo().GetStatus() != temporalApiEnums.WORKFLOW_EXECUTION_STATUS_RUNNING {
+      h.settleEndedRun(run.GetID(), run.GetRunID())
+      return
+    }
+    time.Sleep(10 * time.Second)
+  }
+}
+
+// settleEndedRun settles the reservation of a run that ended without a result
+// (failed, terminated or timed out) with the usage its history records. If that
+// cannot be queried, the run is charged its whole reservation.
+func (h *PageHandler) settleEndedRun(workflowID, runID string) {
+  var total shared.UsageTotals
+  value, err := h.TemporalClient.QueryWorkflow(context.Background(), workflowID, runID, shared.QueryUsage)
+  if err == nil {
+    err = value.Get(&total)
+  }
+  if err != nil {
+    log.Printf("Budget: failed to query the usage of run %s, charging its whole reservation: %v", workflowID, err)
+    h.Budgets.SettleInFull(workflowID)
+    return
+  }
+  h.Budgets.Settle(workflowID, total.CostUSD)
+}
+
+// SettlePendingRuns settles the budget reservations left by an earlier server
+// process, waiting for the runs that are still going. Call it once at startup.
+func (h *PageHandler) SettlePendingRuns() {
+  for _, workflowID := range h.Budgets.Pending() {
+    log.Printf("Budget: settling reservation of run %s from before the restart", workflowID)
+    go h.waitForRun(h.TemporalClient.GetWorkflow(context.Background(), workflowID, ""))
+  }
+}
+
+
+// resolveFollowUp turns the follow-up form value into the previous run's output.
+// The value may be a previous workflow ID (its result supplies the branch, prompt
+// and plan) or the name of an existing branch. An empty value means a fresh run.
+func (h *PageHandler) resolveFollowUp(r *http.Request, target string) (shared.WorkflowOutput, error) {
+  if target == "" {
+    return shared.WorkflowOutput{}, nil
+  }
+  if !strings.HasPrefix(target, "codegen-") {
+    return shared.WorkflowOutput{BranchName: target}, nil
+  }
+  resp, err := h.TemporalClient.DescribeWorkflowExecution(r.Context(), target, "")
+  if err != nil {
+    return shared.WorkflowOutput{}, fmt.Errorf("previous run %s not found: %w", target, err)
+  }
+  if status := resp.GetWorkflowExecutionInfo().GetStatus(); status != temporalApiEnums.WORKFLOW_EXECUTION_STATUS_COMPLETED {
+    return shared.WorkflowOutput{}, fmt.Errorf("previous run %s has status %s, expected completed", target, status.String())
+  }
+  var prior shared.WorkflowOutput
+  if err := h.TemporalClient.GetWorkflow(r.Context(), target, "").Get(r.Context(), &prior); err != nil {
+    return shared.WorkflowOutput{}, fmt.Errorf("previous run %s has no usable result: %w", target, err)
+  }
+  if prior.BranchName == "" {
+    return shared.WorkflowOutput{}, fmt.Errorf("previous run %s did not produce a branch", target)
+  }
+  return prior, nil
+}
 
 // HandleStatus checks the status of a workflow and returns an HTMX snippet.
 func (h *PageHandler) HandleStatus(w http.ResponseWriter, r *http.Request) {
     workflowID := chi.URLParam(r, "workflowID")
+    id := template.HTMLEscapeString(workflowID) // Every dynamic value is escaped before it reaches the page
     // RunID is usually empty for DescribeWorkflowExecution, ID is sufficient
     log.Printf("Checking status for workflow: %s", workflowID)
 
@@ -133,18 +415,18 @@ func (h *PageHandler) HandleStatus(w http.ResponseWriter, r *http.Request) {
         log.Printf("Error describing workflow %s: %v", workflowID, err)
         // Don't stop polling on transient errors maybe? Or signal stop?
         // For now, return an error message but allow polling to potentially continue
-         fmt.Fprintf(w, `<div id="workflow-%s" class="error">Error checking status for %s: %v</div>`, workflowID, workflowID, err)
+         fmt.Fprintf(w, `<div id="workflow-%s" class="error">Error checking status for %s: %s</div>`, id, id, template.HTMLEscapeString(err.Error()))
         return
     }
 
     status := resp.GetWorkflowExecutionInfo().GetStatus()
-    resultDivID := fmt.Sprintf("workflow-%s", workflowID) // ID for the whole status div
+    resultDivID := "workflow-" + id // ID for the whole status div
 
     switch status {
     case temporalApiEnums.WORKFLOW_EXECUTION_STATUS_RUNNING:
          // Still running, keep polling indicator
-         w.Header().Set("HX-Trigger", fmt.Sprintf(`{"pollStatus": {"url": "/status/%s", "interval": "3s"}}`, workflowID))
-         fmt.Fprintf(w, `<div id="%s" class="processing">Workflow %s is running... Status: %s</div>`, resultDivID, workflowID, status.String())
+         w.Header().Set("HX-Trigger", pollTrigger(statusURL(workflowID), "3s"))
+         fmt.Fprintf(w, `<div id="%s" class="processing">Workflow %s is running... Status: %s%s</div>`, resultDivID, id, status.String(), h.runActionsHTML(r, workflowID, requestedBy(resp)))
     case temporalApiEnums.WORKFLOW_EXECUTION_STATUS_COMPLETED:
          // Workflow finished, get result and stop polling
          var result shared.WorkflowOutput
@@ -153,25 +435,270 @@ func (h *PageHandler) HandleStatus(w http.ResponseWriter, r *http.Request) {
          err := h.TemporalClient.GetWorkflow(r.Context(), workflowID, runID).Get(r.Context(), &result)
          if err != nil {
               log.Printf("Error getting workflow result for %s (%s): %v", workflowID, runID, err)
-             fmt.Fprintf(w, `<div id="%s" class="error">Workflow %s completed, but failed to get result: %v</div>`, resultDivID, workflowID, err)
+             fmt.Fprintf(w, `<div id="%s" class="error">Workflow %s completed, but failed to get result: %s</div>`, resultDivID, id, template.HTMLEscapeString(err.Error()))
          } else {
               log.Printf("Workflow %s completed successfully. Branch: %s", workflowID, result.BranchName)
-              fmt.Fprintf(w, `<div id="%s" class="success">Workflow %s completed! ✅<br/>Result: %s</div>`, resultDivID, workflowID, template.HTMLEscapeString(result.Message))
+              outcome := "completed! ✅"
+              if result.Canceled {
+                  outcome = "was canceled ⏹"
+              } else if result.BudgetExceeded {
+                  outcome = "stopped: budget exceeded 💸"
+              }
+              fmt.Fprintf(w, `<div id="%s" class="success">Workflow %s %s<br/>Result: %s%s</div>`, resultDivID, id, outcome, template.HTMLEscapeString(result.Message), requesterHTML(result)+usageHTML(result.Usage)+secretFindingsHTML(result.SecretFindings)+guardrailFindingsHTML(result.ScopeFindings, result.InjectionFindings)+repoConfigHTML(result.RepoConfig)+contextReportsHTML(result.ContextReports)+prDescriptionHTML(result.PRDescription))
          }
     case temporalApiEnums.WORKFLOW_EXECUTION_STATUS_FAILED, temporalApiEnums.WORKFLOW_EXECUTION_STATUS_TIMED_OUT, temporalApiEnums.WORKFLOW_EXECUTION_STATUS_TERMINATED, temporalApiEnums.WORKFLOW_EXECUTION_STATUS_CANCELED:
          // Workflow ended unsuccessfully, stop polling
           // Attempt to get error details if failed
-          var workflowErr error
+          workflowErr := "none"
           runID := resp.GetWorkflowExecutionInfo().GetExecution().GetRunId()
           err := h.TemporalClient.GetWorkflow(r.Context(), workflowID, runID).Get(r.Context(), nil) // Getting result into nil extracts the error
           if err != nil {
-              workflowErr = err
+              workflowErr = err.Error()
           }
-          log.Printf("Workflow %s ended with status %s. Error: %v", workflowID, status.String(), workflowErr)
-          fmt.Fprintf(w, `<div id="%s" class="error">Workflow %s ended with status: %s ❌<br/>Error: %v</div>`, resultDivID, workflowID, status.String(), workflowErr)
+          log.Printf("Workflow %s ended with status %s. Error: %s", workflowID, status.String(), workflowErr)
+          fmt.Fprintf(w, `<div id="%s" class="error">Workflow %s ended with status: %s ❌<br/>Error: %s</div>`, resultDivID, id, status.String(), template.HTMLEscapeString(workflowErr))
     default:
         // Unknown status, keep polling?
-         w.Header().Set("HX-Trigger", fmt.Sprintf(`{"pollStatus": {"url": "/status/%s", "interval": "5s"}}`, workflowID)) // Poll less frequently
-         fmt.Fprintf(w, `<div id="%s" class="processing">Workflow %s has status: %s. Continuing check...</div>`, resultDivID, workflowID, status.String())
+         w.Header().Set("HX-Trigger", pollTrigger(statusURL(workflowID), "5s")) // Poll less frequently
+         fmt.Fprintf(w, `<div id="%s" class="processing">Workflow %s has status: %s. Continuing check...</div>`, resultDivID, id, status.String())
+    }
+}
+
+// HandleApprove lets a run that waits for approval push its branch. Runs that
+// are not waiting yet, or any more, answer 409 Conflict.
+func (h *PageHandler) HandleApprove(w http.ResponseWriter, r *http.Request) {
+  workflowID := chi.URLParam(r, "workflowID")
+  user := UserFromContext(r.Context())
+  value, err := h.TemporalClient.QueryWorkflow(r.Context(), workflowID, "", shared.QueryAwaitingApproval)
+  var awaiting bool
+  if err == nil {
+    err = value.Get(&awaiting)
+  }
+  if err != nil {
+    log.Printf("Error checking whether workflow %s awaits approval: %v", workflowID, err)
+    writeError(w, "Failed to approve run", http.StatusInternalServerError)
+    return
+  }
+  if !awaiting {
+    writeError(w, "Run is not waiting for approval", http.StatusConflict)
+    return
+  }
+  err = h.TemporalClient.SignalWorkflow(r.Context(), workflowID, "", shared.SignalApproveRun, shared.RunApproval{ApprovedBy: user.ID})
+  if err != nil {
+    log.Printf("Error approving workflow %s: %v", workflowID, err)
+    writeError(w, "Failed to approve run", http.StatusInternalServerError)
+    return
+  }
+  log.Printf("Workflow %s approved by %q", workflowID, user.ID)
+  fmt.Fprintf(w, `<span class="processing">Approved by %s.</span>`, template.HTMLEscapeString(displayName(user)))
+}
+
+// HandleCancel requests cancellation of a run. Users with PermCancel may cancel
+// any run; submitters only their own.
+func (h *PageHandler) HandleCancel(w http.ResponseWriter, r *http.Request) {
+  workflowID := chi.URLParam(r, "workflowID")
+  user := UserFromContext(r.Context())
+  if !HasPermission(user, PermCancel) {
+    resp, err := h.TemporalClient.DescribeWorkflowExecution(r.Context(), workflowID, "")
+    if err != nil {
+      writeError(w, "Run not found", http.StatusNotFound)
+      return
+    }
+    if owner := requestedBy(resp); owner == "" || owner != user.ID {
+      writeError(w, "Forbidden", http.StatusForbidden)
+      return
+    }
+  }
+  if err := h.TemporalClient.CancelWorkflow(r.Context(), workflowID, ""); err != nil {
+    log.Printf("Error canceling workflow %s: %v", workflowID, err)
+    writeError(w, "Failed to cancel run", http.StatusInternalServerError)
+    return
+  }
+  log.Printf("Workflow %s cancellation requested by %q", workflowID, user.ID)
+  fmt.Fprint(w, `<span class="processing">Cancellation requested.</span>`)
+}
+
+// runActionsHTML renders the approve and cancel buttons the user may use on a
+// running workflow.
+func (h *PageHandler) runActionsHTML(r *http.Request, workflowID, owner string) string {
+  user := UserFromContext(r.Context())
+  var b strings.Builder
+  if owner != "" {
+    fmt.Fprintf(&b, `<br/>Requested by %s.`, template.HTMLEscapeString(owner))
+  }
+  var awaiting bool
+  if value, err := h.TemporalClient.QueryWorkflow(r.Context(), workflowID, "", shared.QueryAwaitingApproval); err == nil {
+    _ = value.Get(&awaiting)
+  }
+  if awaiting {
+    b.WriteString(` Waiting for approval before pushing.`)
+    if HasPermission(user, PermApprove) {
+      fmt.Fprintf(&b, ` <button hx-post="/approve/%s" hx-swap="outerHTML">Approve</button>`, template.HTMLEscapeString(url.PathEscape(workflowID)))
+    }
+  }
+  if HasPermission(user, PermCancel) || (owner != "" && owner == user.ID && HasPermission(user, PermSubmit)) {
+    fmt.Fprintf(&b, ` <button hx-post="/cancel/%s" hx-swap="outerHTML" hx-confirm="Cancel this run?">Cancel</button>`, template.HTMLEscapeString(url.PathEscape(workflowID)))
+  }
+  return b.String()
+}
+
+// requestedBy returns the submitter's user ID from the run's memo, or "".
+func requestedBy(resp *workflowservice.DescribeWorkflowExecutionResponse) string {
+  payload, ok := resp.GetWorkflowExecutionInfo().GetMemo().GetFields()[memoRequestedBy]
+  if !ok {
+    return ""
+  }
+  var id string
+  if err := converter.GetDefaultDataConverter().FromPayload(payload, &id); err != nil {
+    return ""
+  }
+  return id
+}
+
+// requesterHTML names who submitted and approved a completed run.
+func requesterHTML(result shared.WorkflowOutput) string {
+  if result.RequestedBy == "" {
+    return ""
+  }
+  html := `<br/>Requested by ` + template.HTMLEscapeString(result.RequestedBy)
+  if result.ApprovedBy != "" {
+    html += `, approved by ` + template.HTMLEscapeString(result.ApprovedBy)
+  }
+  return html + "."
+}
+
+func displayName(user *shared.User) string {
+  if user.Name != "" {
+    return user.Name
+  }
+  return user.ID
+}
+
+// usageHTML shows the run's LLM tokens, latency and cost per step and in total.
+func usageHTML(usage *shared.RunUsage) string {
+    if usage == nil || usage.Total.Calls == 0 {
+        return ""
+    }
+    row := func(label string, t shared.UsageTotals) string {
+        return fmt.Sprintf(`<tr><th>%s</th><td>%d</td><td>%d</td><td>%d</td><td>%d</td><td>%.1fs</td><td>$%.4f</td></tr>`,
+            template.HTMLEscapeString(label), t.Calls, t.CachedCalls, t.PromptTokens, t.CompletionTokens, float64(t.LatencyMs)/1000, t.CostUSD)
+    }
+    var b strings.Builder
+    fmt.Fprintf(&b, `<details class="usage"><summary>LLM usage: %d tokens, $%.4f</summary><table>`, usage.Total.Tokens(), usage.Total.CostUSD)
+    b.WriteString(`<tr><th></th><th>Calls</th><th>Cached</th><th>Prompt tokens</th><th>Completion tokens</th><th>Latency</th><th>Cost</th></tr>`)
+    var outside shared.UsageTotals
+    for _, c := range usage.Calls {
+        if c.Step == 0 {
+            outside.Add(c)
+        }
+    }
+    for _, s := range usage.Steps {
+        b.WriteString(row(fmt.Sprintf("Step %d", s.Step), s.UsageTotals))
+    }
+    if outside.Calls > 0 {
+        b.WriteString(row("Planning and merge", outside))
+    }
+    b.WriteString(row("Total", usage.Total))
+    b.WriteString(`</table></details>`)
+    return b.String()
+}
+
+// repoConfigHTML renders the effective .hammer.yaml settings used by a run.
+func repoConfigHTML(cfg *shared.RepoConfig) string {
+    if cfg == nil {
+        return ""
+    }
+    orNone := func(v string) string {
+        if v == "" {
+            return "(none)"
+        }
+        return v
+    }
+    maxFiles := "unlimited"
+    if cfg.MaxFilesPerStep > 0 {
+        maxFiles = fmt.Sprintf("%d", cfg.MaxFilesPerStep)
+    }
+    maxBytes := "default"
+    if cfg.MaxFileBytes > 0 {
+        maxBytes = fmt.Sprintf("%d", cfg.MaxFileBytes)
+    }
+    rows := [][2]string{
+        {"Conventions", orNone(cfg.Conventions)},
+        {"Build command", orNone(cfg.BuildCommand)},
+        {"Test command", orNone(cfg.TestCommand)},
+        {"Ignored paths", orNone(strings.Join(cfg.IgnorePaths, ", "))},
+        {"Protected paths", orNone(strings.Join(cfg.ProtectedPaths, ", "))},
+        {"Max files per step", maxFiles},
+        {"Max file size (bytes)", maxBytes},
+        {"Branch prefix", orNone(cfg.BranchPrefix)},
+        {"Secret allow-list", orNone(strings.Join(cfg.SecretAllowlist, ", "))},
+    }
+    var b strings.Builder
+    b.WriteString(`<details class="repo-config"><summary>Effective repository config</summary><table>`)
+    for _, row := range rows {
+        fmt.Fprintf(&b, `<tr><th>%s</th><td><pre>%s</pre></td></tr>`, template.HTMLEscapeString(row[0]), template.HTMLEscapeString(row[1]))
+    }
+    b.WriteString(`</table></details>`)
+    return b.String()
+}
+
+// contextReportsHTML lists, per step, the files that had to be reduced to fit the
+// code generator's context window.
+func contextReportsHTML(reports []shared.ContextReport) string {
+    var b strings.Builder
+    for _, r := range reports {
+        reduced := r.Reduced()
+        if len(reduced) == 0 {
+            continue
+        }
+        fmt.Fprintf(&b, `<tr><th>Step %d</th><td>%s</td></tr>`, r.Step, template.HTMLEscapeString(strings.Join(reduced, ", ")))
+    }
+    if b.Len() == 0 {
+        return ""
+    }
+    return `<details class="context-report"><summary>Files reduced to fit the context window</summary><table>` + b.String() + `</table></details>`
+}
+
+// secretFindingsHTML flags potential secrets in the run's changes. The matches are
+// already redacted.
+func secretFindingsHTML(findings []shared.SecretFinding) string {
+    if len(findings) == 0 {
+        return ""
+    }
+    var b strings.Builder
+    fmt.Fprintf(&b, `<div class="error secret-findings">%d potential secret(s) found; the branch was not pushed.<table>`, len(findings))
+    for _, f := range findings {
+        fmt.Fprintf(&b, `<tr><th>%s:%d</th><td>%s</td><td><code>%s</code></td></tr>`,
+            template.HTMLEscapeString(f.File), f.Line, template.HTMLEscapeString(f.Rule), template.HTMLEscapeString(f.Match))
+    }
+    b.WriteString(`</table></div>`)
+    return b.String()
+}
+
+// guardrailFindingsHTML lists generated changes outside the plan and repository
+// text that looked like instructions to the model.
+func guardrailFindingsHTML(scope []shared.ScopeFinding, injections []shared.InjectionFinding) string {
+    if len(scope) == 0 && len(injections) == 0 {
+        return ""
+    }
+    var b strings.Builder
+    b.WriteString(`<details class="guardrails" open><summary>Prompt-injection guardrails</summary><table>`)
+    for _, f := range scope {
+        fmt.Fprintf(&b, `<tr><th>Step %d: %s</th><td>%s</td></tr>`, f.Step, template.HTMLEscapeString(f.File), template.HTMLEscapeString(f.Reason))
+    }
+    for _, f := range injections {
+        fmt.Fprintf(&b, `<tr><th>%s:%d</th><td>%s</td><td><code>%s</code></td></tr>`,
+            template.HTMLEscapeString(f.File), f.Line, template.HTMLEscapeString(f.Rule), template.HTMLEscapeString(f.Excerpt))
+    }
+    b.WriteString(`</table></details>`)
+    return b.String()
+}
+
+// prDescriptionHTML shows the run's pull request description, including any
+// self-review notes, ready to copy.
+func prDescriptionHTML(description string) string {
+    if description == "" {
+        return ""
     }
+    return `<details class="pr-description"><summary>Pull request description</summary><pre>` + template.HTMLEscapeString(description) + `</pre></details>`
 }
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+  "context"
+  "crypto/rand"
+  "crypto/subtle"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "html/template"
+  "log"
+  "net/http"
+  "net/url"
+  "os"
+  "strconv"
+  "strings"
+)
+
+// Defaults for the request limits; see LoadRequestLimitsFromEnv.
+const (
+  defaultMaxRequestBytes = 64 << 10
+  defaultMaxPromptChars  = 8000
+  maxFieldChars          = 255 // Branch names and follow-up targets
+)
+
+// CSRF token names. HTMX sends the header on every request; the form field
+// covers submissions without JavaScript.
+const (
+  csrfCookie = "hammer_csrf"
+  csrfHeader = "X-CSRF-Token"
+  csrfField  = "csrf_token"
+)
+
+// RequestLimits caps what a client may send.
+type RequestLimits struct {
+  MaxRequestBytes int64 // Request body size
+  MaxPromptChars  int   // Characters in the task prompt
+}
+
+// LoadRequestLimitsFromEnv reads MAX_REQUEST_BYTES and MAX_PROMPT_CHARS.
+func LoadRequestLimitsFromEnv() (RequestLimits, error) {
+  limits := RequestLimits{MaxRequestBytes: defaultMaxRequestBytes, MaxPromptChars: defaultMaxPromptChars}
+  if value := os.Getenv("MAX_REQUEST_BYTES"); value != "" {
+    n, err := strconv.ParseInt(value, 10, 64)
+    if err != nil || n <= 0 {
+      return RequestLimits{}, fmt.Errorf("MAX_REQUEST_BYTES must be a positive integer, got %q", value)
+    }
+    limits.MaxRequestBytes = n
+  }
+  if value := os.Getenv("MAX_PROMPT_CHARS"); value != "" {
+    n, err := strconv.Atoi(value)
+    if err != nil || n <= 0 {
+      return RequestLimits{}, fmt.Errorf("MAX_PROMPT_CHARS must be a positive integer, got %q", value)
+    }
+    limits.MaxPromptChars = n
+  }
+  return limits, nil
+}
+
+// LimitRequestBody fails reads past n bytes of a request body.
+func LimitRequestBody(n int64) func(http.Handler) http.Handler {
+  return func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      r.Body = http.MaxBytesReader(w, r.Body, n)
+      next.ServeHTTP(w, r)
+    })
+  }
+}
+
+type cspNonceContextKey struct{}
+
+// CSPNonce returns the nonce inline scripts need to run under the
+// Content-Security-Policy set by SecurityHeaders.
+func CSPNonce(ctx context.Context) string {
+  nonce, _ := ctx.Value(cspNonceContextKey{}).(string)
+  return nonce
+}
+
+// SecurityHeaders sets a Content-Security-Policy with a fresh script nonce and
+// headers that stop framing, MIME sniffing and referrer leaks.
+func SecurityHeaders(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    nonce := randomToken(16)
+    h := w.Header()
+    h.Set("Content-Security-Policy", fmt.Sprintf("default-src 'self'; script-src 'self' 'nonce-%s' https://unpkg.com; "+
+      "style-src 'self' 'unsafe-inline'; img-src 'self' data:; connect-src 'self'; form-action 'self'; "+
+      "frame-ancestors 'none'; base-uri 'none'; object-src 'none'", nonce))
+    h.Set("X-Content-Type-Options", "nosniff")
+    h.Set("X-Frame-Options", "DENY")
+    h.Set("Referrer-Policy", "same-origin")
+    h.Set("Cross-Origin-Opener-Policy", "same-origin")
+    h.Set("Permissions-Policy", "camera=(), microphone=(), geolocation=()")
+    if isHTTPS(r) {
+      h.Set("Strict-Transport-Security", "max-age=31536000")
+    }
+    next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cspNonceContextKey{}, nonce)))
+  })
+}
+
+type csrfContextKey struct{}
+
+// CSRFToken returns the token a page must send back with state-changing requests.
+func CSRFToken(ctx context.Context) string {
+  token, _ := ctx.Value(csrfContextKey{}).(string)
+  return token
+}
+
+// CSRFProtect rejects state-changing requests from other sites. It uses a
+// double-submit token: a random value in a SameSite cookie that the page must
+// echo in the X-CSRF-Token header or the csrf_token form field. Requests with a
+// bearer token are exempt, since browsers never attach one on their own.
+func CSRFProtect(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    var token string
+    if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) >= 32 {
+      token = c.Value
+    } else {
+      token = randomToken(32)
+      http.SetCookie(w, &http.Cookie{
+        Name:     csrfCookie,
+        Value:    token,
+        Path:     "/",
+        HttpOnly: true,
+        Secure:   isHTTPS(r),
+        SameSite: http.SameSiteStrictMode,
+      })
+    }
+    r = r.WithContext(context.WithValue(r.Context(), csrfContextKey{}, token))
+
+    switch r.Method {
+    case http.MethodGet, http.MethodHead, http.MethodOptions:
+      next.ServeHTTP(w, r)
+      return
+    }
+    if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+      next.ServeHTTP(w, r)
+      return
+    }
+    if !sameOrigin(r) {
+      log.Printf("CSRF: rejected %s %s from origin %q", r.Method, r.URL.Path, r.Header.Get("Origin"))
+      writeError(w, "Cross-site request rejected", http.StatusForbidden)
+      return
+    }
+    sent := r.Header.Get(csrfHeader)
+    if sent == "" {
+      if err := r.ParseForm(); err != nil {
+        writeFormError(w, err)
+        return
+      }
+      sent = r.PostFormValue(csrfField)
+    }
+    if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+      log.Printf("CSRF: rejected %s %s with a missing or stale token", r.Method, r.URL.Path)
+      writeError(w, "Invalid or missing CSRF token; reload the page and try again", http.StatusForbidden)
+      return
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+// sameOrigin reports whether the request's Origin (or, failing that, Referer)
+// names this host. Requests carrying neither are left to the token check.
+func sameOrigin(r *http.Request) bool {
+  source := r.Header.Get("Origin")
+  if source == "" {
+    source = r.Header.Get("Referer")
+  }
+  if source == "" {
+    return true
+  }
+  u, err := url.Parse(source)
+  if err != nil {
+    return false
+  }
+  return strings.EqualFold(u.Host, r.Host)
+}
+
+func isHTTPS(r *http.Request) bool {
+  return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func randomToken(n int) string {
+  b := make([]byte, n)
+  if _, err := rand.Read(b); err != nil {
+    panic(fmt.Sprintf("crypto/rand failed: %v", err)) // Not recoverable
+  }
+  return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// writeFormError responds to a request whose form could not be parsed.
+func writeFormError(w http.ResponseWriter, err error) {
+  var tooLarge *http.MaxBytesError
+  if errors.As(err, &tooLarge) {
+    writeError(w, fmt.Sprintf("Request too large (limit %d bytes)", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+    return
+  }
+  writeError(w, "Bad Request", http.StatusBadRequest)
+}
+
+// writeError responds with an escaped HTML error snippet. HTMX swaps error
+// responses into the page, so they must never carry raw input.
+func writeError(w http.ResponseWriter, msg string, code int) {
+  w.Header().Set("Content-Type", "text/html; charset=utf-8")
+  w.WriteHeader(code)
+  fmt.Fprintf(w, `<div class="error">%s</div>`, template.HTMLEscapeString(msg))
+}
+
+// pollTrigger returns an HX-Trigger header value that polls url.
+func pollTrigger(url, interval string) string {
+  value, _ := json.Marshal(map[string]any{"pollStatus": map[string]string{"url": url, "interval": interval}})
+  return string(value)
+}
+
+// statusURL returns the status endpoint of a run.
+func statusURL(workflowID string) string {
+  return "/status/" + url.PathEscape(workflowID)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+  "fmt"
   "log"
   "net/http"
   "os"
@@ -26,6 +27,18 @@ func main() {
 		 log.Println("No .env file found, using environment variables or defaults")
 	 }
 
+	 // `validate-prompts [dir]` renders every prompt template against sample data and exits.
+	 if len(os.Args) > 1 && os.Args[1] == "validate-prompts" {
+		 dir := os.Getenv("PROMPTS_DIR")
+		 if len(os.Args) > 2 { dir = os.Args[2] }
+		 os.Exit(validatePrompts(dir))
+	 }
+
+	 // `hash-password <password>` and `hash-token <token>` print values for AUTH_USERS_FILE.
+	 if len(os.Args) == 3 && (os.Args[1] == "hash-password" || os.Args[1] == "hash-token") {
+		 os.Exit(hashSecret(os.Args[1], os.Args[2]))
+	 }
+
 	 // Read necessary config (Temporal, OpenAI key)
 	 temporalAddr := os.Getenv("TEMPORAL_ADDRESS")
 	 if temporalAddr == "" { temporalAddr = "localhost:7233" }
@@ -44,7 +57,30 @@ func main() {
 
 
 	// Init Services (LLM Service needed by activities)
-	 llmService := services.NewLLMService(apiKey)
+	 prompts, err := services.LoadPromptSet(os.Getenv("PROMPTS_DIR"))
+	 if err != nil { log.Fatalf("Failed to load prompt templates: %v", err) }
+	 llmService := services.NewLLMService(apiKey, prompts)
+	 if pattern := os.Getenv("COMMIT_MESSAGE_PATTERN"); pattern != "" {
+		 if err := llmService.SetCommitMessagePattern(pattern); err != nil { log.Fatalf("Invalid COMMIT_MESSAGE_PATTERN: %v", err) }
+	 }
+	 prices, err := services.LoadPriceTableFromEnv()
+	 if err != nil { log.Fatalf("Invalid LLM_PRICES: %v", err) }
+	 llmService.SetPriceTable(prices)
+	 cacheConfig, err := services.LoadLLMCacheConfigFromEnv()
+	 if err != nil { log.Fatalf("Invalid LLM cache config: %v", err) }
+	 responseCache, err := services.NewResponseCache(cacheConfig)
+	 if err != nil { log.Fatalf("Failed to open LLM cache: %v", err) }
+	 llmService.SetResponseCache(responseCache)
+	 commitSigner, err := services.LoadCommitSignerFromEnv()
+	 if err != nil { log.Fatalf("Failed to load commit signing key: %v", err) }
+	 writePolicy, err := services.LoadWritePolicyFromEnv()
+	 if err != nil { log.Fatalf("Invalid write policy: %v", err) }
+	 agentToolOptions := services.AgentToolOptions{AllowVerification: os.Getenv("AGENT_ALLOW_VERIFICATION") == "true"}
+	 if timeout := os.Getenv("AGENT_VERIFICATION_TIMEOUT"); timeout != "" {
+		 d, err := time.ParseDuration(timeout)
+		 if err != nil { log.Fatalf("Invalid AGENT_VERIFICATION_TIMEOUT: %v", err) }
+		 agentToolOptions.VerificationTimeout = d
+	 }
 
 
 	// Init Temporal Worker
@@ -57,12 +93,18 @@ func main() {
 
 	// Register Activities
 	 llmActivities := activities.NewLLMActivities(llmService)
-	 gitActivities := activities.NewGitActivities() // Holds state map
+	 gitActivities := activities.NewGitActivities(commitSigner, agentToolOptions, writePolicy) // Holds state map
+	 gitActivities.SetRepoPromptsAllowed(os.Getenv("ALLOW_REPO_PROMPTS") == "true")
 
 	 // LLM Activities
 	 w.RegisterActivityWithOptions(llmActivities.PlanStepsActivity, activity.RegisterOptions{Name: activities.ActivityName_PlanSteps})
 	 w.RegisterActivityWithOptions(llmActivities.EvaluateFilesActivity, activity.RegisterOptions{Name: activities.ActivityName_EvaluateFiles})
 	 w.RegisterActivityWithOptions(llmActivities.GenerateCodeActivity, activity.RegisterOptions{Name: activities.ActivityName_GenerateCode})
+	 w.RegisterActivityWithOptions(llmActivities.GenerateCommitMessageActivity, activity.RegisterOptions{Name: activities.ActivityName_GenerateCommitMessage})
+	 w.RegisterActivityWithOptions(llmActivities.ResolveConflictActivity, activity.RegisterOptions{Name: activities.ActivityName_ResolveConflict})
+	 w.RegisterActivityWithOptions(llmActivities.SelectDirectoriesActivity, activity.RegisterOptions{Name: activities.ActivityName_SelectDirectories})
+	 w.RegisterActivityWithOptions(llmActivities.AgentTurnActivity, activity.RegisterOptions{Name: activities.ActivityName_AgentTurn})
+	 w.RegisterActivityWithOptions(llmActivities.ReviewCodeActivity, activity.RegisterOptions{Name: activities.ActivityName_ReviewCode})
 
 	 // Git Activities
 	 w.RegisterActivityWithOptions(gitActivities.InitGitActivity, activity.RegisterOptions{Name: activities.ActivityName_InitGit})
@@ -72,6 +114,19 @@ func main() {
 	 w.RegisterActivityWithOptions(gitActivities.WriteFilesAndCommitActivity, activity.RegisterOptions{Name: activities.ActivityName_WriteFilesAndCommit})
 	 w.RegisterActivityWithOptions(gitActivities.CreateBranchActivity, activity.RegisterOptions{Name: activities.ActivityName_CreateBranch})
 	 w.RegisterActivityWithOptions(gitActivities.PushBranchActivity, activity.RegisterOptions{Name: activities.ActivityName_PushBranch})
+	 w.RegisterActivityWithOptions(gitActivities.DiffChangesGitActivity, activity.RegisterOptions{Name: activities.ActivityName_DiffChangesGit})
+	 w.RegisterActivityWithOptions(gitActivities.ApplyBranchStrategyActivity, activity.RegisterOptions{Name: activities.ActivityName_ApplyBranchStrategy})
+	 w.RegisterActivityWithOptions(gitActivities.CheckMergeConflictsActivity, activity.RegisterOptions{Name: activities.ActivityName_CheckMergeConflicts})
+	 w.RegisterActivityWithOptions(gitActivities.ReadConflictFileActivity, activity.RegisterOptions{Name: activities.ActivityName_ReadConflictFile})
+	 w.RegisterActivityWithOptions(gitActivities.MergeUpstreamActivity, activity.RegisterOptions{Name: activities.ActivityName_MergeUpstream})
+	 w.RegisterActivityWithOptions(gitActivities.SummarizeDirectoriesActivity, activity.RegisterOptions{Name: activities.ActivityName_SummarizeDirectories})
+	 w.RegisterActivityWithOptions(gitActivities.RelatedFilesActivity, activity.RegisterOptions{Name: activities.ActivityName_RelatedFiles})
+	 w.RegisterActivityWithOptions(gitActivities.SearchFilesActivity, activity.RegisterOptions{Name: activities.ActivityName_SearchFiles})
+	 w.RegisterActivityWithOptions(gitActivities.AgentToolActivity, activity.RegisterOptions{Name: activities.ActivityName_AgentTool})
+	 w.RegisterActivityWithOptions(gitActivities.PendingChangesActivity, activity.RegisterOptions{Name: activities.ActivityName_PendingChanges})
+	 w.RegisterActivityWithOptions(gitActivities.CommitPendingActivity, activity.RegisterOptions{Name: activities.ActivityName_CommitPending})
+	 w.RegisterActivityWithOptions(gitActivities.SummarizeCommitActivity, activity.RegisterOptions{Name: activities.ActivityName_SummarizeCommit})
+	 w.RegisterActivityWithOptions(gitActivities.ScanBranchActivity, activity.RegisterOptions{Name: activities.ActivityName_ScanBranch})
 
 	// Start Worker
 	 err = w.Start()
@@ -81,10 +136,17 @@ func main() {
 
 	// Init Router and Handlers
 	 r := chi.NewRouter()
-	 r.Use(middleware.Logger, middleware.Recoverer, middleware.Timeout(60*time.Second))
-	 pageHandler, err := handlers.NewPageHandler(temporalClient)
+	 r.Use(middleware.Logger, middleware.Recoverer, middleware.Timeout(60*time.Second), handlers.SecurityHeaders)
+	 auth, err := handlers.LoadAuthFromEnv()
+	 if err != nil { log.Fatalf("Invalid authentication config: %v", err) }
+	 quotaLimits, err := services.LoadQuotaLimitsFromEnv()
+	 if err != nil { log.Fatalf("Invalid quota config: %v", err) }
+	 budgets, err := services.NewBudgetServiceFromEnv()
+	 if err != nil { log.Fatalf("Invalid budget config: %v", err) }
+	 pageHandler, err := handlers.NewPageHandler(temporalClient, auth, services.NewQuotaService(quotaLimits), budgets)
 	 if err != nil { log.Fatalf("Failed to create page handler: %v", err) }
 	 pageHandler.RegisterRoutes(r)
+	 pageHandler.SettlePendingRuns()
 
 
 	// Start HTTP Server
@@ -96,6 +158,46 @@ func main() {
 }
 
 
+// validatePrompts loads the prompt templates (with overrides from dir, if set),
+// renders each one against sample data and prints the result. Returns the exit code.
+func validatePrompts(dir string) int {
+	prompts, err := services.LoadPromptSet(dir)
+	if err != nil {
+		log.Printf("Prompt templates failed to load: %v", err)
+		return 1
+	}
+	rendered, err := prompts.Validate()
+	for _, name := range services.PromptNames() {
+		if out, ok := rendered[name]; ok {
+			fmt.Printf("===== %s =====\n%s\n", name, out)
+		}
+	}
+	if err != nil {
+		log.Printf("Prompt validation failed: %v", err)
+		return 1
+	}
+	log.Printf("All %d prompt templates rendered successfully.", len(rendered))
+	return 0
+}
+
+
+// hashSecret prints the stored form of a basic-auth password or an API token.
+// Returns the exit code.
+func hashSecret(kind, secret string) int {
+	if kind == "hash-token" {
+		fmt.Println(handlers.HashToken(secret))
+		return 0
+	}
+	hash, err := handlers.HashPassword(secret)
+	if err != nil {
+		log.Printf("Failed to hash password: %v", err)
+		return 1
+	}
+	fmt.Println(hash)
+	return 0
+}
+
+
 // --- Temporal Logger Adapter ---
 // Wraps Go's standard logger for Temporal SDK compatibility.
 
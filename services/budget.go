@@ -0,0 +1,325 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"hammer/shared"
+)
+
+// defaultSoftPercent is the share of a budget after which runs and users are warned.
+const defaultSoftPercent = 80
+
+// ErrBudgetExceeded is returned when a user or one of their teams has spent its
+// monthly budget.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// LoadRunBudgetFromEnv reads the per-run limits RUN_BUDGET_TOKENS, RUN_BUDGET_USD
+// and RUN_BUDGET_SOFT_PERCENT. Zero limits are unlimited.
+func LoadRunBudgetFromEnv() (shared.RunBudget, error) {
+	budget := shared.RunBudget{SoftPercent: defaultSoftPercent}
+	if value := os.Getenv("RUN_BUDGET_TOKENS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return shared.RunBudget{}, fmt.Errorf("RUN_BUDGET_TOKENS must be a non-negative integer, got %q", value)
+		}
+		budget.MaxTokens = n
+	}
+	if value := os.Getenv("RUN_BUDGET_USD"); value != "" {
+		usd, err := strconv.ParseFloat(value, 64)
+		if err != nil || usd < 0 {
+			return shared.RunBudget{}, fmt.Errorf("RUN_BUDGET_USD must be a non-negative number, got %q", value)
+		}
+		budget.MaxCostUSD = usd
+	}
+	if value := os.Getenv("RUN_BUDGET_SOFT_PERCENT"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 100 {
+			return shared.RunBudget{}, fmt.Errorf("RUN_BUDGET_SOFT_PERCENT must be between 0 and 100, got %q", value)
+		}
+		budget.SoftPercent = n
+	}
+	return budget, nil
+}
+
+// MonthlyBudgets caps what users and teams may spend per calendar month, in USD.
+// Zero or missing entries are unlimited.
+type MonthlyBudgets struct {
+	DefaultUserUSD float64            `yaml:"default_user_usd"` // For users without an entry
+	Users          map[string]float64 `yaml:"users"`            // Keyed by user ID
+	Teams          map[string]float64 `yaml:"teams"`
+	SoftPercent    int                `yaml:"soft_percent"`
+}
+
+// BudgetStatus is the result of a submission check.
+type BudgetStatus struct {
+	RemainingUSD float64 // Least remaining budget of the user and their teams; 0 if unlimited
+	Limited      bool    // Whether any monthly budget applies
+	Warning      string  // Set once the user or a team passed the soft limit
+	ReservedUSD  float64 // Set aside by Reserve; the run's dollar limit, 0 if unlimited
+}
+
+// Reservation is budget set aside for a run until its cost is known.
+type Reservation struct {
+	UserID    string   `json:"user_id"`
+	Teams     []string `json:"teams,omitempty"`
+	Month     string   `json:"month"` // Month the cost is charged to
+	AmountUSD float64  `json:"amount_usd"`
+}
+
+// ledgerFile is the format of BUDGET_LEDGER_FILE. Older ledgers hold only the
+// spent map and are still read.
+type ledgerFile struct {
+	Spent        map[string]map[string]float64 `json:"spent"`
+	Reservations map[string]Reservation        `json:"reservations"`
+}
+
+// BudgetService enforces MonthlyBudgets. Spend and the reservations of runs in
+// flight are kept in memory and, if a ledger file is set, saved there so they
+// survive restarts.
+type BudgetService struct {
+	budgets      MonthlyBudgets
+	ledger       string // Path of the JSON ledger; empty keeps spend in memory only
+	now          func() time.Time
+	mu           sync.Mutex
+	spent        map[string]map[string]float64 // "2006-01" -> "user:<id>" or "team:<name>" -> USD
+	reservations map[string]Reservation        // Keyed by workflow ID
+}
+
+// NewBudgetServiceFromEnv loads the monthly budgets from BUDGETS_FILE and the
+// spend so far from BUDGET_LEDGER_FILE. Without BUDGETS_FILE nothing is capped.
+func NewBudgetServiceFromEnv() (*BudgetService, error) {
+	s := &BudgetService{
+		budgets:      MonthlyBudgets{SoftPercent: defaultSoftPercent},
+		ledger:       os.Getenv("BUDGET_LEDGER_FILE"),
+		now:          time.Now,
+		spent:        make(map[string]map[string]float64),
+		reservations: make(map[string]Reservation),
+	}
+	if path := os.Getenv("BUDGETS_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read BUDGETS_FILE: %w", err)
+		}
+		if err := yaml.Unmarshal(content, &s.budgets); err != nil {
+			return nil, fmt.Errorf("failed to parse BUDGETS_FILE: %w", err)
+		}
+		if s.budgets.SoftPercent < 0 || s.budgets.SoftPercent > 100 {
+			return nil, fmt.Errorf("BUDGETS_FILE: soft_percent must be between 0 and 100, got %d", s.budgets.SoftPercent)
+		}
+	}
+	if s.ledger != "" {
+		content, err := os.ReadFile(s.ledger)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("failed to read BUDGET_LEDGER_FILE: %w", err)
+		default:
+			var file ledgerFile
+			if err := json.Unmarshal(content, &file); err != nil {
+				return nil, fmt.Errorf("failed to parse BUDGET_LEDGER_FILE: %w", err)
+			}
+			if file.Spent == nil && file.Reservations == nil {
+				err = json.Unmarshal(content, &file.Spent)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse BUDGET_LEDGER_FILE: %w", err)
+			}
+			if file.Spent != nil {
+				s.spent = file.Spent
+			}
+			if file.Reservations != nil {
+				s.reservations = file.Reservations
+			}
+		}
+	}
+	return s, nil
+}
+
+// budgetEntry is one monthly budget that applies to a user.
+type budgetEntry struct {
+	key   string
+	label string
+	limit float64
+}
+
+// entries returns the budgets that apply to a user and their teams.
+func (s *BudgetService) entries(userID string, teams []string) []budgetEntry {
+	var entries []budgetEntry
+	limit, ok := s.budgets.Users[userID]
+	if !ok {
+		limit = s.budgets.DefaultUserUSD
+	}
+	if limit > 0 {
+		entries = append(entries, budgetEntry{key: "user:" + userID, label: "your", limit: limit})
+	}
+	for _, team := range teams {
+		if limit := s.budgets.Teams[team]; limit > 0 {
+			entries = append(entries, budgetEntry{key: "team:" + team, label: fmt.Sprintf("team %s's", team), limit: limit})
+		}
+	}
+	return entries
+}
+
+// Capped reports whether any monthly budget is configured.
+func (s *BudgetService) Capped() bool {
+	if s.budgets.DefaultUserUSD > 0 {
+		return true
+	}
+	for _, limit := range s.budgets.Users {
+		if limit > 0 {
+			return true
+		}
+	}
+	for _, limit := range s.budgets.Teams {
+		if limit > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Reserve returns the budget left this month for a user and their teams and sets
+// aside maxCostUSD of it for run runID, or what is left if that is less. When
+// budgets are Capped, maxCostUSD must be positive.
+// The amount reserved becomes the run's dollar limit and counts as spent until
+// Settle replaces it with the run's actual cost. A user or team that has spent its
+// budget fails with an error wrapping ErrBudgetExceeded.
+func (s *BudgetService) Reserve(runID, userID string, teams []string, maxCostUSD float64) (BudgetStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	month := s.now().Format("2006-01")
+	status, err := s.check(month, userID, teams)
+	if err != nil {
+		return BudgetStatus{}, err
+	}
+	status.ReservedUSD = maxCostUSD
+	if status.Limited && (maxCostUSD == 0 || status.RemainingUSD < maxCostUSD) {
+		status.ReservedUSD = status.RemainingUSD
+	}
+	s.reservations[runID] = Reservation{UserID: userID, Teams: teams, Month: month, AmountUSD: status.ReservedUSD}
+	if err := s.save(); err != nil {
+		log.Printf("Budget: failed to save ledger: %v", err)
+	}
+	return status, nil
+}
+
+// check returns the budget left in month. Must hold s.mu.
+func (s *BudgetService) check(month, userID string, teams []string) (BudgetStatus, error) {
+	var status BudgetStatus
+	for _, e := range s.entries(userID, teams) {
+		reserved := s.reserved(month, e.key)
+		spent := s.spent[month][e.key] + reserved
+		remaining := e.limit - spent
+		if remaining <= 0 {
+			if reserved > 0 {
+				return BudgetStatus{}, fmt.Errorf("%w: %s monthly budget of $%.2f is spent or reserved ($%.2f spent, $%.2f reserved for running or queued tasks); try again when they finish", ErrBudgetExceeded, e.label, e.limit, spent-reserved, reserved)
+			}
+			return BudgetStatus{}, fmt.Errorf("%w: %s monthly budget of $%.2f is used up ($%.2f spent)", ErrBudgetExceeded, e.label, e.limit, spent)
+		}
+		if !status.Limited || remaining < status.RemainingUSD {
+			status.RemainingUSD = remaining
+		}
+		status.Limited = true
+		if status.Warning == "" && s.budgets.SoftPercent > 0 && spent >= e.limit*float64(s.budgets.SoftPercent)/100 {
+			status.Warning = fmt.Sprintf("%s monthly budget is %d%% used ($%.2f of $%.2f)", e.label, int(spent/e.limit*100), spent, e.limit)
+		}
+	}
+	return status, nil
+}
+
+// reserved sums the reservations of month that apply to key. Must hold s.mu.
+func (s *BudgetService) reserved(month, key string) float64 {
+	total := 0.0
+	for _, r := range s.reservations {
+		if r.Month == month && (key == "user:"+r.UserID || containsTeam(r.Teams, key)) {
+			total += r.AmountUSD
+		}
+	}
+	return total
+}
+
+func containsTeam(teams []string, key string) bool {
+	for _, team := range teams {
+		if key == "team:"+team {
+			return true
+		}
+	}
+	return false
+}
+
+// Settle replaces the reservation of run runID with its actual cost, charged to
+// the user and their teams in the month the run was submitted. Settling a run
+// that holds no reservation does nothing.
+func (s *BudgetService) Settle(runID string, costUSD float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settle(runID, func(Reservation) float64 { return costUSD })
+}
+
+// SettleInFull charges run runID the whole amount it reserved. It is used when
+// the run's actual cost cannot be determined.
+func (s *BudgetService) SettleInFull(runID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settle(runID, func(r Reservation) float64 { return r.AmountUSD })
+}
+
+// settle removes a reservation and charges the cost cost returns for it. Must
+// hold s.mu.
+func (s *BudgetService) settle(runID string, cost func(Reservation) float64) {
+	r, ok := s.reservations[runID]
+	if !ok {
+		return
+	}
+	delete(s.reservations, runID)
+	if costUSD := cost(r); costUSD > 0 {
+		if s.spent[r.Month] == nil {
+			s.spent[r.Month] = make(map[string]float64)
+		}
+		s.spent[r.Month]["user:"+r.UserID] += costUSD
+		for _, team := range r.Teams {
+			s.spent[r.Month]["team:"+team] += costUSD
+		}
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Budget: failed to save ledger: %v", err)
+	}
+}
+
+// Pending returns the IDs of the runs that hold a reservation, sorted.
+func (s *BudgetService) Pending() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.reservations))
+	for id := range s.reservations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// save writes the ledger, replacing the file atomically. Must hold s.mu.
+func (s *BudgetService) save() error {
+	if s.ledger == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(ledgerFile{Spent: s.spent, Reservations: s.reservations}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.ledger + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.ledger)
+}
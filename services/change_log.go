@@ -0,0 +1,168 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"hammer/shared"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// The formatted change log is capped at this size; older steps are summarized
+// more briefly first.
+const maxChangeLogChars = 4000
+
+// Symbols listed per file in the change log.
+const maxChangeLogSymbols = 8
+
+// SummarizeCommit describes the files a commit changed relative to its first
+// parent: line counts and the top-level symbols it added or removed. The base
+// commit of the run is not a generated change and yields no summaries.
+func (s *GitService) SummarizeCommit(hash plumbing.Hash) ([]shared.FileChangeSummary, error) {
+	if hash == s.baseHash {
+		return nil, nil
+	}
+	commit, err := s.repo.CommitObject(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load commit %s: %w", hash, err)
+	}
+	if commit.NumParents() == 0 {
+		return nil, nil
+	}
+	parent := commit.ParentHashes[0]
+	paths, err := s.changedPathsBetween(parent, hash)
+	if err != nil {
+		return nil, err
+	}
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	var summaries []shared.FileChangeSummary
+	for _, p := range sorted {
+		before, existed, err := s.fileAt(parent, p)
+		if err != nil {
+			return nil, err
+		}
+		after, exists, err := s.fileAt(hash, p)
+		if err != nil {
+			return nil, err
+		}
+		summary := shared.FileChangeSummary{Path: p, Status: "modified"}
+		switch {
+		case !existed:
+			summary.Status = "added"
+		case !exists:
+			summary.Status = "deleted"
+		}
+		for _, d := range diff.Do(before, after) {
+			lines := strings.Count(d.Text, "\n")
+			switch d.Type {
+			case diffmatchpatch.DiffInsert:
+				summary.LinesAdded += lines
+			case diffmatchpatch.DiffDelete:
+				summary.LinesRemoved += lines
+			}
+		}
+		if isIndexable(p) {
+			summary.SymbolsAdded, summary.SymbolsRemoved = symbolDelta(p, before, after)
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// symbolDelta returns the top-level symbols defined in after but not before, and
+// the reverse.
+func symbolDelta(filePath, before, after string) ([]string, []string) {
+	names := func(content string) map[string]struct{} {
+		set := make(map[string]struct{})
+		if content == "" {
+			return set
+		}
+		for _, def := range indexFile(filePath, content).defs {
+			if def.Kind != SymbolPackage {
+				set[def.Name] = struct{}{}
+			}
+		}
+		return set
+	}
+	old, updated := names(before), names(after)
+	var added, removed []string
+	for name := range updated {
+		if _, ok := old[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	for name := range old {
+		if _, ok := updated[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// FormatChangeLog renders the changes of earlier steps for a prompt. The most
+// recent steps are shown in full; if the log gets too long, older steps are cut
+// down to their description and file list.
+func FormatChangeLog(changes []shared.StepChange) string {
+	if len(changes) == 0 {
+		return ""
+	}
+	full := make([]string, len(changes))
+	brief := make([]string, len(changes))
+	for i, c := range changes {
+		full[i], brief[i] = formatStepChange(c)
+	}
+	total := 0
+	for _, entry := range full {
+		total += len(entry)
+	}
+	// Shorten from the oldest step until the log fits.
+	for i := 0; i < len(changes) && total > maxChangeLogChars; i++ {
+		total -= len(full[i]) - len(brief[i])
+		full[i] = brief[i]
+	}
+	return strings.Join(full, "")
+}
+
+func formatStepChange(c shared.StepChange) (string, string) {
+	var files []string
+	for _, f := range c.Files {
+		files = append(files, f.Path)
+	}
+	header := fmt.Sprintf("Step %d: %s\n", c.Step, c.Description)
+	brief := header + "  Files: " + strings.Join(files, ", ") + "\n"
+
+	var b strings.Builder
+	b.WriteString(header)
+	if c.Summary != "" {
+		fmt.Fprintf(&b, "  Summary: %s\n", strings.Join(strings.Fields(c.Summary), " "))
+	}
+	for _, f := range c.Files {
+		fmt.Fprintf(&b, "  - %s (%s, +%d/-%d)", f.Path, f.Status, f.LinesAdded, f.LinesRemoved)
+		if len(f.SymbolsAdded) > 0 {
+			fmt.Fprintf(&b, "; added %s", limitList(f.SymbolsAdded, maxChangeLogSymbols))
+		}
+		if len(f.SymbolsRemoved) > 0 {
+			fmt.Fprintf(&b, "; removed %s", limitList(f.SymbolsRemoved, maxChangeLogSymbols))
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), brief
+}
+
+func limitList(items []string, max int) string {
+	if len(items) <= max {
+		return strings.Join(items, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(items[:max], ", "), len(items)-max)
+}
@@ -0,0 +1,458 @@
+package services
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"hammer/shared"
+)
+
+// ModelSpec describes a chat model's context window for prompt budgeting.
+type ModelSpec struct {
+	ContextWindow int     // Prompt plus completion tokens
+	TokenFactor   float64 // Multiplier on the heuristic token estimate for the model's tokenizer
+}
+
+var modelSpecs = map[string]ModelSpec{
+	"gpt-4-turbo-preview": {ContextWindow: 128000, TokenFactor: 1.0},
+	"gpt-4-turbo":         {ContextWindow: 128000, TokenFactor: 1.0},
+	"gpt-4o":              {ContextWindow: 128000, TokenFactor: 0.9},
+	"gpt-4o-mini":         {ContextWindow: 128000, TokenFactor: 0.9},
+	"gpt-4":               {ContextWindow: 8192, TokenFactor: 1.0},
+	"gpt-4-32k":           {ContextWindow: 32768, TokenFactor: 1.0},
+	"gpt-3.5-turbo":       {ContextWindow: 16385, TokenFactor: 1.0},
+}
+
+// Unknown models are budgeted conservatively.
+var defaultModelSpec = ModelSpec{ContextWindow: 8192, TokenFactor: 1.1}
+
+// Share of the context window kept free to absorb token estimation error.
+const contextSafetyMargin = 0.05
+
+// Files that would get fewer tokens than this are dropped instead of truncated.
+const minTruncatedFileTokens = 300
+
+// Non-Go files are scored in windows of twice this many lines.
+const rangeContextLines = 12
+
+// Strategies for fitting a file into the prompt.
+const (
+	ContextFull     = "full"
+	ContextRanges   = "relevant ranges"
+	ContextOutline  = "outline"
+	ContextHeadTail = "head/tail"
+	ContextOmitted  = "omitted"
+)
+
+// omissionMarkerText appears in every elided region so partial views can be
+// recognised if the model copies them back into its output.
+const omissionMarkerText = "lines omitted by hammer"
+
+// LookupModelSpec returns the context window parameters for a model.
+func LookupModelSpec(model string) ModelSpec {
+	if spec, ok := modelSpecs[model]; ok {
+		return spec
+	}
+	return defaultModelSpec
+}
+
+// CountTokens estimates the number of tokens text uses with the model's tokenizer.
+// Word runs cost about one token per four characters, digit runs one per three,
+// and each symbol one token, which tracks BPE tokenizers closely for source code.
+func CountTokens(model, text string) int {
+	count := 0
+	runLen, runKind := 0, 0 // 1 = letters, 2 = digits
+	flush := func() {
+		switch runKind {
+		case 1:
+			count += (runLen + 3) / 4
+		case 2:
+			count += (runLen + 2) / 3
+		}
+		runLen, runKind = 0, 0
+	}
+	for _, r := range text {
+		kind := 0
+		switch {
+		case unicode.IsLetter(r) || r == '_':
+			kind = 1
+		case unicode.IsDigit(r):
+			kind = 2
+		}
+		if kind != runKind {
+			flush()
+		}
+		switch {
+		case kind != 0:
+			runKind = kind
+			runLen++
+		case r == '\n':
+			count++
+		case !unicode.IsSpace(r):
+			count++
+		}
+	}
+	flush()
+	return int(float64(count)*LookupModelSpec(model).TokenFactor + 0.5)
+}
+
+// AllocateContext fits files into the prompt budget of model. baseTokens is the
+// size of the prompt without file contents and maxOutput the completion budget.
+// Files that fit are kept whole; otherwise every file gets an equal share of what
+// the smaller files leave, oversized files are reduced to their relevant ranges,
+// an outline, or their head and tail, and the lowest-priority files are dropped if
+// the shares get too small. priority lists files most important first.
+func AllocateContext(model string, baseTokens, maxOutput int, files map[string]string, priority []string, step string) (map[string]string, *shared.ContextReport) {
+	spec := LookupModelSpec(model)
+	available := spec.ContextWindow - maxOutput - baseTokens - int(float64(spec.ContextWindow)*contextSafetyMargin)
+	report := &shared.ContextReport{Model: model, Budget: available}
+
+	ordered := orderByPriority(files, priority)
+	costs := make(map[string]int, len(files))
+	total := 0
+	for _, p := range ordered {
+		costs[p] = CountTokens(model, files[p]) + CountTokens(model, p) + 8 // File header
+		total += costs[p]
+	}
+
+	fitted := make(map[string]string, len(files))
+	strategies := make(map[string]string, len(files))
+	if total <= available {
+		for _, p := range ordered {
+			fitted[p] = files[p]
+			strategies[p] = ContextFull
+		}
+	} else {
+		kept := ordered
+		var share int
+		var full map[string]bool
+		for {
+			share, full = waterFill(kept, costs, available)
+			if share >= minTruncatedFileTokens || len(kept) == 0 {
+				break
+			}
+			dropped := kept[len(kept)-1]
+			strategies[dropped] = ContextOmitted
+			kept = kept[:len(kept)-1]
+		}
+		terms := searchTerms(step)
+		for _, p := range kept {
+			if full[p] {
+				fitted[p] = files[p]
+				strategies[p] = ContextFull
+				continue
+			}
+			fitted[p], strategies[p] = reduceFile(model, p, files[p], terms, share-CountTokens(model, p)-8)
+		}
+	}
+
+	for _, p := range ordered {
+		used := 0
+		if content, ok := fitted[p]; ok {
+			used = CountTokens(model, content)
+			report.Used += used
+		}
+		report.Files = append(report.Files, shared.FileContext{
+			Path:           p,
+			Strategy:       strategies[p],
+			Tokens:         used,
+			OriginalTokens: costs[p],
+		})
+	}
+	if total > available {
+		log.Printf("Context budget for %s: files need %d tokens, %d available; reduced files: %v", model, total, available, report.Reduced())
+	}
+	return fitted, report
+}
+
+// orderByPriority lists the files in priority order, followed by any files not in
+// priority sorted by path.
+func orderByPriority(files map[string]string, priority []string) []string {
+	ordered := make([]string, 0, len(files))
+	seen := make(map[string]struct{}, len(files))
+	for _, p := range priority {
+		if _, ok := files[p]; !ok {
+			continue
+		}
+		if _, dup := seen[p]; dup {
+			continue
+		}
+		seen[p] = struct{}{}
+		ordered = append(ordered, p)
+	}
+	var rest []string
+	for p := range files {
+		if _, ok := seen[p]; !ok {
+			rest = append(rest, p)
+		}
+	}
+	sort.Strings(rest)
+	return append(ordered, rest...)
+}
+
+// waterFill gives files that cost less than an equal share of the budget their
+// full size and returns the share left for each of the remaining files.
+func waterFill(files []string, costs map[string]int, available int) (int, map[string]bool) {
+	bySize := append([]string(nil), files...)
+	sort.SliceStable(bySize, func(i, j int) bool { return costs[bySize[i]] < costs[bySize[j]] })
+	full := make(map[string]bool)
+	remaining := available
+	for i, p := range bySize {
+		share := remaining / (len(bySize) - i)
+		if costs[p] > share {
+			return share, full
+		}
+		full[p] = true
+		remaining -= costs[p]
+	}
+	return remaining, full
+}
+
+// reduceFile shrinks content to roughly maxTokens, preferring the ranges that
+// mention the step's terms, then an outline, then the head and tail of the file.
+func reduceFile(model, filePath, content string, terms []string, maxTokens int) (string, string) {
+	lines := strings.Split(content, "\n")
+	if reduced, ok := relevantRanges(filePath, content, lines, terms, model, maxTokens); ok {
+		return reduced, ContextRanges
+	}
+	if outline := fileOutline(filePath, content, lines); outline != "" && CountTokens(model, outline) <= maxTokens {
+		return outline, ContextOutline
+	}
+	return headTail(model, lines, maxTokens), ContextHeadTail
+}
+
+// lineRange is a half-open range of 0-based line numbers with a relevance score.
+type lineRange struct {
+	start, end int
+	score      int
+}
+
+// relevantRanges keeps the file header and the declarations (Go) or line windows
+// (other languages) that mention the most step terms, as many as fit.
+func relevantRanges(filePath, content string, lines, terms []string, model string, maxTokens int) (string, bool) {
+	if len(terms) == 0 {
+		return "", false
+	}
+	var header lineRange
+	var candidates []lineRange
+	if decls, hdr, ok := goDeclRanges(filePath, content); ok {
+		header = hdr
+		candidates = decls
+	} else {
+		candidates = matchWindows(lines)
+	}
+	for i := range candidates {
+		text := strings.ToLower(strings.Join(lines[candidates[i].start:candidates[i].end], "\n"))
+		for _, term := range terms {
+			if strings.Contains(text, term) {
+				candidates[i].score++
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+
+	selected := []lineRange{header}
+	used := CountTokens(model, strings.Join(lines[header.start:header.end], "\n"))
+	for _, c := range candidates {
+		if c.score == 0 {
+			break
+		}
+		cost := CountTokens(model, strings.Join(lines[c.start:c.end], "\n")) + 12 // Omission marker
+		if used+cost > maxTokens {
+			continue
+		}
+		selected = append(selected, c)
+		used += cost
+	}
+	if len(selected) == 1 {
+		return "", false
+	}
+	return renderRanges(lines, selected), true
+}
+
+// goDeclRanges returns the line range of each top-level declaration in a Go file
+// (including its doc comment) and the header range (package clause and imports).
+func goDeclRanges(filePath, content string) ([]lineRange, lineRange, bool) {
+	if path.Ext(filePath) != ".go" {
+		return nil, lineRange{}, false
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filePath, content, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return nil, lineRange{}, false
+	}
+	header := lineRange{start: 0, end: fset.Position(f.Name.End()).Line}
+	var decls []lineRange
+	for _, decl := range f.Decls {
+		start := decl.Pos()
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+			header.end = fset.Position(gen.End()).Line
+			continue
+		}
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Doc != nil {
+			start = fn.Doc.Pos()
+		} else if gen, ok := decl.(*ast.GenDecl); ok && gen.Doc != nil {
+			start = gen.Doc.Pos()
+		}
+		decls = append(decls, lineRange{start: fset.Position(start).Line - 1, end: fset.Position(decl.End()).Line})
+	}
+	return decls, header, true
+}
+
+// matchWindows splits a file into fixed windows for scoring.
+func matchWindows(lines []string) []lineRange {
+	var windows []lineRange
+	step := 2 * rangeContextLines
+	for start := 0; start < len(lines); start += step {
+		end := start + step
+		if end > len(lines) {
+			end = len(lines)
+		}
+		windows = append(windows, lineRange{start: start, end: end})
+	}
+	return windows
+}
+
+// renderRanges prints the selected ranges in file order, with omission markers
+// for the lines in between.
+func renderRanges(lines []string, ranges []lineRange) string {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	var b strings.Builder
+	next := 0
+	for _, r := range ranges {
+		if r.end <= next {
+			continue
+		}
+		if r.start < next {
+			r.start = next
+		}
+		if r.start > next {
+			b.WriteString(omissionMarker(r.start - next))
+		}
+		b.WriteString(strings.Join(lines[r.start:r.end], "\n"))
+		b.WriteString("\n")
+		next = r.end
+	}
+	if next < len(lines) {
+		b.WriteString(omissionMarker(len(lines) - next))
+	}
+	return b.String()
+}
+
+func omissionMarker(n int) string {
+	return fmt.Sprintf("... [%d %s] ...\n", n, omissionMarkerText)
+}
+
+// ContainsOmissionMarker reports whether content includes an elided region from a
+// partial file view, i.e. the model copied a partial view instead of the file.
+func ContainsOmissionMarker(content string) bool {
+	return strings.Contains(content, omissionMarkerText)
+}
+
+// importLinePattern matches import statements in the regex-indexed languages.
+var importLinePattern = regexp.MustCompile(`^\s*(?:import\b|from\s+\S+\s+import\b|using\s|use\s|require\b|#include\b|package\b)`)
+
+// fileOutline lists a file's declarations without their bodies. Returns "" if
+// the language is not supported.
+func fileOutline(filePath, content string, lines []string) string {
+	if path.Ext(filePath) == ".go" {
+		return goOutline(filePath, content, lines)
+	}
+	lang, ok := regexLanguages[path.Ext(filePath)]
+	if !ok {
+		return ""
+	}
+	keep := make(map[int]bool)
+	for i, line := range lines {
+		if importLinePattern.MatchString(line) {
+			keep[i] = true
+		}
+	}
+	for _, def := range lang.defs {
+		for _, m := range def.pattern.FindAllStringIndex(content, -1) {
+			keep[strings.Count(content[:m[0]], "\n")] = true
+		}
+	}
+	var ranges []lineRange
+	for i := range lines {
+		if keep[i] {
+			ranges = append(ranges, lineRange{start: i, end: i + 1})
+		}
+	}
+	if len(ranges) == 0 {
+		return ""
+	}
+	return renderRanges(lines, ranges)
+}
+
+// goOutline keeps the header, type and value declarations, and function signatures.
+func goOutline(filePath, content string, lines []string) string {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filePath, content, parser.SkipObjectResolution)
+	if err != nil {
+		return ""
+	}
+	ranges := []lineRange{{start: 0, end: fset.Position(f.Name.End()).Line}}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			end := d.End()
+			if d.Body != nil {
+				end = d.Body.Lbrace
+			}
+			ranges = append(ranges, lineRange{start: fset.Position(d.Pos()).Line - 1, end: fset.Position(end).Line})
+		case *ast.GenDecl:
+			ranges = append(ranges, lineRange{start: fset.Position(d.Pos()).Line - 1, end: fset.Position(d.End()).Line})
+		}
+	}
+	return renderRanges(lines, ranges)
+}
+
+// headTail keeps the first two thirds of the budget from the top of the file and
+// the rest from the bottom.
+func headTail(model string, lines []string, maxTokens int) string {
+	headBudget := maxTokens * 2 / 3
+	tailBudget := maxTokens - headBudget
+	head, used := 0, 0
+	for head < len(lines) {
+		cost := CountTokens(model, lines[head]) + 1
+		if used+cost > headBudget {
+			break
+		}
+		used += cost
+		head++
+	}
+	if head == 0 && len(lines) > 0 {
+		// A single very long line (minified or data files): cut it by characters.
+		first := lines[0]
+		for len(first) > 0 && CountTokens(model, first) > maxTokens {
+			first = first[:len(first)*3/4]
+		}
+		return first + "\n" + omissionMarker(len(lines))
+	}
+	tail, used := len(lines), 0
+	for tail > head {
+		cost := CountTokens(model, lines[tail-1]) + 1
+		if used+cost > tailBudget {
+			break
+		}
+		used += cost
+		tail--
+	}
+	var b strings.Builder
+	b.WriteString(strings.Join(lines[:head], "\n"))
+	b.WriteString("\n")
+	if tail > head {
+		b.WriteString(omissionMarker(tail - head))
+	}
+	b.WriteString(strings.Join(lines[tail:], "\n"))
+	return b.String()
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"hammer/shared"
+)
+
+// Directory groups shown to the model are capped at this many entries; deeper
+// directories are collapsed into their ancestors until the tree fits.
+const maxDirectoryGroups = 400
+
+// Number of example file names included per directory summary.
+const summarySampleFiles = 5
+
+// Files that usually describe a directory's purpose, checked in order.
+var directoryDocFiles = []string{"README.md", "README", "readme.md", "doc.go"}
+
+type cachedDirSummary struct {
+	fingerprint string
+	summary     shared.DirectorySummary
+}
+
+// SummarizeDirectories groups files by directory (collapsing deep trees) and
+// returns one summary per group, sorted by path. Summaries are cached for the
+// lifetime of the service and only rebuilt when a group's file list changes.
+func (s *GitService) SummarizeDirectories(files []string) ([]shared.DirectorySummary, error) {
+	groups := GroupFilesByDirectory(files, maxDirectoryGroups)
+	if s.dirSummaryCache == nil {
+		s.dirSummaryCache = make(map[string]cachedDirSummary)
+	}
+
+	dirs := make([]string, 0, len(groups))
+	for dir := range groups {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	summaries := make([]shared.DirectorySummary, 0, len(dirs))
+	rebuilt := 0
+	for _, dir := range dirs {
+		groupFiles := groups[dir]
+		sort.Strings(groupFiles)
+		sum := sha256.Sum256([]byte(strings.Join(groupFiles, "\n")))
+		fingerprint := hex.EncodeToString(sum[:])
+		if cached, ok := s.dirSummaryCache[dir]; ok && cached.fingerprint == fingerprint {
+			summaries = append(summaries, cached.summary)
+			continue
+		}
+		summary := s.summarizeDirectory(dir, groupFiles)
+		s.dirSummaryCache[dir] = cachedDirSummary{fingerprint: fingerprint, summary: summary}
+		summaries = append(summaries, summary)
+		rebuilt++
+	}
+	if rebuilt > 0 {
+		log.Printf("Summarized %d directories (%d rebuilt, %d from cache)", len(summaries), rebuilt, len(summaries)-rebuilt)
+	}
+	return summaries, nil
+}
+
+func (s *GitService) summarizeDirectory(dir string, files []string) shared.DirectorySummary {
+	extCounts := make(map[string]int)
+	for _, f := range files {
+		ext := path.Ext(f)
+		if ext == "" {
+			ext = "(none)"
+		}
+		extCounts[ext]++
+	}
+	exts := make([]string, 0, len(extCounts))
+	for ext := range extCounts {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		if extCounts[exts[i]] != extCounts[exts[j]] {
+			return extCounts[exts[i]] > extCounts[exts[j]]
+		}
+		return exts[i] < exts[j]
+	})
+	var extParts []string
+	for _, ext := range exts {
+		extParts = append(extParts, fmt.Sprintf("%s x%d", ext, extCounts[ext]))
+	}
+
+	samples := make([]string, 0, summarySampleFiles)
+	for _, f := range files {
+		if len(samples) == summarySampleFiles {
+			break
+		}
+		samples = append(samples, strings.TrimPrefix(f, dir+"/"))
+	}
+
+	return shared.DirectorySummary{
+		Path:        dir,
+		FileCount:   len(files),
+		Extensions:  strings.Join(extParts, ", "),
+		SampleFiles: samples,
+		Description: s.directoryDescription(dir, files),
+	}
+}
+
+// directoryDescription returns the first meaningful line of a README or Go
+// package comment in the directory itself, if any.
+func (s *GitService) directoryDescription(dir string, files []string) string {
+	present := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		present[f] = struct{}{}
+	}
+	for _, name := range directoryDocFiles {
+		docPath := path.Join(dir, name)
+		if _, ok := present[docPath]; !ok {
+			continue
+		}
+		content, err := s.ReadFile(docPath)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(content, "\n") {
+			line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#/ "))
+			if line == "" || strings.HasPrefix(line, "package ") || strings.HasPrefix(line, "<!--") {
+				continue
+			}
+			if len(line) > 160 {
+				line = line[:157] + "..."
+			}
+			return line
+		}
+	}
+	return ""
+}
+
+// GroupFilesByDirectory maps a directory key to the files under it. Keys are the
+// files' directories truncated to the deepest level that keeps the number of
+// groups within maxGroups. Root-level files are grouped under ".".
+func GroupFilesByDirectory(files []string, maxGroups int) map[string][]string {
+	maxDepth := 1
+	for _, f := range files {
+		if d := strings.Count(f, "/"); d > maxDepth {
+			maxDepth = d
+		}
+	}
+	var groups map[string][]string
+	for depth := maxDepth; depth >= 1; depth-- {
+		groups = make(map[string][]string)
+		for _, f := range files {
+			groups[directoryKey(f, depth)] = append(groups[directoryKey(f, depth)], f)
+		}
+		if len(groups) <= maxGroups {
+			break
+		}
+	}
+	return groups
+}
+
+func directoryKey(file string, depth int) string {
+	dir := path.Dir(file)
+	if dir == "." {
+		return "."
+	}
+	parts := strings.Split(dir, "/")
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	return strings.Join(parts, "/")
+}
+
+// FilesInDirectories returns the files whose directory key (see
+// GroupFilesByDirectory) is one of dirs, or that live below one of them.
+func FilesInDirectories(files []string, dirs []string) []string {
+	var selected []string
+	for _, f := range files {
+		for _, dir := range dirs {
+			if dir == "." && path.Dir(f) == "." || dir != "." && strings.HasPrefix(f, dir+"/") {
+				selected = append(selected, f)
+				break
+			}
+		}
+	}
+	return selected
+}
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+// HammerIgnoreFile holds extra ignore rules (gitignore syntax) for files the
+// agents should never see, even if they are tracked.
+const HammerIgnoreFile = ".hammerignore"
+
+// DefaultMaxFileBytes is the largest file shown to the LLM unless .hammer.yaml sets max_file_bytes.
+const DefaultMaxFileBytes = 256 * 1024
+
+// Bytes inspected for binary content and generated-file markers.
+const sniffBytes = 8000
+
+// defaultIgnorePatterns hide dependency trees and lockfiles. A .hammerignore
+// can re-include any of them with a "!" pattern.
+var defaultIgnorePatterns = []string{
+	"vendor/",
+	"node_modules/",
+	"third_party/",
+	"*.lock",
+	"package-lock.json",
+	"pnpm-lock.yaml",
+	"go.sum",
+	"*.min.js",
+	"*.min.css",
+}
+
+// generatedMarkers identify generated files in their header.
+var generatedMarkers = []string{
+	"DO NOT EDIT",
+	"@generated",
+	"<auto-generated",
+	"This file is automatically generated",
+	"This file was automatically generated",
+}
+
+// Reasons a file is hidden from the agents.
+const (
+	FilterReasonIgnored   = "ignored"
+	FilterReasonTooLarge  = "too large"
+	FilterReasonBinary    = "binary"
+	FilterReasonGenerated = "generated"
+)
+
+// fileFilter decides which worktree files may be listed for and read by the LLM.
+type fileFilter struct {
+	s            *GitService
+	matcher      gitignore.Matcher
+	maxFileBytes int64
+}
+
+// newFileFilter loads the ignore rules from the current worktree: built-in
+// defaults, every .gitignore, .git/info/exclude, then .hammerignore.
+func (s *GitService) newFileFilter() (*fileFilter, error) {
+	var patterns []gitignore.Pattern
+	for _, p := range defaultIgnorePatterns {
+		patterns = append(patterns, gitignore.ParsePattern(p, nil))
+	}
+	gitPatterns, err := gitignore.ReadPatterns(s.fs, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .gitignore rules: %w", err)
+	}
+	patterns = append(patterns, gitPatterns...)
+	hammerPatterns, err := s.readHammerIgnore()
+	if err != nil {
+		return nil, err
+	}
+	patterns = append(patterns, hammerPatterns...)
+
+	maxFileBytes := int64(DefaultMaxFileBytes)
+	if s.config != nil && s.config.MaxFileBytes > 0 {
+		maxFileBytes = s.config.MaxFileBytes
+	}
+	return &fileFilter{s: s, matcher: gitignore.NewMatcher(patterns), maxFileBytes: maxFileBytes}, nil
+}
+
+func (s *GitService) readHammerIgnore() ([]gitignore.Pattern, error) {
+	content, err := s.ReadFile(HammerIgnoreFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var patterns []gitignore.Pattern
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, gitignore.ParsePattern(line, nil))
+	}
+	return patterns, nil
+}
+
+// reason returns why a file is hidden from the LLM, or "" if it may be used.
+func (f *fileFilter) reason(filePath string) (string, error) {
+	if f.matcher.Match(strings.Split(filePath, "/"), false) || f.s.isIgnored(filePath) {
+		return FilterReasonIgnored, nil
+	}
+	info, err := f.s.fs.Stat(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil // Tracked but deleted in the worktree; nothing to sniff
+		}
+		return "", fmt.Errorf("failed to stat '%s': %w", filePath, err)
+	}
+	if info.Size() > f.maxFileBytes {
+		return FilterReasonTooLarge, nil
+	}
+
+	file, err := f.s.fs.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open '%s': %w", filePath, err)
+	}
+	defer file.Close()
+	head := make([]byte, sniffBytes)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("failed to read '%s': %w", filePath, err)
+	}
+	head = head[:n]
+	if bytes.IndexByte(head, 0) >= 0 {
+		return FilterReasonBinary, nil
+	}
+	if isGeneratedHeader(head) {
+		return FilterReasonGenerated, nil
+	}
+	return "", nil
+}
+
+// isGeneratedHeader looks for a generated-code marker in the first lines of a file.
+func isGeneratedHeader(head []byte) bool {
+	lines := bytes.SplitN(head, []byte("\n"), 30)
+	if len(lines) == 30 {
+		lines = lines[:29] // The last element holds the rest of the sniffed bytes
+	}
+	for _, line := range lines {
+		for _, marker := range generatedMarkers {
+			if bytes.Contains(line, []byte(marker)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FilterReason reports why a file would be withheld from the LLM ("" if allowed).
+func (s *GitService) FilterReason(filePath string) (string, error) {
+	filter, err := s.newFileFilter()
+	if err != nil {
+		return "", err
+	}
+	return filter.reason(filePath)
+}
+
+// filterFiles drops files withheld from the LLM and logs a summary by reason.
+func (s *GitService) filterFiles(files []string) ([]string, error) {
+	filter, err := s.newFileFilter()
+	if err != nil {
+		return nil, err
+	}
+	var kept []string
+	skipped := make(map[string]int)
+	for _, file := range files {
+		reason, err := filter.reason(file)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			skipped[reason]++
+			continue
+		}
+		kept = append(kept, file)
+	}
+	if len(skipped) > 0 {
+		log.Printf("Filtered file listing: kept %d of %d files (skipped by reason: %v)", len(kept), len(files), skipped)
+	}
+	return kept, nil
+}
@@ -0,0 +1,324 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// auth returns the credentials for remote operations, or nil for anonymous access.
+func (s *GitService) auth() transport.AuthMethod {
+	if s.username == "" && s.password == "" {
+		return nil
+	}
+	return &http.BasicAuth{
+		Username: s.username,
+		Password: s.password,
+	}
+}
+
+// BaseBranch returns the short name of the branch that was cloned (e.g. "main").
+func (s *GitService) BaseBranch() string {
+	return s.baseBranch
+}
+
+// BaseHash returns the commit the generated commits are currently based on.
+func (s *GitService) BaseHash() plumbing.Hash {
+	return s.baseHash
+}
+
+// CommitsSinceBase returns the commits made on top of the base commit, oldest first.
+func (s *GitService) CommitsSinceBase() ([]*object.Commit, error) {
+	return s.commitsSince(s.baseHash)
+}
+
+// commitsSince returns the first-parent commits from base (exclusive) to HEAD, oldest first.
+func (s *GitService) commitsSince(base plumbing.Hash) ([]*object.Commit, error) {
+	headRef, err := s.repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get HEAD ref: %w", err)
+	}
+	var commits []*object.Commit
+	hash := headRef.Hash()
+	for hash != base {
+		commit, err := s.repo.CommitObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load commit %s: %w", hash, err)
+		}
+		commits = append([]*object.Commit{commit}, commits...)
+		if commit.NumParents() == 0 {
+			return nil, fmt.Errorf("reached root commit without finding base %s", base)
+		}
+		hash = commit.ParentHashes[0]
+	}
+	return commits, nil
+}
+
+// SquashSinceBase replaces all commits made since the base commit with a single
+// commit carrying the given message. Returns HEAD unchanged if there is nothing to squash.
+func (s *GitService) SquashSinceBase(message string) (plumbing.Hash, error) {
+	commits, err := s.CommitsSinceBase()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if len(commits) < 2 {
+		log.Printf("Nothing to squash (%d commit(s) since base).", len(commits))
+		return s.RepoHeadHash()
+	}
+	worktree, err := s.repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to get worktree: %w", err)
+	}
+	// A soft reset keeps the index at the final tree, so the next commit captures every step.
+	if err := worktree.Reset(&git.ResetOptions{Commit: s.baseHash, Mode: git.SoftReset}); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to reset to base %s for squash: %w", s.baseHash, err)
+	}
+	hash, err := s.Commit(message)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to create squashed commit: %w", err)
+	}
+	log.Printf("Squashed %d commits into %s", len(commits), hash)
+	return hash, nil
+}
+
+// FetchLatestBase fetches the base branch from origin and returns its current tip.
+func (s *GitService) FetchLatestBase() (plumbing.Hash, error) {
+	remoteRef := plumbing.NewRemoteReferenceName("origin", s.baseBranch)
+	refSpec := config.RefSpec(fmt.Sprintf("+%s:%s", plumbing.NewBranchReferenceName(s.baseBranch), remoteRef))
+	err := s.repo.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{refSpec},
+		Auth:       s.auth(),
+		Depth:      1,
+		Force:      true,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return plumbing.ZeroHash, fmt.Errorf("failed to fetch base branch '%s': %w", s.baseBranch, err)
+	}
+	ref, err := s.repo.Reference(remoteRef, true)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to resolve %s after fetch: %w", remoteRef, err)
+	}
+	return ref.Hash(), nil
+}
+
+// RebaseOntoLatestBase fetches the latest base branch and replays the generated commits
+// on top of it, file by file. In follow-up runs the previous runs' commits are
+// replayed too. If a file touched by a replayed commit also changed upstream, the
+// rebase is abandoned, HEAD is left untouched and the conflicting paths are returned.
+func (s *GitService) RebaseOntoLatestBase() (plumbing.Hash, []string, error) {
+	newBase, err := s.FetchLatestBase()
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+	origHead, err := s.RepoHeadHash()
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+	if newBase == s.upstreamBase {
+		log.Printf("Base branch '%s' has not moved; nothing to rebase.", s.baseBranch)
+		return origHead, nil, nil
+	}
+
+	commits, err := s.commitsSince(s.upstreamBase)
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+	conflicts, err := s.ConflictingPaths(newBase)
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+	if len(conflicts) > 0 {
+		log.Printf("Rebase onto %s aborted: %d conflicting file(s): %v", newBase, len(conflicts), conflicts)
+		return origHead, conflicts, nil
+	}
+
+	worktree, err := s.repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, nil, fmt.Errorf("failed to get worktree: %w", err)
+	}
+	if err := worktree.Reset(&git.ResetOptions{Commit: newBase, Mode: git.HardReset}); err != nil {
+		return plumbing.ZeroHash, nil, fmt.Errorf("failed to reset to latest base %s: %w", newBase, err)
+	}
+	// The run's own commits start after baseHash; keep pointing at its replayed copy.
+	replayedBase := newBase
+	for _, commit := range commits {
+		if err := s.replayCommit(worktree, commit); err != nil {
+			// Restore the original commits so the run can still push them.
+			if resetErr := worktree.Reset(&git.ResetOptions{Commit: origHead, Mode: git.HardReset}); resetErr != nil {
+				log.Printf("Warning: failed to restore HEAD %s after failed rebase: %v", origHead, resetErr)
+			}
+			return plumbing.ZeroHash, nil, fmt.Errorf("failed to replay commit %s: %w", commit.Hash, err)
+		}
+		if commit.Hash == s.baseHash {
+			if replayedBase, err = s.RepoHeadHash(); err != nil {
+				return plumbing.ZeroHash, nil, err
+			}
+		}
+	}
+	s.baseHash = replayedBase
+	s.upstreamBase = newBase
+	newHead, err := s.RepoHeadHash()
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+	log.Printf("Rebased %d commit(s) onto %s; new HEAD %s", len(commits), newBase, newHead)
+	return newHead, nil, nil
+}
+
+// ConflictingPaths returns the files the branch changed since it left the base
+// branch that were also changed upstream since then.
+func (s *GitService) ConflictingPaths(upstream plumbing.Hash) ([]string, error) {
+	changed, err := s.changedPathsBetween(s.upstreamBase, plumbing.ZeroHash)
+	if err != nil {
+		return nil, err
+	}
+	upstreamChanged, err := s.changedPathsBetween(s.upstreamBase, upstream)
+	if err != nil {
+		return nil, err
+	}
+	head, err := s.RepoHeadHash()
+	if err != nil {
+		return nil, err
+	}
+	var conflicts []string
+	for p := range changed {
+		if _, ok := upstreamChanged[p]; !ok {
+			continue
+		}
+		// Both sides making the identical change is not a conflict.
+		ours, oursExists, err := s.fileAt(head, p)
+		if err != nil {
+			return nil, err
+		}
+		theirs, theirsExists, err := s.fileAt(upstream, p)
+		if err != nil {
+			return nil, err
+		}
+		if oursExists == theirsExists && ours == theirs {
+			continue
+		}
+		conflicts = append(conflicts, p)
+	}
+	sort.Strings(conflicts)
+	return conflicts, nil
+}
+
+// changedPathsBetween lists paths that differ between two commits. A zero "to" means HEAD.
+func (s *GitService) changedPathsBetween(from, to plumbing.Hash) (map[string]struct{}, error) {
+	if to == plumbing.ZeroHash {
+		head, err := s.RepoHeadHash()
+		if err != nil {
+			return nil, err
+		}
+		to = head
+	}
+	fromTree, err := s.treeAt(from)
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := s.treeAt(to)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := fromTree.Diff(toTree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff %s..%s: %w", from, to, err)
+	}
+	paths := make(map[string]struct{})
+	for _, change := range changes {
+		if change.From.Name != "" {
+			paths[change.From.Name] = struct{}{}
+		}
+		if change.To.Name != "" {
+			paths[change.To.Name] = struct{}{}
+		}
+	}
+	return paths, nil
+}
+
+func (s *GitService) treeAt(hash plumbing.Hash) (*object.Tree, error) {
+	commit, err := s.repo.CommitObject(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load commit %s: %w", hash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tree of commit %s: %w", hash, err)
+	}
+	return tree, nil
+}
+
+// replayCommit applies the file changes of commit (relative to its first parent)
+// to the worktree and commits them with the original message.
+func (s *GitService) replayCommit(worktree *git.Worktree, commit *object.Commit) error {
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return fmt.Errorf("failed to load parent: %w", err)
+	}
+	parentTree, err := parent.Tree()
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	changes, err := parentTree.Diff(tree)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		if change.To.Name == "" {
+			if _, err := worktree.Remove(change.From.Name); err != nil {
+				return fmt.Errorf("failed to remove '%s': %w", change.From.Name, err)
+			}
+			continue
+		}
+		if change.From.Name != "" && change.From.Name != change.To.Name {
+			if _, err := worktree.Remove(change.From.Name); err != nil {
+				return fmt.Errorf("failed to remove renamed '%s': %w", change.From.Name, err)
+			}
+		}
+		file, err := tree.TreeEntryFile(&change.To.TreeEntry)
+		if err != nil {
+			return fmt.Errorf("failed to load '%s': %w", change.To.Name, err)
+		}
+		content, err := file.Contents()
+		if err != nil {
+			return fmt.Errorf("failed to read '%s': %w", change.To.Name, err)
+		}
+		if err := s.writeFile(change.To.Name, content); err != nil {
+			return err
+		}
+	}
+	_, err = s.Commit(commit.Message)
+	return err
+}
+
+// remoteBranchHash returns the hash of the branch on origin, or ZeroHash if it does not exist.
+func (s *GitService) remoteBranchHash(branchName string) (plumbing.Hash, error) {
+	remote, err := s.repo.Remote("origin")
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to get remote origin: %w", err)
+	}
+	refs, err := remote.List(&git.ListOptions{Auth: s.auth()})
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to list remote refs: %w", err)
+	}
+	refName := plumbing.NewBranchReferenceName(branchName)
+	for _, ref := range refs {
+		if ref.Name() == refName {
+			return ref.Hash(), nil
+		}
+	}
+	return plumbing.ZeroHash, nil
+}
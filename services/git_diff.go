@@ -0,0 +1,130 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	fdiff "github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// DiffChanges renders a unified diff of the pending changes (file -> new content)
+// against the files at HEAD, without touching the worktree.
+func (s *GitService) DiffChanges(changes map[string]string) (string, error) {
+	var headCommit *object.Commit
+	headRef, err := s.repo.Head()
+	if err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return "", fmt.Errorf("failed to get HEAD ref: %w", err)
+	}
+	if err == nil {
+		headCommit, err = s.repo.CommitObject(headRef.Hash())
+		if err != nil {
+			return "", fmt.Errorf("failed to load HEAD commit: %w", err)
+		}
+	}
+
+	paths := make([]string, 0, len(changes))
+	for p := range changes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	patch := &textPatch{}
+	for _, p := range paths {
+		oldContent, exists := "", false
+		if headCommit != nil {
+			if f, errFile := headCommit.File(p); errFile == nil {
+				if oldContent, err = f.Contents(); err != nil {
+					return "", fmt.Errorf("failed to read '%s' at HEAD: %w", p, err)
+				}
+				exists = true
+			} else if !errors.Is(errFile, object.ErrFileNotFound) {
+				return "", fmt.Errorf("failed to look up '%s' at HEAD: %w", p, errFile)
+			}
+		}
+		patch.add(p, oldContent, exists, changes[p], true)
+	}
+	return patch.String()
+}
+
+// textPatch is a minimal fdiff.Patch built from in-memory file contents, so it
+// can be rendered by go-git's UnifiedEncoder.
+type textPatch struct {
+	filePatches []fdiff.FilePatch
+}
+
+func (p *textPatch) add(path, oldContent string, oldExists bool, newContent string, newExists bool) {
+	if oldExists && newExists && oldContent == newContent {
+		return
+	}
+	fp := &textFilePatch{}
+	if oldExists {
+		fp.from = &textFile{path: path, hash: plumbing.ComputeHash(plumbing.BlobObject, []byte(oldContent))}
+	}
+	if newExists {
+		fp.to = &textFile{path: path, hash: plumbing.ComputeHash(plumbing.BlobObject, []byte(newContent))}
+	}
+	for _, d := range diff.Do(oldContent, newContent) {
+		op := fdiff.Equal
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			op = fdiff.Add
+		case diffmatchpatch.DiffDelete:
+			op = fdiff.Delete
+		}
+		fp.chunks = append(fp.chunks, &textChunk{content: d.Text, op: op})
+	}
+	p.filePatches = append(p.filePatches, fp)
+}
+
+func (p *textPatch) FilePatches() []fdiff.FilePatch { return p.filePatches }
+func (p *textPatch) Message() string                { return "" }
+
+func (p *textPatch) String() (string, error) {
+	buf := new(bytes.Buffer)
+	if err := fdiff.NewUnifiedEncoder(buf, fdiff.DefaultContextLines).Encode(p); err != nil {
+		return "", fmt.Errorf("failed to encode diff: %w", err)
+	}
+	return buf.String(), nil
+}
+
+type textFilePatch struct {
+	from, to *textFile
+	chunks   []fdiff.Chunk
+}
+
+func (fp *textFilePatch) IsBinary() bool { return false }
+func (fp *textFilePatch) Chunks() []fdiff.Chunk { return fp.chunks }
+func (fp *textFilePatch) Files() (from, to fdiff.File) {
+	// Return untyped nils so the encoder can detect created/deleted files.
+	if fp.from != nil {
+		from = fp.from
+	}
+	if fp.to != nil {
+		to = fp.to
+	}
+	return from, to
+}
+
+type textFile struct {
+	path string
+	hash plumbing.Hash
+}
+
+func (f *textFile) Hash() plumbing.Hash     { return f.hash }
+func (f *textFile) Mode() filemode.FileMode { return filemode.Regular }
+func (f *textFile) Path() string            { return f.path }
+
+type textChunk struct {
+	content string
+	op      fdiff.Operation
+}
+
+func (c *textChunk) Content() string       { return c.content }
+func (c *textChunk) Type() fdiff.Operation { return c.op }
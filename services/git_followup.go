@@ -0,0 +1,110 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Follow-up runs only look this far back for commits made by a previous run.
+const maxFollowUpCommits = 50
+
+// Matches the template commit subject, e.g. "AI Agent: Apply step 2/5: Add handler".
+var templateCommitSubject = regexp.MustCompile(`^AI Agent: Apply step \d+/\d+: (.*)$`)
+
+// FollowUpState describes the work a previous run already did on a branch.
+type FollowUpState struct {
+	PriorSteps []string // Subjects of the previous run's commits, oldest first
+	PriorDiff  string   // Unified diff of the previous run's commits
+}
+
+// CheckoutFollowUpBranch fetches an existing branch created by a previous run and
+// checks it out, so new commits are added on top of it. Its tip becomes the base
+// commit for squashing, while conflict checks and rebases still target the default
+// branch, measured from the commit the branch forked from. The previous run's
+// commits are the commits at the tip of the branch authored by the agent.
+func (s *GitService) CheckoutFollowUpBranch(branchName string) (*FollowUpState, error) {
+	if err := s.ValidateOutputBranch(branchName); err != nil {
+		return nil, err
+	}
+	log.Printf("Fetching follow-up branch '%s'", branchName)
+	localRef := plumbing.NewBranchReferenceName(branchName)
+	remoteRef := plumbing.NewRemoteReferenceName("origin", branchName)
+	refSpec := config.RefSpec(fmt.Sprintf("+%s:%s", localRef, remoteRef))
+	err := s.repo.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{refSpec},
+		Auth:       s.auth(),
+		Depth:      maxFollowUpCommits + 1,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, fmt.Errorf("failed to fetch follow-up branch '%s': %w", branchName, err)
+	}
+	ref, err := s.repo.Reference(remoteRef, true)
+	if err != nil {
+		return nil, fmt.Errorf("follow-up branch '%s' not found on remote: %w", branchName, err)
+	}
+
+	worktree, err := s.repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get worktree: %w", err)
+	}
+	err = worktree.Checkout(&git.CheckoutOptions{
+		Branch: localRef,
+		Hash:   ref.Hash(),
+		Create: true,
+		Force:  true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check out follow-up branch '%s': %w", branchName, err)
+	}
+	s.baseHash = ref.Hash()
+	s.followUpBranch = branchName
+	s.leases[branchName] = ref.Hash()
+
+	// Walk back over the agent's commits to find where the previous run started.
+	tip, err := s.repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tip of '%s': %w", branchName, err)
+	}
+	state := &FollowUpState{}
+	start := tip
+	for i := 0; i < maxFollowUpCommits && start.Author.Name == commitAuthorName && start.NumParents() > 0; i++ {
+		subject, _, _ := strings.Cut(start.Message, "\n")
+		if m := templateCommitSubject.FindStringSubmatch(subject); m != nil {
+			subject = m[1]
+		}
+		state.PriorSteps = append([]string{strings.TrimSpace(subject)}, state.PriorSteps...)
+		parent, err := start.Parent(0)
+		if err != nil {
+			log.Printf("Warning: history of '%s' is truncated; prior context may be incomplete: %v", branchName, err)
+			break
+		}
+		start = parent
+	}
+	// The first commit below the agent's is where the branch left the default branch.
+	s.upstreamBase = start.Hash
+	if start.Hash != tip.Hash {
+		state.PriorDiff, err = commitRangeDiff(start, tip)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("Checked out follow-up branch '%s' at %s with %d prior step commit(s)", branchName, tip.Hash, len(state.PriorSteps))
+	return state, nil
+}
+
+func commitRangeDiff(from, to *object.Commit) (string, error) {
+	patch, err := from.Patch(to)
+	if err != nil {
+		return "", fmt.Errorf("failed to diff %s..%s: %w", from.Hash, to.Hash, err)
+	}
+	return patch.String(), nil
+}
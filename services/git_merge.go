@@ -0,0 +1,149 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"hammer/shared"
+)
+
+// MergeCheck is the outcome of comparing the generated commits with the latest base.
+type MergeCheck struct {
+	Upstream  plumbing.Hash // Latest tip of the base branch
+	BaseMoved bool          // Whether the base branch advanced since the clone
+	Conflicts []string      // Files changed both by the run and upstream
+}
+
+// CheckMergeConflicts fetches the latest base branch and reports which files would
+// conflict if the generated commits were merged with it. Nothing is modified.
+func (s *GitService) CheckMergeConflicts() (*MergeCheck, error) {
+	upstream, err := s.FetchLatestBase()
+	if err != nil {
+		return nil, err
+	}
+	check := &MergeCheck{Upstream: upstream, BaseMoved: upstream != s.upstreamBase}
+	if !check.BaseMoved {
+		return check, nil
+	}
+	check.Conflicts, err = s.ConflictingPaths(upstream)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Base branch '%s' moved to %s; %d conflicting file(s): %v", s.baseBranch, upstream, len(check.Conflicts), check.Conflicts)
+	return check, nil
+}
+
+// ConflictVersions returns the base, HEAD and upstream content of a file.
+func (s *GitService) ConflictVersions(path string, upstream plumbing.Hash) (*shared.ConflictFile, error) {
+	head, err := s.RepoHeadHash()
+	if err != nil {
+		return nil, err
+	}
+	v := &shared.ConflictFile{Path: path}
+	if v.Base, v.BaseExists, err = s.fileAt(s.upstreamBase, path); err != nil {
+		return nil, err
+	}
+	if v.Ours, v.OursExists, err = s.fileAt(head, path); err != nil {
+		return nil, err
+	}
+	if v.Theirs, v.TheirsExists, err = s.fileAt(upstream, path); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// MergeUpstream creates a merge commit of HEAD and upstream. Files only changed
+// upstream are taken from upstream; every conflicting file must have an entry in
+// resolutions (file -> merged content).
+func (s *GitService) MergeUpstream(upstream plumbing.Hash, resolutions map[string]string, message string) (plumbing.Hash, error) {
+	conflicts, err := s.ConflictingPaths(upstream)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	var unresolved []string
+	for _, p := range conflicts {
+		if _, ok := resolutions[p]; !ok {
+			unresolved = append(unresolved, p)
+		}
+	}
+	if len(unresolved) > 0 {
+		return plumbing.ZeroHash, fmt.Errorf("cannot merge %s: unresolved conflicts in %v", upstream, unresolved)
+	}
+
+	upstreamChanged, err := s.changedPathsBetween(s.upstreamBase, upstream)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	worktree, err := s.repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to get worktree: %w", err)
+	}
+	paths := make([]string, 0, len(upstreamChanged))
+	for p := range upstreamChanged {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if _, ok := resolutions[p]; ok {
+			continue
+		}
+		content, exists, err := s.fileAt(upstream, p)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if !exists {
+			if _, err := worktree.Remove(p); err != nil {
+				return plumbing.ZeroHash, fmt.Errorf("failed to remove '%s' deleted upstream: %w", p, err)
+			}
+			continue
+		}
+		if err := s.writeFile(p, content); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	for p, content := range resolutions {
+		if err := s.writeFile(p, content); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	head, err := s.RepoHeadHash()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	opts := s.commitOptions()
+	opts.Parents = []plumbing.Hash{head, upstream}
+	opts.AllowEmptyCommits = true // The merge commit is needed even if the tree is unchanged
+	commit, err := worktree.Commit(s.withTrailers(message), opts)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to create merge commit: %w", err)
+	}
+	s.mergedUpstream = upstream
+	log.Printf("Merged %s into HEAD with %d resolved conflict(s): %s", upstream, len(resolutions), commit)
+	return commit, nil
+}
+
+// fileAt returns the content of path at the given commit and whether it exists.
+func (s *GitService) fileAt(hash plumbing.Hash, path string) (string, bool, error) {
+	commit, err := s.repo.CommitObject(hash)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to load commit %s: %w", hash, err)
+	}
+	file, err := commit.File(path)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to look up '%s' at %s: %w", path, hash, err)
+	}
+	content, err := file.Contents()
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read '%s' at %s: %w", path, hash, err)
+	}
+	return content, true, nil
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
@@ -21,14 +22,39 @@ import (
   "hammer/shared"
 )
 
+// Name recorded as the author of every generated commit.
+const commitAuthorName = "AI Agent"
+
 type GitService struct {
 	repo      *git.Repository
 	fs        billy.Filesystem
   username  string
   password  string
+  signer    *CommitSigner // Optional; nil means commits are unsigned
+  baseBranch string        // Default branch checked out by the clone; conflict checks and rebases target it
+  baseHash   plumbing.Hash // Commit the generated commits build on
+  upstreamBase plumbing.Hash // Commit of baseBranch the branch's changes are measured against; the fork point in follow-up runs
+  followUpBranch string      // Branch checked out by CheckoutFollowUpBranch, if any
+  mergedUpstream plumbing.Hash // Base branch commit merged by MergeUpstream; ZeroHash if none
+  leases     map[string]plumbing.Hash // Remote tip of a branch when the run first read it; ZeroHash if it did not exist
+  config     *shared.RepoConfig // Loaded from .hammer.yaml; nil until LoadRepoConfig
+  dirSummaryCache map[string]cachedDirSummary // Directory summaries reused across steps
+  symbols    *SymbolIndex // Built on first use, refreshed incrementally
+  search     *SearchIndex // Built at init, refreshed incrementally
+  policy     WritePolicy  // Worker-wide write limits; see SetWritePolicy
+  rejected   []shared.RejectedWrite // Writes refused by the policy, until TakeRejectedWrites
+  trailers   []string               // Appended to every commit message; see SetCommitTrailers
 }
 
-func NewGitService(repoURL string, creds shared.GitCredentials) (*GitService, error) {
+// ErrProtectedPath is returned when a write targets a path protected by the
+// repository config or the worker's write policy.
+var ErrProtectedPath = errors.New("path is protected")
+
+// ErrInvalidBranch is returned for output branch names that are not valid git
+// refs or that name the repository's base branch.
+var ErrInvalidBranch = errors.New("invalid output branch")
+
+func NewGitService(repoURL string, creds shared.GitCredentials, signer *CommitSigner) (*GitService, error) {
 	log.Printf("Cloning repository %s into memory...", repoURL)
 	// Use simple variable name `fs`
 	fs := memfs.New() // fs is type *memfs.Memory
@@ -61,12 +87,22 @@ func NewGitService(repoURL string, creds shared.GitCredentials) (*GitService, er
 	}
 	log.Println("Repository cloned successfully.")
 
+	headRef, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve HEAD of cloned repo: %w", err)
+	}
+
 	// Assign the *memfs.Memory instance 'fs' to the struct field 'fs'
 	return &GitService{
 		repo:     repo,
 		fs:       fs,
 	  username: creds.Username,
     password: creds.Password,
+    signer:   signer,
+    baseBranch: headRef.Name().Short(),
+    baseHash:   headRef.Hash(),
+    upstreamBase: headRef.Hash(),
+    leases:     make(map[string]plumbing.Hash),
   }, nil
 }
 
@@ -102,7 +138,8 @@ func (s *GitService) ListFiles() ([]string, error) {
 			filteredFiles = append(filteredFiles, file)
 		}
 	}
-	return filteredFiles, nil
+	// Drop ignored, oversized, binary and generated files so they never reach the LLM.
+	return s.filterFiles(filteredFiles)
 }
 
 
@@ -135,8 +172,19 @@ func (s *GitService) ReadFile(filePath string) (string, error) {
 	return string(content), nil
 }
 
-// ... (WriteFile, Commit, CreateBranch, RepoHeadHash remain the same) ...
+// WriteFile writes and stages a file on behalf of the agents. The write policy is
+// applied first (see checkWrite); rejected writes are recorded, not applied.
 func (s *GitService) WriteFile(filePath string, content string) error {
+	p, err := s.checkWrite(filePath, len(content))
+	if err != nil {
+		return err
+	}
+	return s.writeFile(p, content)
+}
+
+// writeFile writes and stages a file without policy checks. Used when replaying
+// commits or taking upstream content, which the run did not author.
+func (s *GitService) writeFile(filePath string, content string) error {
 	worktree, err := s.repo.Worktree()
 	if err != nil {
 		return fmt.Errorf("failed to get worktree: %w", err)
@@ -191,21 +239,107 @@ func (s *GitService) Commit(message string) (plumbing.Hash, error) {
 		}
 		return headRef.Hash(), nil
 	}
-	commit, err := worktree.Commit(message, &git.CommitOptions{
+	commit, err := worktree.Commit(s.withTrailers(message), s.commitOptions())
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to commit changes: %w", err)
+	}
+	log.Printf("Committed changes with hash: %s", commit.String())
+	return commit, nil
+}
+
+// SetCommitTrailers sets trailers (e.g. "Requested-by: Name <email>") that are
+// appended to every commit this service creates.
+func (s *GitService) SetCommitTrailers(trailers []string) {
+	s.trailers = trailers
+}
+
+// withTrailers appends the configured trailers that the message does not already
+// carry, so re-committing a message (as a rebase does) adds nothing twice.
+func (s *GitService) withTrailers(message string) string {
+	var missing []string
+	for _, t := range s.trailers {
+		if !strings.Contains("\n"+message+"\n", "\n"+t+"\n") {
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) == 0 {
+		return message
+	}
+	message = strings.TrimRight(message, "\n")
+	paragraphs := strings.Split(message, "\n\n")
+	if !isTrailerBlock(paragraphs[len(paragraphs)-1]) || len(paragraphs) == 1 {
+		message += "\n"
+	}
+	return message + "\n" + strings.Join(missing, "\n") + "\n"
+}
+
+// trailerLine matches a git trailer such as "Signed-off-by: A <a@example.com>".
+var trailerLine = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*: \S`)
+
+func isTrailerBlock(paragraph string) bool {
+	for _, line := range strings.Split(paragraph, "\n") {
+		if !trailerLine.MatchString(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// commitOptions returns the author and signing options used for every generated commit.
+func (s *GitService) commitOptions() *git.CommitOptions {
+	commitOpts := &git.CommitOptions{
 		Author: &object.Signature{
-			Name:  "AI Agent",
+			Name:  commitAuthorName,
 			Email: "ai@example.com",
 			When:  time.Now(),
 		},
-	})
+	}
+	s.signer.apply(commitOpts)
+	return commitOpts
+}
+
+// SigningKeyFingerprint returns the fingerprint of the key used to sign commits,
+// or an empty string when commits are unsigned.
+func (s *GitService) SigningKeyFingerprint() string {
+	if s.signer == nil {
+		return ""
+	}
+	return s.signer.Fingerprint
+}
+
+// ValidateOutputBranch checks that the run may commit to and push branchName: it
+// must be a valid branch name and must not be the base branch the clone checked out.
+func (s *GitService) ValidateOutputBranch(branchName string) error {
+	if err := plumbing.NewBranchReferenceName(branchName).Validate(); err != nil || strings.HasPrefix(branchName, "-") {
+		return fmt.Errorf("%w: '%s' is not a valid branch name", ErrInvalidBranch, branchName)
+	}
+	if branchName == s.baseBranch {
+		return fmt.Errorf("%w: '%s' is the repository's base branch", ErrInvalidBranch, branchName)
+	}
+	return nil
+}
+
+// RecordRemoteBranch reads the remote tip of branchName, which PushBranch then
+// expects when force-pushing to it. Call it before the run changes anything.
+func (s *GitService) RecordRemoteBranch(branchName string) error {
+	if _, ok := s.leases[branchName]; ok {
+		return nil
+	}
+	hash, err := s.remoteBranchHash(branchName)
 	if err != nil {
-		return plumbing.ZeroHash, fmt.Errorf("failed to commit changes: %w", err)
+		return fmt.Errorf("failed to read remote state of branch '%s': %w", branchName, err)
 	}
-	log.Printf("Committed changes with hash: %s", commit.String())
-	return commit, nil
+	s.leases[branchName] = hash
+	log.Printf("Remote branch '%s' is at %s at the start of the run", branchName, hash)
+	return nil
 }
 
+// CreateBranch points branchName at HEAD. In follow-up runs the checked-out
+// follow-up branch is reused; any other existing branch is an error.
 func (s *GitService) CreateBranch(branchName string) error {
+	if err := s.ValidateOutputBranch(branchName); err != nil {
+		return err
+	}
 	headRef, err := s.repo.Head()
 	if err != nil {
 		if errors.Is(err, plumbing.ErrReferenceNotFound) { // Use errors.Is
@@ -215,7 +349,11 @@ func (s *GitService) CreateBranch(branchName string) error {
 	}
 	refName := plumbing.NewBranchReferenceName(branchName)
 	_, errCheck := s.repo.Reference(refName, false)
-	if errCheck == nil {
+	if errCheck == nil && headRef.Name() == refName && branchName == s.followUpBranch {
+		// Follow-up runs commit directly onto the checked-out branch.
+		log.Printf("Branch '%s' is already checked out at %s", branchName, headRef.Hash().String())
+		return nil
+	} else if errCheck == nil {
 		return fmt.Errorf("branch '%s' already exists", branchName)
 	} else if !errors.Is(errCheck, plumbing.ErrReferenceNotFound) { // Use !errors.Is
 		return fmt.Errorf("failed to check if branch '%s' exists: %w", branchName, errCheck)
@@ -241,7 +379,11 @@ func (s *GitService) RepoHeadHash() (plumbing.Hash, error) {
 }
 
 // PushBranch pushes the specified local branch to the remote origin.
-func (s *GitService) PushBranch(branchName string) error {
+// With forceWithLease set, an existing remote branch is overwritten only if it
+// still points at the commit recorded when the run started (see RecordRemoteBranch
+// and CheckoutFollowUpBranch). A branch the run did not see on the remote must
+// still be absent.
+func (s *GitService) PushBranch(branchName string, forceWithLease bool) error {
   log.Printf("Attempting to push branch '%s' to remote origin", branchName)
 
   if s.username == "" || s.password == "" {
@@ -253,14 +395,8 @@ func (s *GitService) PushBranch(branchName string) error {
   remoteRef := plumbing.NewBranchReferenceName(branchName)
   refSpec := config.RefSpec(fmt.Sprintf("%s:%s", localRef, remoteRef))
 
-  err := refSpec.Validate()
-  if err != nil {
-    return fmt.Errorf("invalid refspec created for branch '%s': %w", branchName, err)
-  }
-
   pushOpts := &git.PushOptions{
     RemoteName: "origin",
-    RefSpecs:   []config.RefSpec{refSpec},
     Auth:       &http.BasicAuth{
       Username: s.username,
       Password: s.password,
@@ -268,6 +404,28 @@ func (s *GitService) PushBranch(branchName string) error {
     Progress:   os.Stdout,
   }
 
+  if forceWithLease {
+    if expected := s.leases[branchName]; !expected.IsZero() {
+      refSpec = config.RefSpec("+" + string(refSpec))
+      pushOpts.ForceWithLease = &git.ForceWithLease{RefName: remoteRef, Hash: expected}
+      log.Printf("Updating existing remote branch '%s' (lease %s)", branchName, expected)
+    } else {
+      current, err := s.remoteBranchHash(branchName)
+      if err != nil {
+        return fmt.Errorf("failed to read remote state of branch '%s' for force-with-lease: %w", branchName, err)
+      }
+      if !current.IsZero() {
+        return fmt.Errorf("branch '%s' appeared on the remote at %s after the run started; not overwriting it", branchName, current)
+      }
+    }
+  }
+
+  err := refSpec.Validate()
+  if err != nil {
+    return fmt.Errorf("invalid refspec created for branch '%s': %w", branchName, err)
+  }
+  pushOpts.RefSpecs = []config.RefSpec{refSpec}
+
   log.Printf(
     "Pushing with options: Remote=%s, RefSpec=%s, Auth=BasicAuth(User:%s)",
     pushOpts.RemoteName,
@@ -292,3 +450,33 @@ func (s *GitService) PushBranch(branchName string) error {
   log.Printf("Successfully pushed branch '%s' to remote origin.", branchName)
   return nil
 }
+
+// RepoPromptsDir is where a target repository can keep its own prompt templates.
+const RepoPromptsDir = ".hammer/prompts"
+
+// ReadPromptOverrides returns the prompt templates the repository provides in
+// RepoPromptsDir, keyed by file name. A missing directory yields an empty map.
+func (s *GitService) ReadPromptOverrides() (shared.PromptOverrides, error) {
+	overrides := make(shared.PromptOverrides)
+	entries, err := s.fs.ReadDir(RepoPromptsDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return overrides, nil
+		}
+		return nil, fmt.Errorf("failed to list %s: %w", RepoPromptsDir, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		content, err := s.ReadFile(RepoPromptsDir + "/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		overrides[entry.Name()] = content
+	}
+	if len(overrides) > 0 {
+		log.Printf("Found %d repository prompt override(s) in %s", len(overrides), RepoPromptsDir)
+	}
+	return overrides, nil
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// MatchGlob reports whether a slash-separated repository path matches pattern.
+// Patterns use path.Match syntax per segment, plus "**" to match any number of
+// segments (e.g. ".github/workflows/**", "**/*.pb.go"). A pattern without a
+// slash matches the base name at any depth, like .gitignore (e.g. "go.sum").
+func MatchGlob(pattern, filePath string) bool {
+	pattern = strings.TrimPrefix(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(filePath))
+		return ok
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(filePath, "/"))
+}
+
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(rest, parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// MatchAnyGlob reports whether filePath matches any of the patterns.
+func MatchAnyGlob(patterns []string, filePath string) bool {
+	for _, p := range patterns {
+		if MatchGlob(p, filePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateGlob checks that every segment of pattern is valid path.Match syntax.
+func ValidateGlob(pattern string) error {
+	if strings.TrimSpace(pattern) == "" {
+		return fmt.Errorf("empty pattern")
+	}
+	for _, segment := range strings.Split(strings.TrimPrefix(pattern, "/"), "/") {
+		if segment == "**" {
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package services
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		// Patterns without a slash match the base name at any depth.
+		{"go.sum", "go.sum", true},
+		{"go.sum", "tools/go.sum", true},
+		{"go.sum", "go.sum.bak", false},
+		{"*.pb.go", "api/v1/service.pb.go", true},
+		{"*.pb.go", "api/v1/service.go", false},
+		{"Makefile", "makefile", false},
+
+		// Patterns with a slash match from the repository root.
+		{"docs/*.md", "docs/a.md", true},
+		{"docs/*.md", "docs/sub/a.md", false},
+		{"docs/*.md", "other/docs/a.md", false},
+		{"/docs/*.md", "docs/a.md", true},
+
+		// "**" matches any number of segments, including none.
+		{".github/workflows/**", ".github/workflows/ci.yml", true},
+		{".github/workflows/**", ".github/workflows/sub/ci.yml", true},
+		{".github/workflows/**", ".github/workflows", true},
+		{".github/workflows/**", ".github/ci.yml", false},
+		{"**/*.pb.go", "a.pb.go", true},
+		{"**/*.pb.go", "a/b/c.pb.go", true},
+		{"**/*.pb.go", "a/b/c.go", false},
+		{"vendor/**/LICENSE", "vendor/LICENSE", true},
+		{"vendor/**/LICENSE", "vendor/x/y/LICENSE", true},
+		{"vendor/**/LICENSE", "vendor/x/y/COPYING", false},
+		{"**", "any/path/at/all", true},
+
+		// "*" does not cross segments.
+		{"src/*", "src/a/b.go", false},
+		{"src/*/b.go", "src/a/b.go", true},
+		{"src/?.go", "src/a.go", true},
+		{"src/[ab].go", "src/c.go", false},
+	}
+	for _, tt := range tests {
+		if got := MatchGlob(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("MatchGlob(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestValidateGlob(t *testing.T) {
+	for _, pattern := range []string{"go.sum", ".github/workflows/**", "**/*.pb.go", "src/[ab].go"} {
+		if err := ValidateGlob(pattern); err != nil {
+			t.Errorf("ValidateGlob(%q) = %v, want nil", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"", "  ", "src/[a.go", `a\`} {
+		if err := ValidateGlob(pattern); err == nil {
+			t.Errorf("ValidateGlob(%q) = nil, want an error", pattern)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"hammer/shared"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// Model and per-turn completion budget for the tool-calling agent.
+const (
+	agentModel     = openai.GPT4TurboPreview
+	agentMaxTokens = 4000
+)
+
+// agentTools describes the tools offered to the agent. Execution lives in
+// GitService.ExecuteAgentTool.
+func agentTools(verificationEnabled bool) []openai.Tool {
+	str := func(desc string) jsonschema.Definition {
+		return jsonschema.Definition{Type: jsonschema.String, Description: desc}
+	}
+	integer := func(desc string) jsonschema.Definition {
+		return jsonschema.Definition{Type: jsonschema.Integer, Description: desc}
+	}
+	tool := func(name, desc string, props map[string]jsonschema.Definition, required ...string) openai.Tool {
+		if props == nil {
+			props = map[string]jsonschema.Definition{}
+		}
+		return openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        name,
+				Description: desc,
+				Parameters:  jsonschema.Definition{Type: jsonschema.Object, Properties: props, Required: required},
+			},
+		}
+	}
+	tools := []openai.Tool{
+		tool(ToolListFiles, "List repository files, optionally only those under a path prefix.",
+			map[string]jsonschema.Definition{"prefix": str("Path prefix, e.g. \"services/\"; empty lists everything")}),
+		tool(ToolReadFile, "Read a file with line numbers. At most 400 lines are returned per call.",
+			map[string]jsonschema.Definition{
+				"path":       str("File path relative to the repository root"),
+				"start_line": integer("First line to return (1-based, default 1)"),
+				"end_line":   integer("Last line to return (inclusive, default end of file)"),
+			}, "path"),
+		tool(ToolSearch, "Search file contents for identifiers or phrases; returns the best matching files with a matching line.",
+			map[string]jsonschema.Definition{
+				"query": str("Identifiers, words or a quoted phrase"),
+				"limit": integer("Maximum number of files (default 10)"),
+			}, "query"),
+		tool(ToolFindSymbol, "Find where a function, type, method or variable is defined (file and line) and which files use it.",
+			map[string]jsonschema.Definition{"name": str("Symbol name, e.g. \"Commit\" or \"GitService.Commit\"")}, "name"),
+		tool(ToolWriteFile, "Create or overwrite a file with the complete new content.",
+			map[string]jsonschema.Definition{
+				"path":    str("File path relative to the repository root"),
+				"content": str("Complete file content"),
+			}, "path", "content"),
+		tool(ToolApplyPatch, "Apply a unified diff (with @@ hunks and context lines) to one file.",
+			map[string]jsonschema.Definition{
+				"path":  str("File path relative to the repository root"),
+				"patch": str("Unified diff for this file"),
+			}, "path", "patch"),
+		tool(ToolDeleteFile, "Delete a file.",
+			map[string]jsonschema.Definition{"path": str("File path relative to the repository root")}, "path"),
+	}
+	if verificationEnabled {
+		tools = append(tools, tool(ToolRunVerification, "Run the repository's build and test commands against the current changes and return their output.", nil))
+	}
+	return tools
+}
+
+// AgentTurn sends the agent conversation so far and returns the model's next
+// message, which either calls tools or, without tool calls, ends the step.
+func (s *LLMService) AgentTurn(ctx context.Context, input shared.AgentTurnActivityInput) (*shared.AgentTurnActivityResult, error) {
+	system, err := s.prompts.Render(PromptAgentSystem, input.PromptOverrides, AgentSystemPromptData{
+		UserRequest:         input.OriginalUserPrompt,
+		Step:                input.StepDescription,
+		Conventions:         input.Conventions,
+		Changes:             input.PriorChanges,
+		Revision:            input.Revision,
+		MaxIterations:       input.MaxIterations,
+		VerificationEnabled: input.VerificationEnabled,
+	})
+	if err != nil {
+		return nil, err
+	}
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: system},
+		{Role: openai.ChatMessageRoleUser, Content: "Complete the current coding step."},
+	}
+	for _, m := range input.History {
+		msg := openai.ChatCompletionMessage{Role: m.Role, Content: m.Content, ToolCallID: m.ToolCallID}
+		for _, call := range m.ToolCalls {
+			msg.ToolCalls = append(msg.ToolCalls, openai.ToolCall{
+				ID:       call.ID,
+				Type:     openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: call.Name, Arguments: call.Arguments},
+			})
+		}
+		messages = append(messages, msg)
+	}
+
+	resp, err := s.chat(ctx, shared.LLMRoleAgent, openai.ChatCompletionRequest{
+		Model:       agentModel,
+		Messages:    messages,
+		Tools:       agentTools(input.VerificationEnabled),
+		MaxTokens:   agentMaxTokens,
+		Temperature: 0.2,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("openai agent request failed: %w", err)
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("openai returned no agent response")
+	}
+
+	choice := resp.Choices[0].Message
+	reply := shared.AgentMessage{Role: openai.ChatMessageRoleAssistant, Content: choice.Content}
+	for _, call := range choice.ToolCalls {
+		reply.ToolCalls = append(reply.ToolCalls, shared.AgentToolCall{
+			ID:        call.ID,
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+		})
+	}
+	log.Printf("Agent turn: %d tool call(s), %d tokens", len(reply.ToolCalls), resp.Usage.TotalTokens)
+	return &shared.AgentTurnActivityResult{Message: reply, TotalTokens: resp.Usage.TotalTokens}, nil
+}
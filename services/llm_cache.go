@@ -0,0 +1,211 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+
+	"hammer/shared"
+)
+
+// defaultCacheTTL is how long cached responses are served when LLM_CACHE_TTL is unset.
+const defaultCacheTTL = 7 * 24 * time.Hour
+
+// cacheKeyVersion is part of every cache key; bump it when the entry format changes.
+const cacheKeyVersion = "v1"
+
+// cacheableRoles lists the LLM roles whose responses may be cached.
+var cacheableRoles = []string{
+	shared.LLMRolePlan,
+	shared.LLMRoleEvaluate,
+	shared.LLMRoleSelectDirectories,
+	shared.LLMRoleGenerate,
+	shared.LLMRoleReview,
+	shared.LLMRoleCommitMessage,
+	shared.LLMRoleResolveConflict,
+	shared.LLMRoleAgent,
+}
+
+// LLMCacheConfig configures the response cache. An empty Dir disables it.
+type LLMCacheConfig struct {
+	Dir   string
+	TTL   time.Duration
+	Roles map[string]bool // Roles whose responses are cached
+}
+
+// LoadLLMCacheConfigFromEnv reads LLM_CACHE_DIR, LLM_CACHE_TTL and
+// LLM_CACHE_ROLES (a comma-separated list of roles, or "all", the default).
+func LoadLLMCacheConfigFromEnv() (LLMCacheConfig, error) {
+	cfg := LLMCacheConfig{Dir: os.Getenv("LLM_CACHE_DIR"), TTL: defaultCacheTTL, Roles: make(map[string]bool)}
+	if value := os.Getenv("LLM_CACHE_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return LLMCacheConfig{}, fmt.Errorf("LLM_CACHE_TTL must be a positive duration, got %q", value)
+		}
+		cfg.TTL = ttl
+	}
+	roles := strings.TrimSpace(os.Getenv("LLM_CACHE_ROLES"))
+	if roles == "" || roles == "all" {
+		roles = strings.Join(cacheableRoles, ",")
+	}
+	for _, role := range strings.Split(roles, ",") {
+		if role = strings.TrimSpace(role); role == "" {
+			continue
+		}
+		known := false
+		for _, r := range cacheableRoles {
+			known = known || r == role
+		}
+		if !known {
+			return LLMCacheConfig{}, fmt.Errorf("LLM_CACHE_ROLES: unknown role %q (want some of %s)", role, strings.Join(cacheableRoles, ", "))
+		}
+		cfg.Roles[role] = true
+	}
+	return cfg, nil
+}
+
+// ResponseCache stores chat completion responses on disk, addressed by a hash of
+// the request, so identical requests are answered without calling the model.
+// Entries live in <dir>/<first two hex digits>/<hash>.json.
+type ResponseCache struct {
+	dir   string
+	ttl   time.Duration
+	roles map[string]bool
+	now   func() time.Time
+}
+
+// cacheEntry is the file format of a cached response.
+type cacheEntry struct {
+	StoredAt time.Time                     `json:"stored_at"`
+	Role     string                        `json:"role"`
+	Response openai.ChatCompletionResponse `json:"response"`
+}
+
+// NewResponseCache creates the cache directory and removes expired entries. It
+// returns nil if cfg.Dir is empty.
+func NewResponseCache(cfg LLMCacheConfig) (*ResponseCache, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create LLM cache directory: %w", err)
+	}
+	c := &ResponseCache{dir: cfg.Dir, ttl: cfg.TTL, roles: cfg.Roles, now: time.Now}
+	removed := c.prune()
+	log.Printf("LLM response cache enabled in %s (TTL %s, %d expired entries removed)", cfg.Dir, cfg.TTL, removed)
+	return c, nil
+}
+
+// Enabled reports whether responses for role are cached.
+func (c *ResponseCache) Enabled(role string) bool {
+	return c != nil && c.roles[role]
+}
+
+// Key returns the cache key of a request. It covers the model, the sampling
+// parameters, the messages and the tools.
+func (c *ResponseCache) Key(req openai.ChatCompletionRequest) (string, error) {
+	encoded, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode request for the cache key: %w", err)
+	}
+	sum := sha256.Sum256(append([]byte(cacheKeyVersion+"\n"), encoded...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Get returns the cached response for key, if there is one that has not expired.
+func (c *ResponseCache) Get(key string) (openai.ChatCompletionResponse, bool) {
+	content, err := os.ReadFile(c.path(key))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Warning: failed to read LLM cache entry %s: %v", key, err)
+		}
+		return openai.ChatCompletionResponse{}, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		log.Printf("Warning: discarding unreadable LLM cache entry %s: %v", key, err)
+		c.Delete(key)
+		return openai.ChatCompletionResponse{}, false
+	}
+	if c.now().Sub(entry.StoredAt) > c.ttl {
+		c.Delete(key)
+		return openai.ChatCompletionResponse{}, false
+	}
+	return entry.Response, true
+}
+
+// Put stores a response under key. Failures are logged, since the cache is only
+// an optimization.
+func (c *ResponseCache) Put(key, role string, resp openai.ChatCompletionResponse) {
+	content, err := json.Marshal(cacheEntry{StoredAt: c.now(), Role: role, Response: resp})
+	if err != nil {
+		log.Printf("Warning: failed to encode LLM cache entry %s: %v", key, err)
+		return
+	}
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		log.Printf("Warning: failed to store LLM cache entry %s: %v", key, err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		log.Printf("Warning: failed to store LLM cache entry %s: %v", key, err)
+		return
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Warning: failed to store LLM cache entry %s: %v", key, err)
+	}
+}
+
+// Delete removes the entry for key.
+func (c *ResponseCache) Delete(key string) {
+	if err := os.Remove(c.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Warning: failed to delete LLM cache entry %s: %v", key, err)
+	}
+}
+
+func (c *ResponseCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// prune removes entries and leftover temporary files older than the TTL and
+// returns how many it removed.
+func (c *ResponseCache) prune() int {
+	removed := 0
+	cutoff := c.now().Add(-c.ttl)
+	filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err == nil && info.ModTime().Before(cutoff) && os.Remove(path) == nil {
+			removed++
+		}
+		return nil
+	})
+	return removed
+}
+
+// SetResponseCache puts a response cache in front of the model. A nil cache
+// disables caching.
+func (s *LLMService) SetResponseCache(cache *ResponseCache) {
+	s.cache = cache
+}
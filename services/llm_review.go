@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"hammer/shared"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Model and completion budget for the self-review; the context files are fitted to
+// the rest of the model's context window.
+const (
+	reviewModel     = openai.GPT4TurboPreview
+	reviewMaxTokens = 1500
+)
+
+// Diffs longer than this are truncated in review and revision prompts.
+const maxReviewDiffChars = 24000
+
+// ErrInvalidReview is returned when the reviewer's reply is not the expected JSON.
+var ErrInvalidReview = errors.New("review response is invalid")
+
+// reviewResponse is the JSON object the review prompt asks for.
+type reviewResponse struct {
+	Approved bool   `json:"approved"`
+	Summary  string `json:"summary"`
+	Findings []struct {
+		Severity string `json:"severity"`
+		File     string `json:"file"`
+		Line     int    `json:"line"`
+		Message  string `json:"message"`
+	} `json:"findings"`
+}
+
+// ReviewCode critiques a step's generated changes. The step is approved unless
+// there is a high or medium severity finding; a rejection without such findings
+// would give the generator nothing to fix.
+func (s *LLMService) ReviewCode(ctx context.Context, input shared.ReviewCodeActivityInput) (*shared.ReviewResult, error) {
+	diff := input.Diff
+	if len(diff) > maxReviewDiffChars {
+		diff = diff[:maxReviewDiffChars] + "\n... (diff truncated)"
+	}
+	data := ReviewCodePromptData{
+		UserRequest: input.OriginalUserPrompt,
+		Step:        input.StepDescription,
+		Conventions: input.Conventions,
+		Diff:        diff,
+		Partial:     map[string]string{},
+	}
+	basePrompt, err := s.prompts.Render(PromptReviewCode, input.PromptOverrides, data)
+	if err != nil {
+		return nil, err
+	}
+	files, report := AllocateContext(reviewModel, CountTokens(reviewModel, basePrompt), reviewMaxTokens, input.RelevantFilesContent, input.FilePriority, input.StepDescription)
+	data.Files = files
+	for _, f := range report.Files {
+		if f.Strategy != ContextFull && f.Strategy != ContextOmitted {
+			data.Partial[f.Path] = f.Strategy
+		}
+	}
+	prompt, err := s.prompts.Render(PromptReviewCode, input.PromptOverrides, data)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.chat(
+		ctx, shared.LLMRoleReview,
+		openai.ChatCompletionRequest{
+			Model: reviewModel,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role:    openai.ChatMessageRoleSystem,
+					Content: "You are a careful senior code reviewer. You reply with JSON only.",
+				},
+				{
+					Role:    openai.ChatMessageRoleUser,
+					Content: prompt,
+				},
+			},
+			ResponseFormat: &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject},
+			MaxTokens:      reviewMaxTokens,
+			Temperature:    0.1,
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("openai review request failed: %w", err)
+	}
+	if len(resp.Choices) == 0 || resp.Choices[0].Message.Content == "" {
+		return nil, fmt.Errorf("openai returned empty review response")
+	}
+
+	result, err := parseReview(resp.Choices[0].Message.Content)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Review of step %q: approved=%t, %d finding(s)", input.StepDescription, result.Approved, len(result.Findings))
+	return result, nil
+}
+
+// parseReview converts the reviewer's JSON reply into a ReviewResult, normalizing
+// severities and deciding approval from the findings.
+func parseReview(content string) (*shared.ReviewResult, error) {
+	var parsed reviewResponse
+	if err := json.Unmarshal([]byte(strings.TrimSpace(content)), &parsed); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidReview, err)
+	}
+	result := &shared.ReviewResult{Approved: true, Summary: strings.TrimSpace(parsed.Summary)}
+	for _, f := range parsed.Findings {
+		message := strings.TrimSpace(f.Message)
+		if message == "" {
+			continue
+		}
+		severity := strings.ToLower(strings.TrimSpace(f.Severity))
+		switch severity {
+		case shared.ReviewSeverityHigh, shared.ReviewSeverityMedium:
+			result.Approved = false
+		case shared.ReviewSeverityLow:
+		default:
+			severity = shared.ReviewSeverityLow
+		}
+		line := f.Line
+		if line < 0 {
+			line = 0
+		}
+		result.Findings = append(result.Findings, shared.ReviewFinding{
+			Severity: severity,
+			File:     strings.TrimSpace(f.File),
+			Line:     line,
+			Message:  message,
+		})
+	}
+	if parsed.Approved != result.Approved {
+		log.Printf("Reviewer verdict (approved=%t) disagrees with its findings; using approved=%t", parsed.Approved, result.Approved)
+	}
+	return result, nil
+}
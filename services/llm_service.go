@@ -2,45 +2,91 @@ package services
 
 import (
 	"context"
-	_ "embed" // Import the embed package (blank identifier is convention)
+	"errors"
 	"fmt"
 	"log"
+	"regexp"
 	"strings"
+	"unicode/utf8"
 
 	openai "github.com/sashabaranov/go-openai" // Ensure correct import path
+
+	"hammer/shared"
 )
 
-//go:embed prompts/plan_steps.txt
-var planStepsPromptTemplate string
+// DefaultCommitMessagePattern matches a Conventional Commits subject line.
+const DefaultCommitMessagePattern = `^(feat|fix|docs|style|refactor|perf|test|build|ci|chore|revert)(\([\w./-]+\))?!?: \S.*$`
+
+// maxCommitSubjectChars limits the whole subject line, type and scope included,
+// whatever the pattern.
+const maxCommitSubjectChars = 72
+
+// ErrInvalidCommitMessage is returned when a generated commit message fails validation.
+var ErrInvalidCommitMessage = errors.New("generated commit message is invalid")
+
+// Prior diffs longer than this are truncated in follow-up planning prompts.
+const maxFollowUpDiffChars = 12000
 
-//go:embed prompts/evaluate_files.txt
-var evaluateFilesPromptTemplate string
+// Diffs longer than this are truncated before being sent for commit message generation.
+const maxCommitMessageDiffChars = 12000
 
-//go:embed prompts/generate_code.txt
-var generateCodePromptTemplate string
+// Model and completion budget for code generation; the prompt is fitted to the rest
+// of the model's context window.
+const (
+	codeGenerationModel     = openai.GPT4TurboPreview
+	codeGenerationMaxTokens = 3000
+)
 
 type LLMService struct {
-	client *openai.Client
+	client               *openai.Client
+	prompts              *PromptSet
+	commitMessagePattern *regexp.Regexp
+	prices               PriceTable
+	cache                *ResponseCache // Nil unless LLM_CACHE_DIR is set
 }
 
-func NewLLMService(apiKey string) *LLMService {
-	// You could potentially add validation here to ensure templates loaded correctly,
-	// though embed errors usually happen at compile time.
-	if planStepsPromptTemplate == "" || evaluateFilesPromptTemplate == "" || generateCodePromptTemplate == "" {
+func NewLLMService(apiKey string, prompts *PromptSet) *LLMService {
+	if prompts == nil {
 		log.Fatal("LLM prompt templates failed to load. Check embed directives and file paths.")
 	}
 	return &LLMService{
-		client: openai.NewClient(apiKey),
+		client:               openai.NewClient(apiKey),
+		prompts:              prompts,
+		commitMessagePattern: regexp.MustCompile(DefaultCommitMessagePattern),
+		prices:               DefaultPriceTable,
+	}
+}
+
+// SetCommitMessagePattern overrides the regex that generated commit subjects must match.
+func (s *LLMService) SetCommitMessagePattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid commit message pattern %q: %w", pattern, err)
 	}
+	s.commitMessagePattern = re
+	return nil
 }
 
-// PlanSteps breaks down the user prompt into actionable steps.
-func (s *LLMService) PlanSteps(ctx context.Context, userPrompt string) ([]string, error) {
-	// Use the embedded template string
-	prompt := fmt.Sprintf(planStepsPromptTemplate, userPrompt)
+// PlanSteps breaks down the user prompt into actionable steps. When followUp is set,
+// the previous run's prompt, plan and diff are included so the plan only covers
+// what still needs to change.
+func (s *LLMService) PlanSteps(ctx context.Context, userPrompt string, followUp *shared.FollowUpContext, conventions string, overrides shared.PromptOverrides) ([]string, error) {
+	if followUp != nil && len(followUp.PriorDiff) > maxFollowUpDiffChars {
+		truncated := *followUp
+		truncated.PriorDiff = truncateDiff(followUp.PriorDiff, maxFollowUpDiffChars)
+		followUp = &truncated
+	}
+	prompt, err := s.prompts.Render(PromptPlanSteps, overrides, PlanStepsPromptData{
+		UserRequest: userPrompt,
+		FollowUp:    followUp,
+		Conventions: conventions,
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	resp, err := s.client.CreateChatCompletion(
-		ctx,
+	resp, err := s.chat(
+		ctx, shared.LLMRolePlan,
 		openai.ChatCompletionRequest{
 			Model: openai.GPT4TurboPreview, // Or your preferred model
 			Messages: []openai.ChatCompletionMessage{
@@ -88,14 +134,21 @@ func (s *LLMService) PlanSteps(ctx context.Context, userPrompt string) ([]string
 	return steps, nil
 }
 
-// EvaluateRelevantFiles determines which files are needed for a given step.
-func (s *LLMService) EvaluateRelevantFiles(ctx context.Context, step string, allFiles []string) ([]string, error) {
-	fileList := strings.Join(allFiles, "\n")
-	// Use the embedded template string
-	prompt := fmt.Sprintf(evaluateFilesPromptTemplate, step, fileList)
+// EvaluateRelevantFiles determines which files are needed for a given step. Content
+// search hits, if any, are shown alongside the file list.
+func (s *LLMService) EvaluateRelevantFiles(ctx context.Context, step string, allFiles []string, searchHits []shared.SearchHit, priorChanges []shared.StepChange, overrides shared.PromptOverrides) ([]string, error) {
+	prompt, err := s.prompts.Render(PromptEvaluateFiles, overrides, EvaluateFilesPromptData{
+		Step:       step,
+		Files:      allFiles,
+		SearchHits: searchHits,
+		Changes:    priorChanges,
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	resp, err := s.client.CreateChatCompletion(
-		ctx,
+	resp, err := s.chat(
+		ctx, shared.LLMRoleEvaluate,
 		openai.ChatCompletionRequest{
 			Model: openai.GPT3Dot5Turbo,
 			Messages: []openai.ChatCompletionMessage{
@@ -146,25 +199,121 @@ func (s *LLMService) EvaluateRelevantFiles(ctx context.Context, step string, all
 	return cleanedFiles, nil
 }
 
-// GenerateCodeChanges generates the code modifications for a step.
-func (s *LLMService) GenerateCodeChanges(ctx context.Context, step string, relevantFilesContent map[string]string, userPrompt string) (map[string]string, error) {
-	contextStr := ""
-	if len(relevantFilesContent) > 0 {
-		contextStr += "Relevant File Contents:\n"
-		for path, content := range relevantFilesContent {
-			contextStr += fmt.Sprintf("--- File: %s ---\n%s\n\n", path, content)
+// SelectDirectories asks the model which directory groups are relevant to a step,
+// as the first stage of file selection for repositories too large to list in full.
+// Returns at most maxDirs known directory paths, most relevant first.
+func (s *LLMService) SelectDirectories(ctx context.Context, step string, dirs []shared.DirectorySummary, maxDirs int, overrides shared.PromptOverrides) ([]string, error) {
+	prompt, err := s.prompts.Render(PromptSelectDirs, overrides, SelectDirectoriesPromptData{
+		Step:           step,
+		Directories:    dirs,
+		MaxDirectories: maxDirs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.chat(
+		ctx, shared.LLMRoleSelectDirectories,
+		openai.ChatCompletionRequest{
+			Model: openai.GPT3Dot5Turbo,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role:    openai.ChatMessageRoleSystem,
+					Content: "You are a repository navigation assistant.",
+				},
+				{
+					Role:    openai.ChatMessageRoleUser,
+					Content: prompt,
+				},
+			},
+			MaxTokens:   200,
+			Temperature: 0.1,
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("openai directory selection request failed: %w", err)
+	}
+	if len(resp.Choices) == 0 || resp.Choices[0].Message.Content == "" {
+		return nil, fmt.Errorf("openai returned empty directory selection response")
+	}
+
+	content := strings.TrimSpace(resp.Choices[0].Message.Content)
+	log.Printf("LLM Directory Selection Raw Response: %s", content)
+	if content == "NONE" {
+		return []string{}, nil
+	}
+	known := make(map[string]struct{}, len(dirs))
+	for _, d := range dirs {
+		known[d.Path] = struct{}{}
+	}
+	var selected []string
+	seen := make(map[string]struct{})
+	for _, dir := range strings.Split(content, ",") {
+		trimmed := strings.TrimSuffix(strings.TrimSpace(dir), "/")
+		if trimmed == "" {
+			continue
+		}
+		if _, ok := known[trimmed]; !ok {
+			log.Printf("Warning: LLM suggested unknown directory '%s' for step '%s'", trimmed, step)
+			continue
+		}
+		if _, dup := seen[trimmed]; dup {
+			continue
+		}
+		seen[trimmed] = struct{}{}
+		selected = append(selected, trimmed)
+		if maxDirs > 0 && len(selected) == maxDirs {
+			break
 		}
-	} else {
-		contextStr = "No existing files were deemed relevant. You might be creating a new file."
 	}
+	log.Printf("Selected Directories: %v", selected)
+	return selected, nil
+}
 
-	// Use the embedded template string
-	prompt := fmt.Sprintf(generateCodePromptTemplate, userPrompt, step, contextStr)
+// GenerateCodeChanges generates the code modifications for a step. The relevant
+// files are fitted into the model's context window (see AllocateContext), most
+// important first per priority; files shown only partially are read-only. File
+// contents are delimited as untrusted, and lines that look like instructions to
+// the model are flagged in the prompt and the result. A non-nil revision asks
+// for a corrected attempt after a rejected review.
+func (s *LLMService) GenerateCodeChanges(ctx context.Context, step string, relevantFilesContent map[string]string, priority []string, userPrompt string, conventions string, priorChanges []shared.StepChange, revision *shared.RevisionRequest, overrides shared.PromptOverrides) (*shared.GenerateCodeActivityResult, error) {
+	if revision != nil && len(revision.Diff) > maxReviewDiffChars {
+		truncated := *revision
+		truncated.Diff = revision.Diff[:maxReviewDiffChars] + "\n... (diff truncated)"
+		revision = &truncated
+	}
+	data := GenerateCodePromptData{
+		UserRequest: userPrompt,
+		Step:        step,
+		Conventions: conventions,
+		Changes:     priorChanges,
+		Revision:    revision,
+	}
+	basePrompt, err := s.prompts.Render(PromptGenerateCode, overrides, data)
+	if err != nil {
+		return nil, err
+	}
+	files, report := AllocateContext(codeGenerationModel, CountTokens(codeGenerationModel, basePrompt), codeGenerationMaxTokens, relevantFilesContent, priority, step)
+	data.Files = files
+	data.Partial = make(map[string]string)
+	for _, f := range report.Files {
+		if f.Strategy != ContextFull && f.Strategy != ContextOmitted {
+			data.Partial[f.Path] = f.Strategy
+		}
+	}
+	data.Injections = DetectInjections(files)
+	for _, f := range data.Injections {
+		log.Printf("Warning: possible prompt injection in %s:%d (%s): %s", f.File, f.Line, f.Rule, f.Excerpt)
+	}
+	prompt, err := s.prompts.Render(PromptGenerateCode, overrides, data)
+	if err != nil {
+		return nil, err
+	}
 
-	resp, err := s.client.CreateChatCompletion(
-		ctx,
+	resp, err := s.chat(
+		ctx, shared.LLMRoleGenerate,
 		openai.ChatCompletionRequest{
-			Model: openai.GPT4TurboPreview,
+			Model: codeGenerationModel,
 			Messages: []openai.ChatCompletionMessage{
 				{
 					Role:    openai.ChatMessageRoleSystem,
@@ -175,7 +324,7 @@ func (s *LLMService) GenerateCodeChanges(ctx context.Context, step string, relev
 					Content: prompt,
 				},
 			},
-			MaxTokens:   3000,
+			MaxTokens:   codeGenerationMaxTokens,
 			Temperature: 0.3,
 		},
 	)
@@ -225,6 +374,12 @@ func (s *LLMService) GenerateCodeChanges(ctx context.Context, step string, relev
 				content = strings.TrimPrefix(contentBlock, "```")
 			}
 		}
+		if _, partial := data.Partial[filePath]; partial || ContainsOmissionMarker(content) {
+			// Writing back a partial view would delete the omitted lines.
+			log.Printf("Warning: Dropping generated content for '%s': the file was only shown partially", filePath)
+			continue
+		}
+		content = stripUntrustedMarkers(content)
 		if filePath != "" {
 			changes[filePath] = content
 			log.Printf("Parsed change for file: %s", filePath)
@@ -237,5 +392,144 @@ func (s *LLMService) GenerateCodeChanges(ctx context.Context, step string, relev
 	} else if len(changes) == 0 {
 		log.Println("LLM did not generate any file changes for this step.")
 	}
-	return changes, nil
+	return &shared.GenerateCodeActivityResult{GeneratedFiles: changes, Context: report, Injections: data.Injections}, nil
+}
+
+// GenerateCommitMessage writes a Conventional Commits message (subject plus body)
+// describing the given diff. The subject line is validated against the configured
+// pattern; an error is returned if it does not match so callers can fall back.
+func (s *LLMService) GenerateCommitMessage(ctx context.Context, step string, diff string, userPrompt string, overrides shared.PromptOverrides) (string, error) {
+	diff = truncateDiff(diff, maxCommitMessageDiffChars)
+	prompt, err := s.prompts.Render(PromptCommitMessage, overrides, CommitMessagePromptData{
+		UserRequest: userPrompt,
+		Step:        step,
+		Diff:        diff,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.chat(
+		ctx, shared.LLMRoleCommitMessage,
+		openai.ChatCompletionRequest{
+			Model: openai.GPT3Dot5Turbo,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role:    openai.ChatMessageRoleSystem,
+					Content: "You are an assistant that writes clear, conventional git commit messages.",
+				},
+				{
+					Role:    openai.ChatMessageRoleUser,
+					Content: prompt,
+				},
+			},
+			MaxTokens:   300,
+			Temperature: 0.2,
+		},
+	)
+
+	if err != nil {
+		return "", fmt.Errorf("openai commit message request failed: %w", err)
+	}
+
+	if len(resp.Choices) == 0 || resp.Choices[0].Message.Content == "" {
+		return "", fmt.Errorf("openai returned empty commit message response")
+	}
+
+	message := strings.TrimSpace(resp.Choices[0].Message.Content)
+	message = strings.TrimSpace(strings.Trim(message, "`"))
+	subject, _, _ := strings.Cut(message, "\n")
+	subject = strings.TrimSpace(subject)
+	if !s.commitMessagePattern.MatchString(subject) {
+		return "", fmt.Errorf("%w: subject %q does not match pattern %q", ErrInvalidCommitMessage, subject, s.commitMessagePattern.String())
+	}
+	if n := utf8.RuneCountInString(subject); n > maxCommitSubjectChars {
+		return "", fmt.Errorf("%w: subject %q is %d characters long, the limit is %d", ErrInvalidCommitMessage, subject, n, maxCommitSubjectChars)
+	}
+	log.Printf("Generated Commit Message: %s", subject)
+	return message, nil
+}
+
+// truncateDiff shortens a diff longer than max bytes. It cuts after the last
+// complete line that fits, or at a character boundary if there is none, and marks
+// the cut.
+func truncateDiff(diff string, max int) string {
+	if len(diff) <= max {
+		return diff
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(diff[cut]) {
+		cut--
+	}
+	if i := strings.LastIndexByte(diff[:cut], '\n'); i >= 0 {
+		cut = i
+	}
+	return diff[:cut] + "\n... (diff truncated)"
+}
+
+// ResolveConflict asks the model to merge the branch and upstream versions of a file.
+func (s *LLMService) ResolveConflict(ctx context.Context, file shared.ConflictFile, userPrompt string, overrides shared.PromptOverrides) (string, error) {
+	side := func(content string, exists bool) string {
+		if !exists {
+			return "(file does not exist)"
+		}
+		return content
+	}
+	prompt, err := s.prompts.Render(PromptResolveConflict, overrides, ResolveConflictPromptData{
+		UserRequest: userPrompt,
+		Path:        file.Path,
+		Base:        side(file.Base, file.BaseExists),
+		Ours:        side(file.Ours, file.OursExists),
+		Theirs:      side(file.Theirs, file.TheirsExists),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.chat(
+		ctx, shared.LLMRoleResolveConflict,
+		openai.ChatCompletionRequest{
+			Model: openai.GPT4TurboPreview,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role:    openai.ChatMessageRoleSystem,
+					Content: "You are an expert at resolving git merge conflicts.",
+				},
+				{
+					Role:    openai.ChatMessageRoleUser,
+					Content: prompt,
+				},
+			},
+			MaxTokens:   3000,
+			Temperature: 0.1,
+		},
+	)
+
+	if err != nil {
+		return "", fmt.Errorf("openai conflict resolution request failed: %w", err)
+	}
+
+	if len(resp.Choices) == 0 || resp.Choices[0].Message.Content == "" {
+		return "", fmt.Errorf("openai returned empty conflict resolution response")
+	}
+
+	merged := stripUntrustedMarkers(stripCodeFence(strings.TrimSpace(resp.Choices[0].Message.Content)))
+	if strings.Contains(merged, "<<<<<<<") || strings.Contains(merged, ">>>>>>>") {
+		return "", fmt.Errorf("resolution for '%s' still contains conflict markers", file.Path)
+	}
+	log.Printf("Resolved conflict in %s", file.Path)
+	return merged, nil
+}
+
+// stripCodeFence removes a surrounding ``` block (with optional language tag) if present.
+func stripCodeFence(content string) string {
+	if !strings.HasPrefix(content, "```") {
+		return content
+	}
+	contentEnd := strings.LastIndex(content, "```")
+	firstNewline := strings.Index(content, "\n")
+	if contentEnd <= 0 || firstNewline < 0 || firstNewline >= contentEnd {
+		return strings.TrimPrefix(content, "```")
+	}
+	return content[firstNewline+1 : contentEnd]
 }
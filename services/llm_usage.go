@@ -0,0 +1,169 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+
+	"hammer/shared"
+)
+
+// ModelPrice is the USD price of a model per million tokens.
+type ModelPrice struct {
+	Input  float64
+	Output float64
+}
+
+// PriceTable maps model names to their prices.
+type PriceTable map[string]ModelPrice
+
+// DefaultPriceTable holds list prices for the models Hammer uses.
+var DefaultPriceTable = PriceTable{
+	openai.GPT4TurboPreview: {Input: 10, Output: 30},
+	openai.GPT3Dot5Turbo:    {Input: 0.5, Output: 1.5},
+}
+
+// LoadPriceTableFromEnv returns DefaultPriceTable with the entries of LLM_PRICES
+// added or replaced. LLM_PRICES is a comma-separated list of
+// model=input:output, in USD per million tokens.
+func LoadPriceTableFromEnv() (PriceTable, error) {
+	prices := make(PriceTable, len(DefaultPriceTable))
+	for model, price := range DefaultPriceTable {
+		prices[model] = price
+	}
+	for _, entry := range strings.Split(os.Getenv("LLM_PRICES"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		model, rates, ok := strings.Cut(entry, "=")
+		input, output, ok2 := strings.Cut(rates, ":")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("LLM_PRICES entry %q must look like model=input:output", entry)
+		}
+		in, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+		if err != nil || in < 0 {
+			return nil, fmt.Errorf("LLM_PRICES entry %q: invalid input price", entry)
+		}
+		out, err := strconv.ParseFloat(strings.TrimSpace(output), 64)
+		if err != nil || out < 0 {
+			return nil, fmt.Errorf("LLM_PRICES entry %q: invalid output price", entry)
+		}
+		prices[strings.TrimSpace(model)] = ModelPrice{Input: in, Output: out}
+	}
+	return prices, nil
+}
+
+// Cost returns the USD cost of a call, and false if the model has no price.
+func (p PriceTable) Cost(model string, promptTokens, completionTokens int) (float64, bool) {
+	price, ok := p[model]
+	if !ok {
+		return 0, false
+	}
+	return (float64(promptTokens)*price.Input + float64(completionTokens)*price.Output) / 1e6, true
+}
+
+// UsageRecorder collects the usage of the LLM calls made with a context from
+// TrackUsage.
+type UsageRecorder struct {
+	mu        sync.Mutex
+	calls     []shared.LLMUsage
+	cache     *ResponseCache
+	cacheKeys []string // Cache entries the calls read or wrote
+}
+
+type usageRecorderKey struct{}
+
+// TrackUsage returns a context whose LLM calls are recorded in the returned recorder.
+func TrackUsage(ctx context.Context) (context.Context, *UsageRecorder) {
+	r := &UsageRecorder{}
+	return context.WithValue(ctx, usageRecorderKey{}, r), r
+}
+
+// Calls returns the calls recorded so far.
+func (r *UsageRecorder) Calls() []shared.LLMUsage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]shared.LLMUsage(nil), r.calls...)
+}
+
+// DiscardCached removes the cached responses the recorded calls used, so that a
+// retry after a reply that could not be used asks the model again.
+func (r *UsageRecorder) DiscardCached() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range r.cacheKeys {
+		r.cache.Delete(key)
+	}
+	r.cacheKeys = nil
+}
+
+func (r *UsageRecorder) add(u shared.LLMUsage, cache *ResponseCache, cacheKey string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, u)
+	if cacheKey != "" {
+		r.cache = cache
+		r.cacheKeys = append(r.cacheKeys, cacheKey)
+	}
+}
+
+// SetPriceTable sets the prices used to cost LLM calls.
+func (s *LLMService) SetPriceTable(prices PriceTable) {
+	s.prices = prices
+}
+
+// chat sends a chat completion request and records its tokens, latency and cost
+// with the context's UsageRecorder, if any. Roles enabled in the response cache
+// are answered from it when the same request was made before; such calls are
+// recorded as cached, with no tokens or cost.
+func (s *LLMService) chat(ctx context.Context, role string, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	start := time.Now()
+	recorder, _ := ctx.Value(usageRecorderKey{}).(*UsageRecorder)
+	var cacheKey string
+	if s.cache.Enabled(role) {
+		key, err := s.cache.Key(req)
+		if err != nil {
+			log.Printf("Warning: not caching LLM %s call: %v", role, err)
+		} else if resp, ok := s.cache.Get(key); ok {
+			usage := shared.LLMUsage{Role: role, Model: req.Model, LatencyMs: time.Since(start).Milliseconds(), Cached: true}
+			log.Printf("LLM %s call: %s, served from cache", role, req.Model)
+			if recorder != nil {
+				recorder.add(usage, s.cache, key)
+			}
+			return resp, nil
+		} else {
+			cacheKey = key
+		}
+	}
+	resp, err := s.client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	if cacheKey != "" {
+		s.cache.Put(cacheKey, role, resp)
+	}
+	usage := shared.LLMUsage{
+		Role:             role,
+		Model:            req.Model,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+		LatencyMs:        time.Since(start).Milliseconds(),
+	}
+	cost, priced := s.prices.Cost(req.Model, usage.PromptTokens, usage.CompletionTokens)
+	if !priced {
+		log.Printf("Warning: no price for model %s; add it to LLM_PRICES to count its cost", req.Model)
+	}
+	usage.CostUSD = cost
+	log.Printf("LLM %s call: %s, %d prompt + %d completion tokens, %dms, $%.4f", role, req.Model, usage.PromptTokens, usage.CompletionTokens, usage.LatencyMs, cost)
+	if recorder != nil {
+		recorder.add(usage, s.cache, cacheKey)
+	}
+	return resp, nil
+}
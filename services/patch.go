@@ -0,0 +1,139 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrPatchDoesNotApply is returned when a hunk's context cannot be found in the file.
+var ErrPatchDoesNotApply = errors.New("patch does not apply")
+
+var hunkHeaderPattern = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// patchHunk is one "@@" section of a unified diff.
+type patchHunk struct {
+	oldStart int      // 1-based line number from the header (0 for empty files)
+	oldLines []string // Context and removed lines, in order
+	newLines []string // Context and added lines, in order
+}
+
+// ApplyUnifiedPatch applies a single-file unified diff to content. File headers
+// ("---", "+++", "diff --git") are ignored. Each hunk is matched at the line given
+// in its header or, failing that, at the nearest position where its context and
+// removed lines match exactly.
+func ApplyUnifiedPatch(content, patch string) (string, error) {
+	hunks, err := parseHunks(patch)
+	if err != nil {
+		return "", err
+	}
+	if len(hunks) == 0 {
+		return "", fmt.Errorf("%w: no hunks found", ErrPatchDoesNotApply)
+	}
+
+	trailingNewline := content == "" || strings.HasSuffix(content, "\n")
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if content == "" {
+		lines = nil
+	}
+
+	offset := 0 // Lines added minus removed by earlier hunks
+	searchFrom := 0
+	for i, h := range hunks {
+		want := h.oldStart - 1 + offset
+		if h.oldStart == 0 {
+			want = 0
+		}
+		pos := findHunk(lines, h.oldLines, want, searchFrom)
+		if pos < 0 {
+			return "", fmt.Errorf("%w: hunk %d (at line %d) does not match the file", ErrPatchDoesNotApply, i+1, h.oldStart)
+		}
+		updated := make([]string, 0, len(lines)-len(h.oldLines)+len(h.newLines))
+		updated = append(updated, lines[:pos]...)
+		updated = append(updated, h.newLines...)
+		updated = append(updated, lines[pos+len(h.oldLines):]...)
+		lines = updated
+		offset += len(h.newLines) - len(h.oldLines)
+		searchFrom = pos + len(h.newLines)
+	}
+
+	result := strings.Join(lines, "\n")
+	if trailingNewline && len(lines) > 0 {
+		result += "\n"
+	}
+	return result, nil
+}
+
+func parseHunks(patch string) ([]patchHunk, error) {
+	var hunks []patchHunk
+	var current *patchHunk
+	patchLines := strings.Split(strings.TrimRight(strings.ReplaceAll(patch, "\r\n", "\n"), "\n"), "\n")
+	for i, line := range patchLines {
+		if m := hunkHeaderPattern.FindStringSubmatch(line); m != nil {
+			start, _ := strconv.Atoi(m[1])
+			hunks = append(hunks, patchHunk{oldStart: start})
+			current = &hunks[len(hunks)-1]
+			continue
+		}
+		if current == nil {
+			continue // File headers before the first hunk
+		}
+		switch {
+		case strings.HasPrefix(line, "--- ") && i+1 < len(patchLines) && strings.HasPrefix(patchLines[i+1], "+++ "),
+			strings.HasPrefix(line, "diff --git "):
+			// Another file's headers. Its hunks must not be applied to this file.
+			return nil, fmt.Errorf("%w: the patch changes more than one file; send one patch per file", ErrPatchDoesNotApply)
+		case strings.HasPrefix(line, `\`):
+			// "\ No newline at end of file"
+		case strings.HasPrefix(line, "+"):
+			current.newLines = append(current.newLines, line[1:])
+		case strings.HasPrefix(line, "-"):
+			current.oldLines = append(current.oldLines, line[1:])
+		case strings.HasPrefix(line, " "):
+			current.oldLines = append(current.oldLines, line[1:])
+			current.newLines = append(current.newLines, line[1:])
+		case line == "":
+			// Blank context lines often lose their leading space in model output.
+			current.oldLines = append(current.oldLines, "")
+			current.newLines = append(current.newLines, "")
+		default:
+			return nil, fmt.Errorf("%w: unexpected line in hunk: %q", ErrPatchDoesNotApply, line)
+		}
+	}
+	return hunks, nil
+}
+
+// findHunk returns the start index where old matches lines, preferring the
+// position closest to want and never before minPos. Returns -1 if there is none.
+func findHunk(lines, old []string, want, minPos int) int {
+	maxPos := len(lines) - len(old)
+	if maxPos < minPos {
+		return -1
+	}
+	if want < minPos {
+		want = minPos
+	}
+	if want > maxPos {
+		want = maxPos
+	}
+	for delta := 0; want-delta >= minPos || want+delta <= maxPos; delta++ {
+		if p := want - delta; p >= minPos && linesMatch(lines[p:p+len(old)], old) {
+			return p
+		}
+		if p := want + delta; delta > 0 && p <= maxPos && linesMatch(lines[p:p+len(old)], old) {
+			return p
+		}
+	}
+	return -1
+}
+
+func linesMatch(a, b []string) bool {
+	for i := range b {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestApplyUnifiedPatch(t *testing.T) {
+	const file = "a\nb\nc\nd\ne\nf\n"
+	tests := []struct {
+		name    string
+		content string
+		patch   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "replace line",
+			content: file,
+			patch:   "--- a/x.txt\n+++ b/x.txt\n@@ -2,3 +2,3 @@\n b\n-c\n+C\n d\n",
+			want:    "a\nb\nC\nd\ne\nf\n",
+		},
+		{
+			name:    "wrong line number in header",
+			content: file,
+			patch:   "@@ -1,3 +1,3 @@\n d\n-e\n+E\n f\n",
+			want:    "a\nb\nc\nd\nE\nf\n",
+		},
+		{
+			name:    "two hunks shift later lines",
+			content: file,
+			patch:   "@@ -1,2 +1,3 @@\n a\n+a2\n b\n@@ -5,2 +6,2 @@\n e\n-f\n+F\n",
+			want:    "a\na2\nb\nc\nd\ne\nF\n",
+		},
+		{
+			name:    "create file",
+			content: "",
+			patch:   "--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1,2 @@\n+one\n+two\n",
+			want:    "one\ntwo\n",
+		},
+		{
+			name:    "no trailing newline is kept",
+			content: "a\nb",
+			patch:   "@@ -1,2 +1,2 @@\n a\n-b\n+B\n\\ No newline at end of file\n",
+			want:    "a\nB",
+		},
+		{
+			name:    "CRLF patch and blank context without space",
+			content: "x\n\ny\n",
+			patch:   "@@ -1,3 +1,3 @@\r\n x\r\n\r\n-y\r\n+Y\r\n",
+			want:    "x\n\nY\n",
+		},
+		{
+			name:    "delete everything",
+			content: "a\nb\n",
+			patch:   "@@ -1,2 +0,0 @@\n-a\n-b\n",
+			want:    "",
+		},
+		{
+			name:    "context does not match",
+			content: file,
+			patch:   "@@ -2,3 +2,3 @@\n b\n-x\n+y\n d\n",
+			wantErr: true,
+		},
+		{
+			name:    "no hunks",
+			content: file,
+			patch:   "--- a/x.txt\n+++ b/x.txt\n",
+			wantErr: true,
+		},
+		{
+			name:    "garbage in hunk",
+			content: file,
+			patch:   "@@ -1,1 +1,1 @@\n*a\n",
+			wantErr: true,
+		},
+		{
+			name:    "hunks out of order",
+			content: file,
+			patch:   "@@ -5,1 +5,1 @@\n-e\n+E\n@@ -1,1 +1,1 @@\n-a\n+A\n",
+			wantErr: true,
+		},
+		{
+			name:    "second file",
+			content: file,
+			patch:   "@@ -1,1 +1,1 @@\n-a\n+A\ndiff --git a/y b/y\n--- a/y\n+++ b/y\n@@ -1,1 +1,1 @@\n-a\n+A\n",
+			wantErr: true,
+		},
+		{
+			name:    "second file without git header",
+			content: file,
+			patch:   "--- a/x\n+++ b/x\n@@ -1,1 +1,1 @@\n-a\n+A\n--- a/y\n+++ b/y\n@@ -1,1 +1,1 @@\n-b\n+B\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyUnifiedPatch(tt.content, tt.patch)
+			if tt.wantErr {
+				if !errors.Is(err, ErrPatchDoesNotApply) {
+					t.Fatalf("ApplyUnifiedPatch() = %q, %v; want ErrPatchDoesNotApply", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyUnifiedPatch() error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ApplyUnifiedPatch() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"hammer/shared"
+)
+
+// Markers around repository content in prompts. The model is told that text
+// between them is data, never instructions.
+const (
+	untrustedBegin = "<<<BEGIN UNTRUSTED"
+	untrustedEnd   = "<<<END UNTRUSTED"
+)
+
+// maxInjectionFindingsPerFile caps the findings reported for one file.
+const maxInjectionFindingsPerFile = 5
+
+// UntrustedBlock delimits repository content for a prompt. Markers inside the
+// content are defused so a file cannot close its own block early.
+func UntrustedBlock(label, content string) string {
+	content = strings.ReplaceAll(content, untrustedBegin, "<<< BEGIN (defused) UNTRUSTED")
+	content = strings.ReplaceAll(content, untrustedEnd, "<<< END (defused) UNTRUSTED")
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return fmt.Sprintf("%s %s>>>\n%s%s %s>>>", untrustedBegin, label, content, untrustedEnd, label)
+}
+
+// stripUntrustedMarkers removes marker lines a model copied from its prompt
+// into generated content.
+func stripUntrustedMarkers(content string) string {
+	if !strings.Contains(content, untrustedBegin) && !strings.Contains(content, untrustedEnd) {
+		return content
+	}
+	lines := strings.Split(content, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if (strings.HasPrefix(trimmed, untrustedBegin) || strings.HasPrefix(trimmed, untrustedEnd)) && strings.HasSuffix(trimmed, ">>>") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\n")
+}
+
+type injectionRule struct {
+	id      string
+	pattern *regexp.Regexp
+}
+
+// injectionRules flag text addressed to a model rather than to the code's readers.
+var injectionRules = []injectionRule{
+	{id: "ignore-instructions", pattern: regexp.MustCompile(`(?i)\b(?:ignore|disregard|forget|override)\b[^\n]{0,30}\b(?:previous|prior|above|earlier|all|any|system)\b[^\n]{0,20}\b(?:instructions?|prompts?|rules|directions)\b`)},
+	{id: "role-override", pattern: regexp.MustCompile(`(?i)\byou are (?:now|no longer)\b|\bnew (?:system )?instructions\s*:|\bfrom now on,? you\b`)},
+	{id: "addressed-to-model", pattern: regexp.MustCompile(`(?i)\b(?:note|message|instructions?)\s+(?:to|for)\s+(?:the\s+|any\s+)?(?:ai|llm|language model|assistant|code generator|model|agent)s?\b`)},
+	{id: "reveal-prompt", pattern: regexp.MustCompile(`(?i)\b(?:reveal|print|output|repeat|leak)\b[^\n]{0,30}\b(?:system prompt|your instructions|hidden instructions)\b`)},
+	{id: "exfiltration", pattern: regexp.MustCompile(`(?i)\b(?:send|post|upload|exfiltrate|leak|transmit)\b[^\n]{0,60}\b(?:secrets?|credentials?|tokens?|api[ _-]?keys?|passwords?|env(?:ironment)? variables)\b[^\n]{0,60}https?://`)},
+	{id: "chat-markup", pattern: regexp.MustCompile(`<\|im_(?:start|end)\|>|<\|(?:system|assistant)\|>|\[/?INST\]|<</?SYS>>`)},
+	{id: "bidi-control", pattern: regexp.MustCompile(`[\x{202A}-\x{202E}\x{2066}-\x{2069}]`)},
+}
+
+// DetectInjection reports lines of a repository file that look like attempts to
+// instruct the model. Findings are advisory: the content is still shown to the
+// model, inside untrusted markers.
+func DetectInjection(filePath, content string) []shared.InjectionFinding {
+	if strings.IndexByte(content, 0) >= 0 {
+		return nil // Binary content
+	}
+	var findings []shared.InjectionFinding
+	for i, line := range strings.Split(content, "\n") {
+		for _, rule := range injectionRules {
+			if !rule.pattern.MatchString(line) {
+				continue
+			}
+			findings = append(findings, shared.InjectionFinding{
+				File:    filePath,
+				Line:    i + 1,
+				Rule:    rule.id,
+				Excerpt: injectionExcerpt(line),
+			})
+			break // One finding per line is enough
+		}
+		if len(findings) == maxInjectionFindingsPerFile {
+			break
+		}
+	}
+	return findings
+}
+
+// DetectInjections runs DetectInjection over files in path order.
+func DetectInjections(files map[string]string) []shared.InjectionFinding {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var findings []shared.InjectionFinding
+	for _, p := range paths {
+		findings = append(findings, DetectInjection(p, files[p])...)
+	}
+	return findings
+}
+
+func injectionExcerpt(line string) string {
+	const maxExcerpt = 120
+	line = strings.Map(func(r rune) rune {
+		if r >= 0x202A && r <= 0x202E || r >= 0x2066 && r <= 0x2069 {
+			return '?'
+		}
+		return r
+	}, strings.TrimSpace(line))
+	if runes := []rune(line); len(runes) > maxExcerpt {
+		line = string(runes[:maxExcerpt]) + "..."
+	}
+	return line
+}
+
+// CheckChangeScope flags generated changes the step had no reason to make. An
+// existing file is in scope if it was selected for the step; a new file if it
+// sits next to a selected file. Either is also in scope when the request, the
+// plan or the step mentions its path or file name. existing is the repository's
+// file list before the step.
+func CheckChangeScope(changed, selected, existing []string, userPrompt, step string, plan []string) []shared.ScopeFinding {
+	selectedSet := make(map[string]bool, len(selected))
+	selectedDirs := make(map[string]bool, len(selected))
+	for _, f := range selected {
+		f = strings.TrimPrefix(path.Clean(f), "./")
+		selectedSet[f] = true
+		selectedDirs[path.Dir(f)] = true
+	}
+	existingSet := make(map[string]bool, len(existing))
+	for _, f := range existing {
+		existingSet[f] = true
+	}
+	planText := strings.ToLower(userPrompt + "\n" + step + "\n" + strings.Join(plan, "\n"))
+
+	sorted := append([]string(nil), changed...)
+	sort.Strings(sorted)
+	var findings []shared.ScopeFinding
+	for _, f := range sorted {
+		clean := strings.TrimPrefix(path.Clean(f), "./")
+		if selectedSet[clean] || mentionsPath(planText, clean) {
+			continue
+		}
+		switch {
+		case existingSet[clean]:
+			findings = append(findings, shared.ScopeFinding{File: clean, Reason: "modifies a file that was not selected for the step and is not mentioned in the plan"})
+		case !selectedDirs[path.Dir(clean)]:
+			findings = append(findings, shared.ScopeFinding{File: clean, Reason: "creates a file outside the selected files' directories that is not mentioned in the plan"})
+		}
+	}
+	return findings
+}
+
+// mentionsPath reports whether text (already lower-cased) names the file by
+// path or, for names with an extension, by file name.
+func mentionsPath(text, filePath string) bool {
+	lower := strings.ToLower(filePath)
+	if strings.Contains(text, lower) {
+		return true
+	}
+	base := path.Base(lower)
+	return strings.Contains(base, ".") && strings.Contains(text, base)
+}
@@ -0,0 +1,284 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// quotaWindow is the period the daily limits count starts over.
+const quotaWindow = 24 * time.Hour
+
+// ErrQuotaExceeded is returned when a submission is over a daily limit or the
+// queue is full.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaLimits caps runs per user and per repository. Zero means unlimited.
+type QuotaLimits struct {
+	UserConcurrent int // Runs a user may have running at once
+	UserDaily      int // Runs a user may start per 24 hours
+	RepoConcurrent int
+	RepoDaily      int
+	MaxQueued      int // Submissions a user may have waiting for capacity
+}
+
+// LoadQuotaLimitsFromEnv reads QUOTA_USER_CONCURRENT, QUOTA_USER_DAILY,
+// QUOTA_REPO_CONCURRENT, QUOTA_REPO_DAILY and QUOTA_MAX_QUEUED.
+func LoadQuotaLimitsFromEnv() (QuotaLimits, error) {
+	limits := QuotaLimits{MaxQueued: 10}
+	for name, field := range map[string]*int{
+		"QUOTA_USER_CONCURRENT": &limits.UserConcurrent,
+		"QUOTA_USER_DAILY":      &limits.UserDaily,
+		"QUOTA_REPO_CONCURRENT": &limits.RepoConcurrent,
+		"QUOTA_REPO_DAILY":      &limits.RepoDaily,
+		"QUOTA_MAX_QUEUED":      &limits.MaxQueued,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return QuotaLimits{}, fmt.Errorf("%s must be a non-negative integer, got %q", name, value)
+		}
+		*field = n
+	}
+	return limits, nil
+}
+
+// StartRunFunc starts a run and returns its workflow ID and a function that
+// blocks until the run has ended.
+type StartRunFunc func() (workflowID string, wait func(), err error)
+
+// QueueTicket tracks a submission that is waiting for capacity.
+type QueueTicket struct {
+	ID         string
+	User       string
+	Repo       string
+	Position   int    // 1-based place in the queue; 0 once it left the queue
+	WorkflowID string // Set once the run started
+	Err        error  // Set if starting the run failed
+	QueuedAt   time.Time
+	start      StartRunFunc
+}
+
+// QuotaService enforces QuotaLimits for the runs started through it. Counts live
+// in memory, so they start from zero when the process restarts.
+type QuotaService struct {
+	limits  QuotaLimits
+	now     func() time.Time
+	mu      sync.Mutex
+	running map[string]int         // "user:<id>" or "repo:<url>" -> runs in progress
+	starts  map[string][]time.Time // Same keys -> start times within quotaWindow
+	queue   []*QueueTicket         // Waiting submissions, oldest first
+	tickets map[string]*QueueTicket
+	nextID  int
+}
+
+func NewQuotaService(limits QuotaLimits) *QuotaService {
+	return &QuotaService{
+		limits:  limits,
+		now:     time.Now,
+		running: make(map[string]int),
+		starts:  make(map[string][]time.Time),
+		tickets: make(map[string]*QueueTicket),
+	}
+}
+
+// Submit starts the run now if the user and repository have capacity, or queues
+// it until a run of theirs ends. A nil ticket means the run started; its ID is
+// returned. Submissions over a daily limit, or beyond the user's queue limit,
+// fail with an error wrapping ErrQuotaExceeded.
+func (q *QuotaService) Submit(user, repo string, start StartRunFunc) (string, *QueueTicket, error) {
+	q.mu.Lock()
+	userKey, repoKey := "user:"+user, "repo:"+repo
+	queuedUser, queuedRepo := 0, 0
+	for _, t := range q.queue {
+		if t.User == user {
+			queuedUser++
+		}
+		if t.Repo == repo {
+			queuedRepo++
+		}
+	}
+	if reason := q.dailyExceeded(userKey, q.limits.UserDaily, queuedUser); reason != "" {
+		q.mu.Unlock()
+		return "", nil, fmt.Errorf("%w: you have %s", ErrQuotaExceeded, reason)
+	}
+	if reason := q.dailyExceeded(repoKey, q.limits.RepoDaily, queuedRepo); reason != "" {
+		q.mu.Unlock()
+		return "", nil, fmt.Errorf("%w: this repository has %s", ErrQuotaExceeded, reason)
+	}
+
+	// Don't overtake queued submissions that wait for the same slot.
+	overtakes := (q.limits.UserConcurrent > 0 && queuedUser > 0) || (q.limits.RepoConcurrent > 0 && queuedRepo > 0)
+	if q.hasCapacity(user, repo) && !overtakes {
+		q.reserve(user, repo)
+		q.mu.Unlock()
+		workflowID, err := q.launch(user, repo, start)
+		return workflowID, nil, err
+	}
+
+	if q.limits.MaxQueued > 0 && queuedUser >= q.limits.MaxQueued {
+		q.mu.Unlock()
+		return "", nil, fmt.Errorf("%w: you already have %d submission(s) waiting for a free slot", ErrQuotaExceeded, queuedUser)
+	}
+	q.pruneTickets()
+	q.nextID++
+	ticket := &QueueTicket{
+		ID:       fmt.Sprintf("queued-%d-%d", q.now().Unix(), q.nextID),
+		User:     user,
+		Repo:     repo,
+		QueuedAt: q.now(),
+		start:    start,
+	}
+	q.queue = append(q.queue, ticket)
+	q.tickets[ticket.ID] = ticket
+	q.renumber()
+	log.Printf("Quota: queued %s for user %q (position %d)", ticket.ID, user, ticket.Position)
+	q.mu.Unlock()
+	return "", ticket, nil
+}
+
+// Ticket returns a copy of a queued submission's state.
+func (q *QuotaService) Ticket(id string) (QueueTicket, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t, ok := q.tickets[id]
+	if !ok {
+		return QueueTicket{}, false
+	}
+	return *t, true
+}
+
+// dailyExceeded describes the exceeded daily limit for key, counting queued
+// submissions, or returns "" if there is room. Must hold q.mu.
+func (q *QuotaService) dailyExceeded(key string, limit, queued int) string {
+	if limit == 0 {
+		return ""
+	}
+	cutoff := q.now().Add(-quotaWindow)
+	recent := q.starts[key][:0]
+	for _, t := range q.starts[key] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	q.starts[key] = recent
+	if len(recent)+queued < limit {
+		return ""
+	}
+	return fmt.Sprintf("reached the limit of %d runs per 24 hours; the next slot frees up at %s", limit, q.nextDailySlot(recent).Format(time.RFC3339))
+}
+
+func (q *QuotaService) nextDailySlot(recent []time.Time) time.Time {
+	if len(recent) == 0 {
+		return q.now()
+	}
+	return recent[0].Add(quotaWindow)
+}
+
+// hasCapacity reports whether another run may start for user and repo. Must hold q.mu.
+func (q *QuotaService) hasCapacity(user, repo string) bool {
+	if q.limits.UserConcurrent > 0 && q.running["user:"+user] >= q.limits.UserConcurrent {
+		return false
+	}
+	if q.limits.RepoConcurrent > 0 && q.running["repo:"+repo] >= q.limits.RepoConcurrent {
+		return false
+	}
+	return true
+}
+
+// reserve counts a run as started. Must hold q.mu.
+func (q *QuotaService) reserve(user, repo string) {
+	now := q.now()
+	for _, key := range []string{"user:" + user, "repo:" + repo} {
+		q.running[key]++
+		q.starts[key] = append(q.starts[key], now)
+	}
+}
+
+// launch starts a reserved run and releases its slot when it ends. A run that
+// fails to start gives its slot back.
+func (q *QuotaService) launch(user, repo string, start StartRunFunc) (string, error) {
+	workflowID, wait, err := start()
+	if err != nil {
+		q.mu.Lock()
+		q.running["user:"+user]--
+		q.running["repo:"+repo]--
+		q.unstart("user:" + user)
+		q.unstart("repo:" + repo)
+		q.dispatch()
+		q.mu.Unlock()
+		return "", err
+	}
+	go func() {
+		wait()
+		q.release(user, repo)
+	}()
+	return workflowID, nil
+}
+
+// unstart forgets the latest start for key. Must hold q.mu.
+func (q *QuotaService) unstart(key string) {
+	if n := len(q.starts[key]); n > 0 {
+		q.starts[key] = q.starts[key][:n-1]
+	}
+}
+
+// release frees a run's slot and starts queued submissions that now fit.
+func (q *QuotaService) release(user, repo string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running["user:"+user]--
+	q.running["repo:"+repo]--
+	q.dispatch()
+}
+
+// dispatch starts queued submissions, oldest first, skipping those whose user or
+// repository is still at capacity. Must hold q.mu; it is released while runs
+// start.
+func (q *QuotaService) dispatch() {
+	for i := 0; i < len(q.queue); {
+		t := q.queue[i]
+		if !q.hasCapacity(t.User, t.Repo) {
+			i++
+			continue
+		}
+		q.queue = append(q.queue[:i], q.queue[i+1:]...)
+		t.Position = 0
+		q.renumber()
+		q.reserve(t.User, t.Repo)
+		q.mu.Unlock()
+		workflowID, err := q.launch(t.User, t.Repo, t.start)
+		q.mu.Lock()
+		t.WorkflowID, t.Err = workflowID, err
+		if err != nil {
+			log.Printf("Quota: failed to start queued %s: %v", t.ID, err)
+		} else {
+			log.Printf("Quota: started queued %s as %s after %s", t.ID, workflowID, q.now().Sub(t.QueuedAt).Round(time.Second))
+		}
+		i = 0 // The queue may have changed while unlocked
+	}
+}
+
+// renumber updates queue positions. Must hold q.mu.
+func (q *QuotaService) renumber() {
+	for i, t := range q.queue {
+		t.Position = i + 1
+	}
+}
+
+// pruneTickets forgets submissions that left the queue over a day ago. Must hold q.mu.
+func (q *QuotaService) pruneTickets() {
+	cutoff := q.now().Add(-quotaWindow)
+	for id, t := range q.tickets {
+		if t.Position == 0 && t.QueuedAt.Before(cutoff) {
+			delete(q.tickets, id)
+		}
+	}
+}
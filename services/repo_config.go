@@ -0,0 +1,106 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"gopkg.in/yaml.v3"
+
+	"hammer/shared"
+)
+
+// RepoConfigFile is the per-repository configuration file read from the clone root.
+const RepoConfigFile = ".hammer.yaml"
+
+// ErrInvalidRepoConfig is returned when .hammer.yaml does not match the schema.
+var ErrInvalidRepoConfig = errors.New("invalid " + RepoConfigFile)
+
+// LoadRepoConfig reads .hammer.yaml from the checked-out tree, validates it and
+// keeps it for later operations (ignored and protected paths). A missing file
+// yields an empty config.
+func (s *GitService) LoadRepoConfig() (*shared.RepoConfig, error) {
+	content, err := s.ReadFile(RepoConfigFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			s.config = &shared.RepoConfig{}
+			return s.config, nil
+		}
+		return nil, err
+	}
+	config, err := ParseRepoConfig([]byte(content))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %s: %d ignored path(s), %d protected path(s), max %d file(s) per step",
+		RepoConfigFile, len(config.IgnorePaths), len(config.ProtectedPaths), config.MaxFilesPerStep)
+	s.config = config
+	return config, nil
+}
+
+// ParseRepoConfig decodes and validates a .hammer.yaml document. Unknown keys are rejected.
+func ParseRepoConfig(content []byte) (*shared.RepoConfig, error) {
+	config := &shared.RepoConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRepoConfig, err)
+	}
+
+	var problems []string
+	if config.MaxFilesPerStep < 0 {
+		problems = append(problems, "max_files_per_step must not be negative")
+	}
+	if config.MaxFileBytes < 0 {
+		problems = append(problems, "max_file_bytes must not be negative")
+	}
+	for _, p := range config.IgnorePaths {
+		if err := ValidateGlob(p); err != nil {
+			problems = append(problems, "ignore_paths: "+err.Error())
+		}
+	}
+	for _, p := range config.ProtectedPaths {
+		if err := ValidateGlob(p); err != nil {
+			problems = append(problems, "protected_paths: "+err.Error())
+		}
+	}
+	if _, err := NewSecretScanner(config.SecretAllowlist); err != nil {
+		problems = append(problems, "secret_allowlist: "+err.Error())
+	}
+	if config.BranchPrefix != "" {
+		if err := plumbing.NewBranchReferenceName(config.BranchPrefix + "ai-x").Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("branch_prefix %q is not valid in a branch name", config.BranchPrefix))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRepoConfig, strings.Join(problems, "; "))
+	}
+	return config, nil
+}
+
+// RepoConfig returns the loaded repository config, or an empty config if none was loaded.
+func (s *GitService) RepoConfig() shared.RepoConfig {
+	if s.config == nil {
+		return shared.RepoConfig{}
+	}
+	return *s.config
+}
+
+// isIgnored reports whether the repository config excludes path from listings.
+func (s *GitService) isIgnored(filePath string) bool {
+	return s.config != nil && MatchAnyGlob(s.config.IgnorePaths, filePath)
+}
+
+// isProtected reports whether the repository config or the worker's write policy
+// forbids modifying path.
+func (s *GitService) isProtected(filePath string) bool {
+	if MatchAnyGlob(s.policy.ProtectedPaths, filePath) {
+		return true
+	}
+	return s.config != nil && MatchAnyGlob(s.config.ProtectedPaths, filePath)
+}
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"os"
+	"strconv"
+
+	"hammer/shared"
+)
+
+// LoadRunSettingsFromEnv reads the worker settings that runs depend on. The web
+// process passes them to each run it starts, so workflow code never reads the
+// environment itself.
+func LoadRunSettingsFromEnv() shared.RunSettings {
+	return shared.RunSettings{
+		Agent: shared.AgentLimits{
+			MaxIterations:       envInt("AGENT_MAX_ITERATIONS", 20),
+			MaxTokens:           envInt("AGENT_MAX_TOKENS", 300000),
+			VerificationEnabled: os.Getenv("AGENT_ALLOW_VERIFICATION") == "true",
+		},
+		Selection: shared.SelectionLimits{
+			HierarchicalThreshold: envInt("HIERARCHICAL_SELECTION_THRESHOLD", 300),
+			MaxDirectories:        envInt("SELECTION_MAX_DIRECTORIES", 8),
+			MaxFiles:              envInt("SELECTION_MAX_FILES", 25),
+			MaxBytes:              int64(envInt("SELECTION_MAX_BYTES", 512*1024)),
+			MaxRelatedFiles:       envInt("SYMBOL_RELATED_FILES", 5),
+			SearchResults:         envInt("SEARCH_RESULTS", 10),
+		},
+		LLMCommitMessages:    os.Getenv("LLM_COMMIT_MESSAGES") == "true",
+		ReviewMaxRevisions:   envInt("REVIEW_MAX_REVISIONS", 2),
+		ApprovalTimeoutHours: envInt("APPROVAL_TIMEOUT_HOURS", 72),
+	}
+}
+
+// envInt reads a non-negative integer from the environment, falling back to def.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return def
+	}
+	return n
+}
@@ -0,0 +1,362 @@
+package services
+
+import (
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"hammer/shared"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// BM25 parameters (the usual defaults).
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Extra weight for query terms found in a file's path rather than its content.
+const pathTermBoost = 2.0
+
+// Score added to a file containing an exact identifier or quoted phrase from the query.
+const exactMatchBoost = 3.0
+
+// Snippets longer than this are truncated.
+const maxSnippetChars = 160
+
+// searchStopWords are ignored in queries; step descriptions are mostly prose.
+var searchStopWords = map[string]struct{}{
+	"a": {}, "an": {}, "and": {}, "are": {}, "as": {}, "at": {}, "be": {}, "by": {}, "for": {},
+	"from": {}, "in": {}, "into": {}, "is": {}, "it": {}, "its": {}, "of": {}, "on": {}, "or": {},
+	"so": {}, "that": {}, "the": {}, "this": {}, "to": {}, "with": {}, "when": {}, "which": {},
+	"should": {}, "must": {}, "new": {}, "add": {}, "update": {}, "create": {}, "file": {}, "use": {},
+}
+
+var (
+	searchTokenPattern  = regexp.MustCompile(`[A-Za-z0-9_]+`)
+	quotedPhrasePattern = regexp.MustCompile("[\"'`]([^\"'`]{3,})[\"'`]")
+	// Identifiers worth an exact-match check: mixed case, snake_case or dotted names.
+	identifierLikePattern = regexp.MustCompile(`\b[A-Za-z_][A-Za-z0-9_]*(?:[A-Z_.][A-Za-z0-9_]*)+\b`)
+)
+
+// searchDoc holds the indexed terms of one file.
+type searchDoc struct {
+	hash      plumbing.Hash
+	length    int                 // Number of content terms
+	terms     map[string]int      // Content term -> frequency
+	pathTerms map[string]struct{} // Terms from the file path
+	trigrams  map[string]struct{} // Lowercased content trigrams
+}
+
+// SearchIndex is a BM25 index over file contents with a trigram index for exact
+// identifier and phrase lookups.
+type SearchIndex struct {
+	docs     map[string]*searchDoc
+	postings map[string]map[string]struct{} // Term -> files containing it
+	trigrams map[string]map[string]struct{} // Trigram -> files containing it
+	totalLen int
+}
+
+// SearchIndex returns the search index for the current worktree, re-indexing only
+// files that changed since the previous call.
+func (s *GitService) SearchIndex() (*SearchIndex, error) {
+	files, err := s.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	if s.search == nil {
+		s.search = &SearchIndex{
+			docs:     make(map[string]*searchDoc),
+			postings: make(map[string]map[string]struct{}),
+			trigrams: make(map[string]map[string]struct{}),
+		}
+	}
+	listed := make(map[string]struct{}, len(files))
+	indexed := 0
+	for _, file := range files {
+		listed[file] = struct{}{}
+		content, err := s.ReadFile(file)
+		if err != nil {
+			log.Printf("Warning: search index could not read '%s': %v", file, err)
+			continue
+		}
+		hash := plumbing.ComputeHash(plumbing.BlobObject, []byte(content))
+		if doc, ok := s.search.docs[file]; ok && doc.hash == hash {
+			continue
+		}
+		s.search.remove(file)
+		s.search.add(file, content, hash)
+		indexed++
+	}
+	for file := range s.search.docs {
+		if _, ok := listed[file]; !ok {
+			s.search.remove(file)
+		}
+	}
+	if indexed > 0 {
+		log.Printf("Search index: indexed %d file(s), %d in total", indexed, len(s.search.docs))
+	}
+	return s.search, nil
+}
+
+// SearchFiles ranks files by how well their contents match the query and returns
+// the best limit hits, each with the first matching line as a snippet.
+func (s *GitService) SearchFiles(query string, limit int) ([]shared.SearchHit, error) {
+	index, err := s.SearchIndex()
+	if err != nil {
+		return nil, err
+	}
+	hits := index.Search(query, limit)
+	terms := searchTerms(query)
+	for i := range hits {
+		content, err := s.ReadFile(hits[i].File)
+		if err != nil {
+			continue
+		}
+		hits[i].Snippet = matchingLine(content, terms)
+	}
+	return hits, nil
+}
+
+func (idx *SearchIndex) add(file, content string, hash plumbing.Hash) {
+	doc := &searchDoc{
+		hash:      hash,
+		terms:     make(map[string]int),
+		pathTerms: make(map[string]struct{}),
+		trigrams:  make(map[string]struct{}),
+	}
+	for _, term := range tokenizeForSearch(content) {
+		doc.terms[term]++
+		doc.length++
+	}
+	for _, term := range tokenizeForSearch(file) {
+		doc.pathTerms[term] = struct{}{}
+	}
+	lower := strings.ToLower(content)
+	for i := 0; i+3 <= len(lower); i++ {
+		doc.trigrams[lower[i:i+3]] = struct{}{}
+	}
+
+	idx.docs[file] = doc
+	idx.totalLen += doc.length
+	for term := range doc.terms {
+		addPosting(idx.postings, term, file)
+	}
+	for term := range doc.pathTerms {
+		addPosting(idx.postings, term, file)
+	}
+	for tri := range doc.trigrams {
+		addPosting(idx.trigrams, tri, file)
+	}
+}
+
+func (idx *SearchIndex) remove(file string) {
+	doc, ok := idx.docs[file]
+	if !ok {
+		return
+	}
+	for term := range doc.terms {
+		removePosting(idx.postings, term, file)
+	}
+	for term := range doc.pathTerms {
+		removePosting(idx.postings, term, file)
+	}
+	for tri := range doc.trigrams {
+		removePosting(idx.trigrams, tri, file)
+	}
+	idx.totalLen -= doc.length
+	delete(idx.docs, file)
+}
+
+func addPosting(postings map[string]map[string]struct{}, key, file string) {
+	if postings[key] == nil {
+		postings[key] = make(map[string]struct{})
+	}
+	postings[key][file] = struct{}{}
+}
+
+func removePosting(postings map[string]map[string]struct{}, key, file string) {
+	delete(postings[key], file)
+	if len(postings[key]) == 0 {
+		delete(postings, key)
+	}
+}
+
+// Search scores files with BM25 over the query terms, boosts path matches and
+// files containing an identifier or quoted phrase from the query verbatim, and
+// returns the best limit hits.
+func (idx *SearchIndex) Search(query string, limit int) []shared.SearchHit {
+	if len(idx.docs) == 0 || limit <= 0 {
+		return nil
+	}
+	scores := make(map[string]float64)
+	n := float64(len(idx.docs))
+	avgLen := float64(idx.totalLen) / n
+	if avgLen == 0 {
+		avgLen = 1
+	}
+	for _, term := range searchTerms(query) {
+		files := idx.postings[term]
+		if len(files) == 0 {
+			continue
+		}
+		df := float64(len(files))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for file := range files {
+			doc := idx.docs[file]
+			if tf := float64(doc.terms[term]); tf > 0 {
+				norm := tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(doc.length)/avgLen))
+				scores[file] += idf * norm
+			}
+			if _, ok := doc.pathTerms[term]; ok {
+				scores[file] += idf * pathTermBoost
+			}
+		}
+	}
+	for _, phrase := range exactPhrases(query) {
+		for _, file := range idx.filesWithTrigrams(strings.ToLower(phrase)) {
+			scores[file] += exactMatchBoost
+		}
+	}
+
+	hits := make([]shared.SearchHit, 0, len(scores))
+	for file, score := range scores {
+		hits = append(hits, shared.SearchHit{File: file, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].File < hits[j].File
+	})
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+// filesWithTrigrams returns the files containing every trigram of the phrase. This
+// is a candidate filter; short false positives are acceptable for ranking.
+func (idx *SearchIndex) filesWithTrigrams(phrase string) []string {
+	if len(phrase) < 3 {
+		return nil
+	}
+	var candidates map[string]struct{}
+	for i := 0; i+3 <= len(phrase); i++ {
+		files := idx.trigrams[phrase[i:i+3]]
+		if candidates == nil {
+			candidates = make(map[string]struct{}, len(files))
+			for f := range files {
+				candidates[f] = struct{}{}
+			}
+			continue
+		}
+		for f := range candidates {
+			if _, ok := files[f]; !ok {
+				delete(candidates, f)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+	}
+	result := make([]string, 0, len(candidates))
+	for f := range candidates {
+		result = append(result, f)
+	}
+	return result
+}
+
+// tokenizeForSearch splits text into lowercase terms. Compound identifiers are
+// indexed both whole and split into their camelCase / snake_case parts.
+func tokenizeForSearch(text string) []string {
+	var terms []string
+	for _, token := range searchTokenPattern.FindAllString(text, -1) {
+		lower := strings.ToLower(token)
+		terms = append(terms, lower)
+		parts := splitIdentifier(token)
+		if len(parts) > 1 {
+			for _, part := range parts {
+				terms = append(terms, strings.ToLower(part))
+			}
+		}
+	}
+	return terms
+}
+
+// splitIdentifier splits "parseHTTPRequest_v2" into ["parse", "HTTP", "Request", "v2"].
+func splitIdentifier(token string) []string {
+	var parts []string
+	for _, chunk := range strings.Split(token, "_") {
+		runes := []rune(chunk)
+		start := 0
+		for i := 1; i < len(runes); i++ {
+			lowerToUpper := unicode.IsLower(runes[i-1]) && unicode.IsUpper(runes[i])
+			acronymEnd := i+1 < len(runes) && unicode.IsUpper(runes[i-1]) && unicode.IsUpper(runes[i]) && unicode.IsLower(runes[i+1])
+			if lowerToUpper || acronymEnd {
+				parts = append(parts, string(runes[start:i]))
+				start = i
+			}
+		}
+		if start < len(runes) {
+			parts = append(parts, string(runes[start:]))
+		}
+	}
+	return parts
+}
+
+// searchTerms returns the distinct, non-stop-word terms of a query.
+func searchTerms(query string) []string {
+	seen := make(map[string]struct{})
+	var terms []string
+	for _, term := range tokenizeForSearch(query) {
+		if _, stop := searchStopWords[term]; stop || len(term) < 2 {
+			continue
+		}
+		if _, dup := seen[term]; dup {
+			continue
+		}
+		seen[term] = struct{}{}
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// exactPhrases returns quoted phrases and identifier-like tokens from the query.
+func exactPhrases(query string) []string {
+	var phrases []string
+	for _, m := range quotedPhrasePattern.FindAllStringSubmatch(query, -1) {
+		phrases = append(phrases, m[1])
+	}
+	for _, m := range identifierLikePattern.FindAllString(query, -1) {
+		if len(m) >= 4 {
+			phrases = append(phrases, m)
+		}
+	}
+	return phrases
+}
+
+// matchingLine returns the first line containing the most query terms.
+func matchingLine(content string, terms []string) string {
+	best, bestCount := "", 0
+	for _, line := range strings.Split(content, "\n") {
+		lower := strings.ToLower(line)
+		count := 0
+		for _, term := range terms {
+			if strings.Contains(lower, term) {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = strings.TrimSpace(line), count
+		}
+	}
+	if len(best) > maxSnippetChars {
+		best = best[:maxSnippetChars-3] + "..."
+	}
+	return best
+}
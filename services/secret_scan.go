@@ -0,0 +1,263 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"hammer/shared"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// ErrSecretsFound is returned when a push is refused because the branch adds
+// lines that look like credentials.
+var ErrSecretsFound = errors.New("potential secrets found in generated changes")
+
+// secretRule flags a credential by its shape. If group is non-zero, only that
+// capture group is the secret and it must also pass the entropy threshold.
+type secretRule struct {
+	id         string
+	pattern    *regexp.Regexp
+	group      int
+	minEntropy float64
+}
+
+var secretRules = []secretRule{
+	{id: "aws-access-key", pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{id: "github-token", pattern: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})`)},
+	{id: "slack-token", pattern: regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{id: "openai-key", pattern: regexp.MustCompile(`\bsk-(?:proj-)?[A-Za-z0-9_-]{20,}`)},
+	{id: "google-api-key", pattern: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`)},
+	{id: "stripe-live-key", pattern: regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}`)},
+	{id: "private-key", pattern: regexp.MustCompile(`-----BEGIN (?:[A-Z]+ )*PRIVATE KEY-----`)},
+	{id: "jwt", pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+	{
+		id:         "credential-assignment",
+		pattern:    regexp.MustCompile(`(?i)(?:password|passwd|secret|token|api[_-]?key|access[_-]?key|private[_-]?key|client[_-]?secret)[\w.-]*["']?\s*[:=]\s*["']([^"'\s]{8,})["']`),
+		group:      1,
+		minEntropy: 3.5,
+	},
+	{
+		id:         "high-entropy-string",
+		pattern:    regexp.MustCompile(`["'\x60]([A-Za-z0-9+/=_-]{32,})["'\x60]`),
+		group:      1,
+		minEntropy: 4.5,
+	},
+}
+
+// placeholderPattern matches values that are obviously not real credentials.
+var placeholderPattern = regexp.MustCompile(`(?i)example|sample|dummy|placeholder|changeme|your[_-]|xxxx|\*\*\*\*|<[^>]*>|\$\{|\{\{|^test`)
+
+// SecretScanner finds credential-looking strings in added lines. Lines matching
+// an allow-list pattern are never reported.
+type SecretScanner struct {
+	allow []*regexp.Regexp
+}
+
+// NewSecretScanner compiles the allow-list (regular expressions matched against
+// each line).
+func NewSecretScanner(allowlist []string) (*SecretScanner, error) {
+	scanner := &SecretScanner{}
+	for _, pattern := range allowlist {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret allow-list pattern %q: %w", pattern, err)
+		}
+		scanner.allow = append(scanner.allow, re)
+	}
+	return scanner, nil
+}
+
+// ScanChange reports secrets on lines of after that do not appear in before, so
+// credentials that were already in the repository are not reported again.
+func (sc *SecretScanner) ScanChange(filePath, before, after string) []shared.SecretFinding {
+	if strings.IndexByte(after, 0) >= 0 {
+		return nil // Binary content
+	}
+	existing := make(map[string]struct{})
+	for _, line := range strings.Split(before, "\n") {
+		existing[line] = struct{}{}
+	}
+	var findings []shared.SecretFinding
+	for i, line := range strings.Split(after, "\n") {
+		if _, ok := existing[line]; ok {
+			continue
+		}
+		if sc.allowed(line) {
+			continue
+		}
+		for _, rule := range secretRules {
+			if match, ok := rule.find(line); ok {
+				findings = append(findings, shared.SecretFinding{
+					File:  filePath,
+					Line:  i + 1,
+					Rule:  rule.id,
+					Match: RedactSecret(match),
+				})
+				break // One finding per line is enough
+			}
+		}
+	}
+	return findings
+}
+
+func (sc *SecretScanner) allowed(line string) bool {
+	for _, re := range sc.allow {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r secretRule) find(line string) (string, bool) {
+	for _, m := range r.pattern.FindAllStringSubmatch(line, -1) {
+		secret := m[r.group]
+		if r.group == 0 {
+			return secret, true
+		}
+		if placeholderPattern.MatchString(secret) || shannonEntropy(secret) < r.minEntropy {
+			continue
+		}
+		if r.id == "high-entropy-string" && !mixedCharacterClasses(secret) {
+			continue // Hex digests, identifiers and paths
+		}
+		return secret, true
+	}
+	return "", false
+}
+
+// shannonEntropy returns the entropy of s in bits per character.
+func shannonEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	counts := make(map[rune]int)
+	for _, r := range s {
+		counts[r]++
+	}
+	n := float64(len([]rune(s)))
+	entropy := 0.0
+	for _, c := range counts {
+		p := float64(c) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// mixedCharacterClasses reports whether s has upper case, lower case and digits,
+// as random tokens do.
+func mixedCharacterClasses(s string) bool {
+	var upper, lower, digit bool
+	for _, r := range s {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= '0' && r <= '9':
+			digit = true
+		}
+	}
+	return upper && lower && digit
+}
+
+// RedactSecret keeps just enough of a secret to identify it in reports.
+func RedactSecret(secret string) string {
+	if len(secret) <= 8 {
+		return strings.Repeat("*", len(secret))
+	}
+	return fmt.Sprintf("%s…(%d chars)", secret[:4], len(secret))
+}
+
+// secretScanner builds a scanner with the allow-list from .hammer.yaml.
+func (s *GitService) secretScanner() (*SecretScanner, error) {
+	return NewSecretScanner(s.RepoConfig().SecretAllowlist)
+}
+
+// ScanChanges scans files about to be written against their content at HEAD.
+func (s *GitService) ScanChanges(changes map[string]string) ([]shared.SecretFinding, error) {
+	scanner, err := s.secretScanner()
+	if err != nil {
+		return nil, err
+	}
+	head, err := s.RepoHeadHash()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(changes))
+	for p := range changes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var findings []shared.SecretFinding
+	for _, p := range paths {
+		before := ""
+		if head != plumbing.ZeroHash {
+			if before, _, err = s.fileAt(head, p); err != nil {
+				return nil, err
+			}
+		}
+		findings = append(findings, scanner.ScanChange(p, before, changes[p])...)
+	}
+	return findings, nil
+}
+
+// ScanBranch scans everything the run changed, from the base commit to HEAD.
+// Lines that came in with a merge of the base branch are upstream's, not the
+// run's, and are not reported.
+func (s *GitService) ScanBranch() ([]shared.SecretFinding, error) {
+	scanner, err := s.secretScanner()
+	if err != nil {
+		return nil, err
+	}
+	head, err := s.RepoHeadHash()
+	if err != nil {
+		return nil, err
+	}
+	if head == s.baseHash {
+		return nil, nil
+	}
+	changed, err := s.changedPathsBetween(s.baseHash, head)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(changed))
+	for p := range changed {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var upstreamChanged map[string]struct{}
+	if s.mergedUpstream != plumbing.ZeroHash {
+		if upstreamChanged, err = s.changedPathsBetween(s.upstreamBase, s.mergedUpstream); err != nil {
+			return nil, err
+		}
+	}
+	var findings []shared.SecretFinding
+	for _, p := range paths {
+		after, exists, err := s.fileAt(head, p)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		before, _, err := s.fileAt(s.baseHash, p)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := upstreamChanged[p]; ok {
+			theirs, _, err := s.fileAt(s.mergedUpstream, p)
+			if err != nil {
+				return nil, err
+			}
+			before += "\n" + theirs
+		}
+		findings = append(findings, scanner.ScanChange(p, before, after)...)
+	}
+	return findings, nil
+}
@@ -0,0 +1,387 @@
+package services
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"hammer/shared"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Symbols defined in more files than this are too ambiguous (String, New, init, ...)
+// to say anything about how two files relate, so they are ignored when expanding.
+const maxSymbolDefiners = 3
+
+// Identifiers shorter than this are never indexed as references.
+const minSymbolLength = 3
+
+// Symbol kinds recorded in the index.
+const (
+	SymbolPackage  = "package"
+	SymbolType     = "type"
+	SymbolFunc     = "func"
+	SymbolMethod   = "method"
+	SymbolVar      = "var"
+	SymbolConst    = "const"
+	SymbolClass    = "class"
+	SymbolFunction = "function"
+)
+
+// fileSymbols is the index entry for a single file.
+type fileSymbols struct {
+	hash plumbing.Hash       // Content hash; the file is re-parsed only when it changes
+	defs []shared.SymbolDef  // Symbols defined in the file
+	uses map[string]struct{} // Identifiers referenced in the file
+}
+
+// SymbolIndex maps the files of a worktree to the symbols they define and reference.
+type SymbolIndex struct {
+	files map[string]*fileSymbols
+}
+
+// regexLanguage describes definition patterns for a language without a Go parser.
+// Each pattern's first submatch is the symbol name.
+type regexLanguage struct {
+	defs []regexDef
+}
+
+type regexDef struct {
+	kind    string
+	pattern *regexp.Regexp
+}
+
+var identifierPattern = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+
+var (
+	pythonLanguage = regexLanguage{defs: []regexDef{
+		{SymbolClass, regexp.MustCompile(`(?m)^\s*class\s+([A-Za-z_]\w*)`)},
+		{SymbolFunction, regexp.MustCompile(`(?m)^\s*(?:async\s+)?def\s+([A-Za-z_]\w*)`)},
+	}}
+	jsLanguage = regexLanguage{defs: []regexDef{
+		{SymbolClass, regexp.MustCompile(`(?m)^\s*(?:export\s+)?(?:default\s+)?(?:abstract\s+)?class\s+([A-Za-z_$][\w$]*)`)},
+		{SymbolFunction, regexp.MustCompile(`(?m)^\s*(?:export\s+)?(?:default\s+)?(?:async\s+)?function\s*\*?\s*([A-Za-z_$][\w$]*)`)},
+		{SymbolVar, regexp.MustCompile(`(?m)^\s*(?:export\s+)?(?:const|let|var)\s+([A-Za-z_$][\w$]*)\s*=`)},
+		{SymbolType, regexp.MustCompile(`(?m)^\s*(?:export\s+)?(?:interface|type|enum)\s+([A-Za-z_$][\w$]*)`)},
+	}}
+	javaLikeLanguage = regexLanguage{defs: []regexDef{
+		{SymbolClass, regexp.MustCompile(`(?m)^\s*(?:(?:public|private|protected|internal|static|abstract|final|sealed|data|open|partial)\s+)*(?:class|interface|enum|record|object|struct)\s+([A-Za-z_]\w*)`)},
+		{SymbolFunction, regexp.MustCompile(`(?m)^\s*(?:(?:public|private|protected|internal|static|final|override|suspend|async|virtual)\s+)*fun\s+([A-Za-z_]\w*)`)},
+	}}
+	rustLanguage = regexLanguage{defs: []regexDef{
+		{SymbolType, regexp.MustCompile(`(?m)^\s*(?:pub(?:\([^)]*\))?\s+)?(?:struct|enum|trait|type|union)\s+([A-Za-z_]\w*)`)},
+		{SymbolFunction, regexp.MustCompile(`(?m)^\s*(?:pub(?:\([^)]*\))?\s+)?(?:async\s+)?(?:unsafe\s+)?fn\s+([A-Za-z_]\w*)`)},
+	}}
+	rubyLanguage = regexLanguage{defs: []regexDef{
+		{SymbolClass, regexp.MustCompile(`(?m)^\s*(?:class|module)\s+([A-Z]\w*)`)},
+		{SymbolFunction, regexp.MustCompile(`(?m)^\s*def\s+(?:self\.)?([A-Za-z_]\w*[?!]?)`)},
+	}}
+)
+
+// regexLanguages maps file extensions to their fallback parsers.
+var regexLanguages = map[string]regexLanguage{
+	".py":   pythonLanguage,
+	".js":   jsLanguage,
+	".jsx":  jsLanguage,
+	".mjs":  jsLanguage,
+	".ts":   jsLanguage,
+	".tsx":  jsLanguage,
+	".java": javaLikeLanguage,
+	".kt":   javaLikeLanguage,
+	".cs":   javaLikeLanguage,
+	".rs":   rustLanguage,
+	".rb":   rubyLanguage,
+}
+
+// SymbolIndex returns the symbol index for the current worktree, re-parsing only
+// files that changed since the previous call.
+func (s *GitService) SymbolIndex() (*SymbolIndex, error) {
+	files, err := s.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	if s.symbols == nil {
+		s.symbols = &SymbolIndex{files: make(map[string]*fileSymbols)}
+	}
+	listed := make(map[string]struct{}, len(files))
+	parsed := 0
+	for _, file := range files {
+		listed[file] = struct{}{}
+		if !isIndexable(file) {
+			continue
+		}
+		content, err := s.ReadFile(file)
+		if err != nil {
+			log.Printf("Warning: symbol index could not read '%s': %v", file, err)
+			continue
+		}
+		hash := plumbing.ComputeHash(plumbing.BlobObject, []byte(content))
+		if entry, ok := s.symbols.files[file]; ok && entry.hash == hash {
+			continue
+		}
+		entry := indexFile(file, content)
+		entry.hash = hash
+		s.symbols.files[file] = entry
+		parsed++
+	}
+	for file := range s.symbols.files {
+		if _, ok := listed[file]; !ok {
+			delete(s.symbols.files, file)
+		}
+	}
+	if parsed > 0 {
+		log.Printf("Symbol index: parsed %d file(s), %d indexed in total", parsed, len(s.symbols.files))
+	}
+	return s.symbols, nil
+}
+
+func isIndexable(file string) bool {
+	ext := path.Ext(file)
+	if ext == ".go" {
+		return true
+	}
+	_, ok := regexLanguages[ext]
+	return ok
+}
+
+// indexFile extracts definitions and references from one file. Go files that fail
+// to parse fall back to identifier scanning so their references still count.
+func indexFile(file, content string) *fileSymbols {
+	entry := &fileSymbols{uses: make(map[string]struct{})}
+	if path.Ext(file) == ".go" {
+		if indexGoFile(entry, file, content) {
+			return entry
+		}
+	} else {
+		for _, def := range regexLanguages[path.Ext(file)].defs {
+			for _, m := range def.pattern.FindAllStringSubmatchIndex(content, -1) {
+				name := content[m[2]:m[3]]
+				line := strings.Count(content[:m[2]], "\n") + 1
+				entry.defs = append(entry.defs, shared.SymbolDef{Name: name, Kind: def.kind, File: file, Line: line})
+			}
+		}
+	}
+	for _, ident := range identifierPattern.FindAllString(content, -1) {
+		if len(ident) >= minSymbolLength {
+			entry.uses[ident] = struct{}{}
+		}
+	}
+	return entry
+}
+
+// indexGoFile fills entry from the Go AST. Returns false if the file does not parse.
+func indexGoFile(entry *fileSymbols, file, content string) bool {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, content, parser.SkipObjectResolution)
+	if err != nil {
+		return false
+	}
+	add := func(name, kind string, pos token.Pos) {
+		if name == "_" {
+			return
+		}
+		entry.defs = append(entry.defs, shared.SymbolDef{Name: name, Kind: kind, File: file, Line: fset.Position(pos).Line})
+	}
+	add(f.Name.Name, SymbolPackage, f.Name.Pos())
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				add(receiverType(d.Recv.List[0].Type)+"."+d.Name.Name, SymbolMethod, d.Name.Pos())
+				continue
+			}
+			add(d.Name.Name, SymbolFunc, d.Name.Pos())
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch sp := spec.(type) {
+				case *ast.TypeSpec:
+					add(sp.Name.Name, SymbolType, sp.Name.Pos())
+				case *ast.ValueSpec:
+					kind := SymbolVar
+					if d.Tok == token.CONST {
+						kind = SymbolConst
+					}
+					for _, n := range sp.Names {
+						add(n.Name, kind, n.Pos())
+					}
+				}
+			}
+		}
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok && len(ident.Name) >= minSymbolLength {
+			entry.uses[ident.Name] = struct{}{}
+		}
+		return true
+	})
+	return true
+}
+
+func receiverType(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverType(t.X)
+	case *ast.IndexExpr:
+		return receiverType(t.X)
+	case *ast.IndexListExpr:
+		return receiverType(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
+
+// Definers returns the definitions of name, sorted by file and line. For Go methods
+// both "Method" and "Type.Method" match.
+func (idx *SymbolIndex) Definers(name string) []shared.SymbolDef {
+	var defs []shared.SymbolDef
+	for _, entry := range idx.files {
+		for _, def := range entry.defs {
+			if def.Name == name || def.Kind == SymbolMethod && strings.HasSuffix(def.Name, "."+name) {
+				defs = append(defs, def)
+			}
+		}
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		if defs[i].File != defs[j].File {
+			return defs[i].File < defs[j].File
+		}
+		return defs[i].Line < defs[j].Line
+	})
+	return defs
+}
+
+// Users returns the files that reference name, excluding the files defining it.
+func (idx *SymbolIndex) Users(name string) []string {
+	short := name
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		short = name[i+1:]
+	}
+	var users []string
+	for file, entry := range idx.files {
+		if _, ok := entry.uses[short]; !ok {
+			continue
+		}
+		if defines(entry, short) {
+			continue
+		}
+		users = append(users, file)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// defines reports whether the file defines name. Definitions also show up as
+// identifiers, so definers are excluded when looking for references.
+func defines(entry *fileSymbols, name string) bool {
+	for _, def := range entry.defs {
+		if def.Name == name || strings.HasSuffix(def.Name, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RelatedFiles returns up to max files connected to the selected ones: first files
+// defining symbols the selection references, then files referencing symbols the
+// selection defines. Candidates are ranked by the number of shared symbols;
+// ambiguous symbols (defined in many files) are ignored.
+func (idx *SymbolIndex) RelatedFiles(selected []string, max int) []string {
+	if max <= 0 {
+		return nil
+	}
+	definers := make(map[string][]string) // short symbol name -> defining files
+	for file, entry := range idx.files {
+		for _, def := range entry.defs {
+			if def.Kind == SymbolPackage {
+				continue
+			}
+			name := def.Name
+			if i := strings.LastIndex(name, "."); i >= 0 {
+				name = name[i+1:]
+			}
+			definers[name] = appendUnique(definers[name], file)
+		}
+	}
+	isSelected := make(map[string]struct{}, len(selected))
+	for _, f := range selected {
+		isSelected[f] = struct{}{}
+	}
+
+	dependencies := make(map[string]int)
+	dependents := make(map[string]int)
+	for _, file := range selected {
+		entry, ok := idx.files[file]
+		if !ok {
+			continue
+		}
+		for use := range entry.uses {
+			files := definers[use]
+			if len(files) == 0 || len(files) > maxSymbolDefiners {
+				continue
+			}
+			for _, def := range files {
+				if _, sel := isSelected[def]; !sel {
+					dependencies[def]++
+				}
+			}
+		}
+		for _, def := range entry.defs {
+			name := def.Name
+			if i := strings.LastIndex(name, "."); i >= 0 {
+				name = name[i+1:]
+			}
+			if def.Kind == SymbolPackage || len(definers[name]) > maxSymbolDefiners {
+				continue
+			}
+			for other, otherEntry := range idx.files {
+				if _, sel := isSelected[other]; sel {
+					continue
+				}
+				if _, ok := otherEntry.uses[name]; ok && !defines(otherEntry, name) {
+					dependents[other]++
+				}
+			}
+		}
+	}
+
+	var related []string
+	for _, ranked := range []map[string]int{dependencies, dependents} {
+		for _, file := range rankByCount(ranked) {
+			if len(related) == max {
+				return related
+			}
+			related = appendUnique(related, file)
+		}
+	}
+	return related
+}
+
+func rankByCount(counts map[string]int) []string {
+	files := make([]string, 0, len(counts))
+	for f := range counts {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if counts[files[i]] != counts[files[j]] {
+			return counts[files[i]] > counts[files[j]]
+		}
+		return files[i] < files[j]
+	})
+	return files
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, existing := range list {
+		if existing == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
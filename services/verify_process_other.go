@@ -0,0 +1,9 @@
+//go:build !unix
+
+package services
+
+import "os/exec"
+
+// killProcessGroupOnCancel leaves cmd's default cancellation, which kills only
+// the process itself; WaitDelay bounds how long its children can hold the output.
+func killProcessGroupOnCancel(cmd *exec.Cmd) {}
@@ -0,0 +1,234 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"hammer/shared"
+)
+
+// DefaultMaxWriteBytes is the largest file content that may be written unless
+// WRITE_MAX_FILE_BYTES says otherwise.
+const DefaultMaxWriteBytes = 1024 * 1024
+
+// DefaultProtectedPaths are protected in every repository unless WRITE_PROTECTED_PATHS
+// is set: CI definitions run with the repository's secrets, and checksums cannot be
+// produced by a model.
+var DefaultProtectedPaths = []string{".github/workflows/**", "go.sum"}
+
+// Write policy violations. Writes rejected for any of these are recorded on the
+// GitService (see TakeRejectedWrites) instead of being applied.
+var (
+	ErrUnsafePath   = errors.New("unsafe path")
+	ErrFileTooLarge = errors.New("file content exceeds the write size limit")
+	ErrTooManyFiles = errors.New("step changes more files than the per-step limit")
+)
+
+// WritePolicy holds the worker-wide limits on files the agents may write. They
+// apply in addition to .hammer.yaml, which can tighten but not loosen them.
+type WritePolicy struct {
+	ProtectedPaths  []string // Globs that may not be modified in any repository
+	MaxFileBytes    int64    // Largest file content that may be written; 0 means no limit
+	MaxFilesPerStep int      // 0 means no worker-wide limit
+}
+
+// LoadWritePolicyFromEnv reads the write policy from the environment:
+//
+//	WRITE_PROTECTED_PATHS     comma-separated globs (default DefaultProtectedPaths; set empty to disable)
+//	WRITE_MAX_FILE_BYTES      largest file content that may be written (default 1 MiB; 0 disables)
+//	WRITE_MAX_FILES_PER_STEP  files a step may change (default 0, unlimited)
+func LoadWritePolicyFromEnv() (WritePolicy, error) {
+	policy := WritePolicy{
+		ProtectedPaths: DefaultProtectedPaths,
+		MaxFileBytes:   DefaultMaxWriteBytes,
+	}
+	if value, ok := os.LookupEnv("WRITE_PROTECTED_PATHS"); ok {
+		policy.ProtectedPaths = nil
+		for _, p := range strings.Split(value, ",") {
+			if p = strings.TrimSpace(p); p == "" {
+				continue
+			}
+			if err := ValidateGlob(p); err != nil {
+				return WritePolicy{}, fmt.Errorf("WRITE_PROTECTED_PATHS: %w", err)
+			}
+			policy.ProtectedPaths = append(policy.ProtectedPaths, p)
+		}
+	}
+	if value := os.Getenv("WRITE_MAX_FILE_BYTES"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return WritePolicy{}, fmt.Errorf("WRITE_MAX_FILE_BYTES must be a non-negative integer, got %q", value)
+		}
+		policy.MaxFileBytes = n
+	}
+	if value := os.Getenv("WRITE_MAX_FILES_PER_STEP"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return WritePolicy{}, fmt.Errorf("WRITE_MAX_FILES_PER_STEP must be a non-negative integer, got %q", value)
+		}
+		policy.MaxFilesPerStep = n
+	}
+	return policy, nil
+}
+
+// SetWritePolicy sets the worker-wide write policy for this GitService.
+func (s *GitService) SetWritePolicy(policy WritePolicy) {
+	s.policy = policy
+}
+
+// NormalizeRepoPath cleans a repository-relative path from model output. It
+// rejects empty and absolute paths, paths that escape the repository root and
+// paths with a .git component (in any letter case, for case-insensitive
+// checkouts).
+func NormalizeRepoPath(filePath string) (string, error) {
+	p := strings.TrimSpace(strings.ReplaceAll(filePath, `\`, "/"))
+	switch {
+	case p == "":
+		return "", fmt.Errorf("%w: empty path", ErrUnsafePath)
+	case strings.ContainsRune(p, 0):
+		return "", fmt.Errorf("%w: %q contains a NUL byte", ErrUnsafePath, filePath)
+	case strings.HasPrefix(p, "/"), len(p) > 1 && p[1] == ':':
+		return "", fmt.Errorf("%w: %q is absolute", ErrUnsafePath, filePath)
+	}
+	p = path.Clean(p)
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("%w: %q escapes the repository", ErrUnsafePath, filePath)
+	}
+	for _, part := range strings.Split(p, "/") {
+		if strings.EqualFold(part, ".git") {
+			return "", fmt.Errorf("%w: %q is inside .git", ErrUnsafePath, filePath)
+		}
+	}
+	return p, nil
+}
+
+// IsWriteRejected reports whether err is a write policy violation.
+func IsWriteRejected(err error) bool {
+	return errors.Is(err, ErrUnsafePath) || errors.Is(err, ErrProtectedPath) || errors.Is(err, ErrFileTooLarge) || errors.Is(err, ErrTooManyFiles)
+}
+
+// checkWrite applies the write policy to a write of size bytes and returns the
+// normalized path. Violations are recorded for TakeRejectedWrites.
+func (s *GitService) checkWrite(filePath string, size int) (string, error) {
+	p, err := NormalizeRepoPath(filePath)
+	if err == nil && s.isProtected(p) {
+		err = fmt.Errorf("cannot modify '%s': %w", p, ErrProtectedPath)
+	}
+	if err == nil && size >= 0 && s.policy.MaxFileBytes > 0 && int64(size) > s.policy.MaxFileBytes {
+		err = fmt.Errorf("cannot write '%s' (%d bytes, limit %d): %w", p, size, s.policy.MaxFileBytes, ErrFileTooLarge)
+	}
+	if err != nil {
+		s.rejected = append(s.rejected, shared.RejectedWrite{Path: filePath, Reason: err.Error()})
+		return "", err
+	}
+	return p, nil
+}
+
+// CheckWrites applies the write policy to a step's generated files without writing
+// them and returns the accepted ones keyed by normalized path. Rejections are
+// recorded for TakeRejectedWrites. Paths naming the same file (such as "./a.go"
+// and "a.go") are one change: the first in sorted order is kept and the others
+// are rejected.
+func (s *GitService) CheckWrites(changes map[string]string) map[string]string {
+	paths := make([]string, 0, len(changes))
+	for p := range changes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	accepted := make(map[string]string, len(changes))
+	from := make(map[string]string, len(changes))
+	for _, filePath := range paths {
+		p, err := s.checkWrite(filePath, len(changes[filePath]))
+		if err != nil {
+			continue
+		}
+		if first, ok := from[p]; ok {
+			s.rejected = append(s.rejected, shared.RejectedWrite{Path: filePath, Reason: fmt.Sprintf("'%s' names the same file as '%s', which was written instead", filePath, first)})
+			continue
+		}
+		from[p] = filePath
+		accepted[p] = changes[filePath]
+	}
+	return accepted
+}
+
+// TakeRejectedWrites returns the writes rejected by the policy since the last call.
+func (s *GitService) TakeRejectedWrites() []shared.RejectedWrite {
+	rejected := s.rejected
+	s.rejected = nil
+	return rejected
+}
+
+// LimitStepFiles splits a step's changed paths at the per-step file limit. The
+// first paths in sorted order are kept; the rest are returned as rejected writes
+// so the workflow can report them instead of failing the step. The paths must be
+// normalized and allowed by the policy (see CheckWrites), so that invalid paths
+// and aliases don't take up the limit.
+func (s *GitService) LimitStepFiles(paths []string) (kept []string, rejected []shared.RejectedWrite) {
+	kept = append([]string(nil), paths...)
+	sort.Strings(kept)
+	max := s.MaxFilesPerStep()
+	if max == 0 || len(kept) <= max {
+		return kept, nil
+	}
+	for _, p := range kept[max:] {
+		err := fmt.Errorf("cannot change '%s' (step changes %d files, limit %d): %w", p, len(paths), max, ErrTooManyFiles)
+		rejected = append(rejected, shared.RejectedWrite{Path: p, Reason: err.Error()})
+	}
+	return kept[:max], rejected
+}
+
+// RevertPaths restores paths in the worktree and index to their content at HEAD,
+// removing files that HEAD does not have. Used to drop staged changes that are
+// over the per-step file limit.
+func (s *GitService) RevertPaths(paths []string) error {
+	worktree, err := s.repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+	head, err := s.repo.Head()
+	if err != nil {
+		return fmt.Errorf("failed to get HEAD: %w", err)
+	}
+	tree, err := s.treeAt(head.Hash())
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		file, err := tree.File(p)
+		if errors.Is(err, object.ErrFileNotFound) {
+			if _, err := worktree.Remove(p); err != nil {
+				return fmt.Errorf("failed to remove '%s': %w", p, err)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load '%s' at HEAD: %w", p, err)
+		}
+		content, err := file.Contents()
+		if err != nil {
+			return fmt.Errorf("failed to read '%s' at HEAD: %w", p, err)
+		}
+		if err := s.writeFile(p, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MaxFilesPerStep returns the stricter of the worker-wide and .hammer.yaml limits
+// on files changed per step; 0 means unlimited.
+func (s *GitService) MaxFilesPerStep() int {
+	limit := s.policy.MaxFilesPerStep
+	if repo := s.RepoConfig().MaxFilesPerStep; repo > 0 && (limit == 0 || repo < limit) {
+		limit = repo
+	}
+	return limit
+}
@@ -0,0 +1,56 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeRepoPath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // Empty means the path is rejected
+	}{
+		{"main.go", "main.go"},
+		{"./pkg/a.go", "pkg/a.go"},
+		{"pkg//b/../a.go", "pkg/a.go"},
+		{`pkg\sub\a.go`, "pkg/sub/a.go"},
+		{"  docs/README.md ", "docs/README.md"},
+		{".github/workflows/ci.yml", ".github/workflows/ci.yml"},
+		{".gitignore", ".gitignore"},
+		{"src/.gitkeep", "src/.gitkeep"},
+
+		{"", ""},
+		{"   ", ""},
+		{".", ""},
+		{"..", ""},
+		{"../x", ""},
+		{"a/../../x", ""},
+		{`..\x`, ""},
+		{`a\..\..\x`, ""},
+		{"/etc/passwd", ""},
+		{`\etc\passwd`, ""},
+		{"C:/Windows/x", ""},
+		{`C:\Windows\x`, ""},
+		{"c:x", ""},
+		{".git/config", ""},
+		{".GIT/config", ""},
+		{".Git/hooks/pre-commit", ""},
+		{"sub/.git/config", ""},
+		{`sub\.git\HEAD`, ""},
+		{"a/./.git", ""},
+		{".git", ""},
+		{"a\x00b", ""},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeRepoPath(tt.in)
+		if tt.want == "" {
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Errorf("NormalizeRepoPath(%q) = %q, %v; want ErrUnsafePath", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("NormalizeRepoPath(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
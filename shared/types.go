@@ -1,39 +1,594 @@
 // shared/types.go
 package shared
 
+// Branch strategies controlling how generated commits land on the output branch.
+const (
+  BranchStrategyCommits = "commits" // Keep one commit per step (default)
+  BranchStrategySquash  = "squash"  // Squash all steps into a single commit
+  BranchStrategyRebase  = "rebase"  // Rebase per-step commits onto the latest base before pushing
+)
+
+// Conflict modes for the pre-push check against the latest base branch.
+const (
+  ConflictModeOff     = ""        // No check
+  ConflictModeReport  = "report"  // Report conflicting files but push unchanged
+  ConflictModeResolve = "resolve" // Merge the latest base, asking the generator to resolve conflicts
+)
+
+// Agent modes controlling how each step is carried out.
+const (
+  AgentModePipeline = ""      // Evaluate, read, generate and commit with fixed prompts (default)
+  AgentModeTools    = "tools" // A tool-calling agent explores and edits the worktree
+)
+
+// User roles. Each role includes the permissions of the roles above it.
+const (
+  RoleViewer    = "viewer"    // Sees run status
+  RoleSubmitter = "submitter" // Starts runs and cancels their own
+  RoleApprover  = "approver"  // Approves and cancels anyone's runs
+  RoleAdmin     = "admin"     // Everything
+)
+
+// Signal and query names for runs that wait for approval before pushing.
+const (
+  SignalApproveRun      = "approve-run"
+  QueryAwaitingApproval = "awaiting-approval"
+)
+
+// QueryUsage returns a run's LLM usage totals (UsageTotals). It also answers for
+// runs that failed, were terminated or timed out, whose result carries no usage.
+const QueryUsage = "usage"
+
+// User is an authenticated user of the web UI or API.
+type User struct {
+  ID    string
+  Name  string
+  Email string
+  Roles []string
+  Teams []string // Teams whose monthly budget the user's runs count toward
+}
+
+// RunBudget caps the LLM usage of one run. Zero means unlimited. Past
+// SoftPercent of a limit the run is flagged; at the limit it stops before its
+// next LLM call.
+type RunBudget struct {
+  MaxTokens   int
+  MaxCostUSD  float64
+  SoftPercent int
+}
+
+// RunSettings are the worker settings a run depends on. They are read from the
+// environment when the run is submitted, because workflow code must not read the
+// environment: a changed value would break the replay of runs in flight.
+type RunSettings struct {
+  Agent                AgentLimits
+  Selection            SelectionLimits
+  LLMCommitMessages    bool // Have the model write each step's commit message
+  ReviewMaxRevisions   int  // Self-review: extra generation attempts per step
+  ApprovalTimeoutHours int  // How long a run waits for approval before ending without a push
+}
+
+// SelectionLimits bound how much of the repository a single step may look at.
+type SelectionLimits struct {
+  HierarchicalThreshold int   // Above this many files, directories are selected first
+  MaxDirectories        int   // Directories the selector may pick per step
+  MaxFiles              int   // Files read per step (0 = unlimited)
+  MaxBytes              int64 // Bytes read per step (0 = unlimited)
+  MaxRelatedFiles       int   // Files added per step from the symbol index (0 = disabled)
+  SearchResults         int   // Content search hits shown to the evaluator (0 = disabled)
+}
+
+// AgentLimits bounds the tool-calling agent per step.
+type AgentLimits struct {
+  MaxIterations       int  // Model turns per step
+  MaxTokens           int  // Total tokens per step, as reported by the API
+  VerificationEnabled bool // Offer run_verification (the worker must also allow it)
+}
+
+// RunApproval is the payload of SignalApproveRun.
+type RunApproval struct {
+  ApprovedBy string // User ID
+}
+
 // WorkflowInput defines the input for the code generation workflow.
 type WorkflowInput struct {
-  UserPrompt string
-  RepoURL    string // URL of the repo to clone
+  UserPrompt     string
+  RepoURL        string // URL of the repo to clone
+  BranchStrategy string // One of the BranchStrategy* constants; empty means commits
+  BranchName     string // Optional output branch name; defaults to ai-<runID>
+  ForceUpdate    bool   // Overwrite an existing remote branch using force-with-lease
+  ConflictMode   string // One of the ConflictMode* constants
+  AgentMode      string // One of the AgentMode* constants
+  SelfReview     bool   // Review each generated step before committing it
+  PushPartial    bool   // If the run is canceled or stopped by its budget, push the steps committed so far
+  Budget         RunBudget
+  Settings       RunSettings
+
+  // Identity of the submitter and whether someone else must approve the push.
+  Requester       User // Recorded in the run's memo, search attributes and commit trailers
+  RequireApproval bool // Wait for SignalApproveRun before pushing
+
+  // Follow-up mode: continue work on a branch created by a previous run.
+  FollowUpBranch string   // Existing branch to check out instead of the default branch
+  PriorPrompt    string   // Prompt of the previous run, if known
+  PriorPlan      []string // Planned steps of the previous run, if known
+}
+
+// FollowUpContext describes a previous run that the current run builds on.
+type FollowUpContext struct {
+  Branch      string
+  PriorPrompt string
+  PriorSteps  []string
+  PriorDiff   string // Unified diff of the previous run's commits
+}
+
+// PlanStepsActivityInput defines input for the planning activity.
+type PlanStepsActivityInput struct {
+  UserPrompt      string
+  FollowUp        *FollowUpContext // Set when iterating on a previous run's branch
+  Conventions     string           // Repository coding conventions from .hammer.yaml
+  PromptOverrides PromptOverrides
+}
+
+// PlanStepsActivityResult defines the output of the planning activity.
+type PlanStepsActivityResult struct {
+  Steps []string
+  Usage []LLMUsage
+}
+
+// LLM call roles, recorded with each call's usage.
+const (
+  LLMRolePlan              = "plan"
+  LLMRoleEvaluate          = "evaluate"
+  LLMRoleSelectDirectories = "select_directories"
+  LLMRoleGenerate          = "generate"
+  LLMRoleReview            = "review"
+  LLMRoleCommitMessage     = "commit_message"
+  LLMRoleResolveConflict   = "resolve_conflict"
+  LLMRoleAgent             = "agent"
+)
+
+// LLMUsage records one LLM call.
+type LLMUsage struct {
+  Step             int    // 1-based step number, set by the workflow; 0 outside the steps
+  Role             string // One of the LLMRole* constants
+  Model            string
+  PromptTokens     int
+  CompletionTokens int
+  LatencyMs        int64
+  CostUSD          float64 // From the worker's price table; 0 for unpriced models
+  Cached           bool    // Answered from the response cache, at no token cost
+}
+
+// UsageTotals sums the usage of several LLM calls.
+type UsageTotals struct {
+  Calls            int
+  CachedCalls      int
+  PromptTokens     int
+  CompletionTokens int
+  LatencyMs        int64
+  CostUSD          float64
+}
+
+// Add counts one call.
+func (t *UsageTotals) Add(u LLMUsage) {
+  t.Calls++
+  if u.Cached {
+    t.CachedCalls++
+  }
+  t.PromptTokens += u.PromptTokens
+  t.CompletionTokens += u.CompletionTokens
+  t.LatencyMs += u.LatencyMs
+  t.CostUSD += u.CostUSD
+}
+
+// Tokens returns prompt plus completion tokens.
+func (t UsageTotals) Tokens() int {
+  return t.PromptTokens + t.CompletionTokens
+}
+
+// StepUsage is the LLM usage of one step.
+type StepUsage struct {
+  Step int
+  UsageTotals
+}
+
+// RunUsage is the LLM usage of a run, per call, per step and in total. Calls
+// outside the steps (planning, conflict resolution) only count toward the total.
+type RunUsage struct {
+  Calls []LLMUsage
+  Steps []StepUsage
+  Total UsageTotals
+}
+
+// Add records calls made for step (0 outside the steps).
+func (r *RunUsage) Add(step int, calls []LLMUsage) {
+  for _, c := range calls {
+    c.Step = step
+    r.Calls = append(r.Calls, c)
+    r.Total.Add(c)
+    if step == 0 {
+      continue
+    }
+    if n := len(r.Steps); n == 0 || r.Steps[n-1].Step != step {
+      r.Steps = append(r.Steps, StepUsage{Step: step})
+    }
+    r.Steps[len(r.Steps)-1].Add(c)
+  }
 }
 
 // WorkflowOutput defines the result of the workflow.
 type WorkflowOutput struct {
-  BranchName string
-  Message    string
+  BranchName            string
+  Message               string
+  SigningKeyFingerprint string // Empty when commits were not signed
+  UserPrompt            string   // Echoed so follow-up runs can reuse it
+  PlannedSteps          []string
+  MergeCheck            *MergeCheckOutcome // Set when a pre-push conflict check ran
+  RepoConfig            *RepoConfig        // Effective repository config used for the run
+  ContextReports        []ContextReport    // Per-step context budgeting, for steps that generated code
+  AgentSteps            []AgentStepSummary // Set in tool-calling agent mode
+  ChangeLog             []StepChange       // What each step changed
+  Reviews               []StepReview       // Self-review results, one per reviewed attempt
+  RejectedWrites        []RejectedWrite    // File writes refused by the write policy
+  SecretFindings        []SecretFinding    // Potential secrets in the generated changes
+  PushBlocked           bool               // The push was refused because of SecretFindings
+  RequestedBy           string             // User ID of the submitter
+  ApprovedBy            string             // User ID of the approver, if the run needed approval
+  InjectionFindings     []InjectionFinding // Repository text that looks like instructions to the model
+  ScopeFindings         []ScopeFinding     // Generated changes the step had no reason to make
+  Canceled              bool               // The run was canceled before finishing its steps or push
+  BudgetExceeded        bool               // The run stopped because it used up its budget
+  StepsCompleted        int                // Steps finished before a cancellation or budget stop
+  BudgetWarning         string             // Set once the run passed the soft budget limit
+  Usage                 *RunUsage          // LLM tokens, latency and cost
+  PRDescription         string             // Markdown description for a pull request of the branch
+}
+
+// MergeCheckOutcome reports the pre-push comparison with the latest base branch.
+type MergeCheckOutcome struct {
+  BaseMoved   bool
+  Conflicts   []string // Files changed both by the run and upstream
+  Resolved    []string // Conflicts resolved by the generator
+  Unresolved  []string // Conflicts left in place (report mode or failed resolution)
+  MergeCommit string   // Merge commit of the latest base, if one was created
 }
 
+// ConflictFile holds the three sides of a conflicting file. A missing side is
+// an empty string with its Exists flag unset.
+type ConflictFile struct {
+  Path                                 string
+  Base, Ours, Theirs                   string
+  BaseExists, OursExists, TheirsExists bool
+}
+
+// ResolveConflictActivityInput defines input for the conflict resolution activity.
+type ResolveConflictActivityInput struct {
+  File               ConflictFile
+  OriginalUserPrompt string
+  PromptOverrides    PromptOverrides
+}
+
+// ResolveConflictActivityResult defines the output of the conflict resolution activity.
+type ResolveConflictActivityResult struct {
+  Merged string
+  Usage  []LLMUsage
+}
+
+// RepoConfig is the per-repository configuration read from .hammer.yaml.
+type RepoConfig struct {
+  Conventions     string   `yaml:"conventions"`        // Coding conventions injected into prompts
+  BuildCommand    string   `yaml:"build_command"`
+  TestCommand     string   `yaml:"test_command"`
+  IgnorePaths     []string `yaml:"ignore_paths"`       // Globs excluded from file listings
+  ProtectedPaths  []string `yaml:"protected_paths"`    // Globs that may not be modified
+  MaxFilesPerStep int      `yaml:"max_files_per_step"` // 0 means unlimited
+  MaxFileBytes    int64    `yaml:"max_file_bytes"`     // Larger files are hidden from the LLM; 0 means the default
+  BranchPrefix    string   `yaml:"branch_prefix"`      // Overrides BRANCH_PREFIX
+  SecretAllowlist []string `yaml:"secret_allowlist"`   // Regexes; matching lines are never flagged as secrets
+}
+
+// PromptOverrides maps a prompt template name (e.g. "plan_steps.txt") to template
+// text supplied by the target repository.
+type PromptOverrides map[string]string
+
 // GenerateCodeActivityInput defines input for the code generation activity.
 type GenerateCodeActivityInput struct {
   StepDescription      string
   RelevantFilesContent map[string]string // map[filePath]content
+  FilePriority         []string          // Most important files first, for context budgeting
   OriginalUserPrompt   string            // Pass original prompt for context
+  PriorChanges         []StepChange      // What earlier steps of this run changed
+  Conventions          string            // Repository coding conventions from .hammer.yaml
+  Revision             *RevisionRequest  // Set when a review asked for another attempt
+  PromptOverrides      PromptOverrides
+}
+
+// Review finding severities, most serious first.
+const (
+  ReviewSeverityHigh   = "high"   // Wrong or broken; must be fixed
+  ReviewSeverityMedium = "medium" // Likely problem or missing part of the step
+  ReviewSeverityLow    = "low"    // Style or minor improvement
+)
+
+// ReviewFinding is one issue the reviewer found in a step's changes.
+type ReviewFinding struct {
+  Severity string // One of the ReviewSeverity* constants
+  File     string
+  Line     int // Line in the new file content; 0 if not specific
+  Message  string
+}
+
+// ReviewCodeActivityInput asks the reviewer to critique a step's generated changes.
+type ReviewCodeActivityInput struct {
+  StepDescription      string
+  OriginalUserPrompt   string
+  Conventions          string
+  Diff                 string            // Generated changes against HEAD
+  RelevantFilesContent map[string]string // Files the generator saw, as context
+  FilePriority         []string
+  PromptOverrides      PromptOverrides
+}
+
+// ReviewCodeActivityResult defines the output of the review activity.
+type ReviewCodeActivityResult struct {
+  Review ReviewResult
+  Usage  []LLMUsage
+}
+
+// ReviewResult is the reviewer's verdict on a step's changes.
+type ReviewResult struct {
+  Approved bool
+  Summary  string
+  Findings []ReviewFinding
+}
+
+// RevisionRequest carries a rejected attempt and its review back to the generator.
+type RevisionRequest struct {
+  Diff     string // The rejected attempt against HEAD
+  Summary  string
+  Findings []ReviewFinding
+}
+
+// StepReview records one review of a step in the run output.
+type StepReview struct {
+  Step    int // 1-based
+  Attempt int // 1 for the first generation, 2 after one revision, ...
+  ReviewResult
 }
 
 // GenerateCodeActivityResult defines the output of the code generation activity.
 type GenerateCodeActivityResult struct {
   GeneratedFiles map[string]string // map[filePath]newContent
+  Context        *ContextReport    // How the files were fitted into the prompt
+  Injections     []InjectionFinding // Suspicious text in the files shown to the model
+  Usage          []LLMUsage
+}
+
+// InjectionFinding is a line of repository content that looks like an attempt
+// to instruct the model.
+type InjectionFinding struct {
+  Step    int // 1-based; set by the workflow
+  File    string
+  Line    int
+  Rule    string // e.g. "ignore-instructions", "exfiltration"
+  Excerpt string
+}
+
+// ScopeFinding is a generated change to a file the step was not expected to touch.
+type ScopeFinding struct {
+  Step   int // 1-based; set by the workflow
+  File   string
+  Reason string
+}
+
+// ContextReport records how a step's files were fitted into the model's context window.
+type ContextReport struct {
+  Step   int // 1-based step number, set by the workflow
+  Model  string
+  Budget int // Tokens available for file contents
+  Used   int // Tokens of file contents actually sent
+  Files  []FileContext
+}
+
+// FileContext records the strategy used for one file.
+type FileContext struct {
+  Path           string
+  Strategy       string // full, relevant ranges, outline, head/tail or omitted
+  Tokens         int    // Estimated tokens sent
+  OriginalTokens int    // Estimated tokens of the whole file
+}
+
+// Reduced lists the files that were not sent in full, as "path (strategy)".
+func (r *ContextReport) Reduced() []string {
+  var reduced []string
+  for _, f := range r.Files {
+    if f.Strategy != "full" {
+      reduced = append(reduced, f.Path+" ("+f.Strategy+")")
+    }
+  }
+  return reduced
+}
+
+// AgentMessage is one message of a tool-calling agent conversation, after the
+// system prompt. Role is "assistant" or "tool".
+type AgentMessage struct {
+  Role       string
+  Content    string
+  ToolCalls  []AgentToolCall // Set on assistant messages that call tools
+  ToolCallID string          // Set on tool messages: the call being answered
+}
+
+// AgentToolCall is a tool invocation requested by the model.
+type AgentToolCall struct {
+  ID        string
+  Name      string
+  Arguments string // JSON object
+}
+
+// AgentTurnActivityInput asks the model for the next agent turn.
+type AgentTurnActivityInput struct {
+  StepDescription     string
+  OriginalUserPrompt  string
+  Conventions         string
+  PriorChanges        []StepChange
+  Revision            *RevisionRequest // Set when a review rejected the agent's changes so far
+  History             []AgentMessage
+  MaxIterations       int
+  VerificationEnabled bool
+  PromptOverrides     PromptOverrides
+}
+
+// AgentTurnActivityResult is the model's reply and the tokens the turn used.
+type AgentTurnActivityResult struct {
+  Message     AgentMessage
+  TotalTokens int
+  Usage       []LLMUsage
+}
+
+// AgentToolActivityInput executes one tool call against a workflow's worktree.
+type AgentToolActivityInput struct {
+  WorkflowID string
+  Call       AgentToolCall
+}
+
+// AgentStepSummary records how the tool-calling agent ran one step.
+type AgentStepSummary struct {
+  Step        int
+  Iterations  int
+  ToolCalls   int
+  TotalTokens int
+  StopReason  string // completed, max iterations or token budget
+  Summary     string // The agent's final message
+}
+
+// PendingChangesInput asks for the uncommitted changes in a workflow's worktree.
+type PendingChangesInput struct {
+  WorkflowID string
+}
+
+// PendingChangesResult lists the uncommitted changes in a worktree.
+type PendingChangesResult struct {
+  Written  map[string]string // path -> new content
+  Deleted  []string
+  Rejected []RejectedWrite // Writes refused by the write policy since the last call
+}
+
+// CommitPendingInput commits whatever the agent left staged in the worktree.
+type CommitPendingInput struct {
+  WorkflowID    string
+  CommitMessage string
+}
+
+// CommitPendingResult is the agent step's commit and the changes left out of it.
+type CommitPendingResult struct {
+  CommitHash string          // Empty if there was nothing to commit
+  Rejected   []RejectedWrite // Changes over the per-step file limit, reverted instead of committed
+}
+
+// GenerateCommitMessageActivityInput defines input for the commit message activity.
+type GenerateCommitMessageActivityInput struct {
+  StepDescription    string
+  Diff               string // Unified diff of the step's changes
+  OriginalUserPrompt string
+  PromptOverrides    PromptOverrides
+}
+
+// GenerateCommitMessageActivityResult defines the output of the commit message activity.
+type GenerateCommitMessageActivityResult struct {
+  Message string
+  Usage   []LLMUsage
 }
 
 // EvaluateFilesActivityInput defines input for the file evaluation activity.
 type EvaluateFilesActivityInput struct {
   StepDescription string
   AllFiles        []string // List of all files currently in the repo
+  SearchHits      []SearchHit // Content search results for the step, best first
+  PriorChanges    []StepChange // What earlier steps of this run changed
+  PromptOverrides PromptOverrides
+}
+
+// StepChange records what one completed step changed, so later steps can build on it.
+type StepChange struct {
+  Step        int // 1-based
+  Description string
+  Summary     string // Commit subject, or the agent's own summary in tool-calling mode
+  Files       []FileChangeSummary
+}
+
+// FileChangeSummary describes the change to one file in a step's commit.
+type FileChangeSummary struct {
+  Path           string
+  Status         string // "added", "modified" or "deleted"
+  LinesAdded     int
+  LinesRemoved   int
+  SymbolsAdded   []string // Top-level definitions new in this commit
+  SymbolsRemoved []string
+}
+
+// SummarizeCommitInput asks for a FileChangeSummary of each file a commit changed.
+type SummarizeCommitInput struct {
+  WorkflowID string
+  CommitHash string
+}
+
+// SearchHit is one file matched by the lexical search index.
+type SearchHit struct {
+  File    string
+  Score   float64
+  Snippet string // Best matching line
+}
+
+// SearchFilesInput queries the lexical search index of a workflow's worktree.
+type SearchFilesInput struct {
+  WorkflowID string
+  Query      string
+  Limit      int
+}
+
+// DirectorySummary describes one directory group for hierarchical file selection.
+type DirectorySummary struct {
+  Path        string   // Directory key; "." for root-level files
+  FileCount   int      // Files in the directory and its collapsed subdirectories
+  Extensions  string   // e.g. ".go x12, .md x1"
+  SampleFiles []string // A few file names, relative to Path
+  Description string   // First line of a README or package comment, if any
+}
+
+// SymbolDef is a symbol definition found by the local symbol index.
+type SymbolDef struct {
+  Name string // e.g. "GitService", "GitService.Commit", "process_order"
+  Kind string // package, type, func, method, var, const, class, function
+  File string
+  Line int
+}
+
+// RelatedFilesInput asks for files connected to a selection through shared symbols.
+type RelatedFilesInput struct {
+  WorkflowID string
+  Files      []string
+  MaxFiles   int
+}
+
+// SelectDirectoriesActivityInput defines input for the directory selection activity.
+type SelectDirectoriesActivityInput struct {
+  StepDescription string
+  Directories     []DirectorySummary
+  MaxDirectories  int
+  PromptOverrides PromptOverrides
+}
+
+// SelectDirectoriesActivityResult defines the output of the directory selection activity.
+type SelectDirectoriesActivityResult struct {
+  Directories []string
+  Usage       []LLMUsage
 }
 
 // EvaluateFilesActivityResult defines the output of the file evaluation activity.
 type EvaluateFilesActivityResult struct {
   RelevantFiles []string
+  Usage         []LLMUsage
 }
 
 // --- Input structs for stateful Git activities ---
@@ -45,9 +600,19 @@ type GitCredentials struct {
 }
 
 type InitGitActivityInput struct {
-  WorkflowID  string
-  RepoURL     string
-  Credentials GitCredentials
+  WorkflowID     string
+  RepoURL        string
+  Credentials    GitCredentials
+  FollowUpBranch string // Optional existing branch to check out after cloning
+  OutputBranch   string // Explicit output branch; validated and its remote tip recorded for force-with-lease
+  CommitTrailers []string // Appended to every commit message, e.g. "Requested-by: ..."
+}
+type InitGitActivityResult struct {
+  SigningKeyFingerprint string   // Empty when commit signing is disabled
+  PriorSteps            []string // Follow-up only: steps found in the branch's commits
+  PriorDiff             string   // Follow-up only: diff of the previous run's commits
+  PromptOverrides       PromptOverrides // Prompt templates found in the target repository
+  RepoConfig            *RepoConfig     // Validated .hammer.yaml (empty if absent)
 }
 type CleanupGitActivityInput struct {
   WorkflowID string
@@ -57,18 +622,85 @@ type ListFilesGitActivityInput struct {
 }
 type ReadFilesGitActivityInput struct {
   WorkflowID string
-  FilePaths  []string
+  FilePaths  []string // In priority order; later files are dropped first when over budget
+  MaxFiles   int      // 0 means unlimited
+  MaxBytes   int64    // 0 means unlimited
+}
+type SummarizeDirectoriesInput struct {
+  WorkflowID string
+  Files      []string
+}
+// RejectedWrite is a file write refused by the write policy.
+type RejectedWrite struct {
+  Step   int    // 1-based; set by the workflow
+  Path   string // As given by the model
+  Reason string
+}
+
+// WriteAndCommitResult is the step's commit and any writes the policy refused.
+type WriteAndCommitResult struct {
+  CommitHash     string
+  Rejected       []RejectedWrite
+  SecretFindings []SecretFinding // Credential-looking strings added by the step
+}
+
+// SecretFinding is a line that looks like it adds a credential.
+type SecretFinding struct {
+  Step  int // 1-based; 0 for findings of the final branch scan
+  File  string
+  Line  int
+  Rule  string // e.g. "aws-access-key", "high-entropy-string"
+  Match string // Redacted
+}
+
+// ScanBranchInput asks for a secret scan of everything the run changed.
+type ScanBranchInput struct {
+  WorkflowID string
 }
+
 type WriteAndCommitInput struct {
   WorkflowID    string
   Changes       map[string]string // file -> content
   CommitMessage string
 }
+type DiffChangesGitActivityInput struct {
+  WorkflowID string
+  Changes    map[string]string // file -> content
+}
 type CreateBranchInput struct {
   WorkflowID string
   BranchName string
 }
 type PushBranchActivityInput struct {
-  WorkflowID  string
-  BranchName  string
+  WorkflowID     string
+  BranchName     string
+  ForceWithLease bool
+}
+type CheckMergeConflictsInput struct {
+  WorkflowID string
+}
+type CheckMergeConflictsResult struct {
+  UpstreamHash string
+  BaseMoved    bool
+  Conflicts    []string
+}
+type ReadConflictFileInput struct {
+  WorkflowID   string
+  Path         string
+  UpstreamHash string
+}
+type MergeUpstreamInput struct {
+  WorkflowID    string
+  UpstreamHash  string
+  Resolutions   map[string]string // file -> merged content
+  CommitMessage string
+}
+type ApplyBranchStrategyInput struct {
+  WorkflowID    string
+  Strategy      string
+  SquashMessage string // Commit message used by the squash strategy
+}
+type ApplyBranchStrategyResult struct {
+  HeadHash  string
+  Conflicts []string // Files that blocked a rebase; HEAD is unchanged when set
 }
@@ -1,18 +1,21 @@
 package workflows
 
 import (
+  "errors"
   "fmt"
   "time"
   "os"
+  "strings"
 
   "hammer/shared"
   "hammer/activities"
+  "hammer/services"
   "go.temporal.io/sdk/workflow"
   "go.temporal.io/sdk/temporal"
 )
 
 // CodeGenWorkflow orchestrates the multi-agent code generation process.
-func CodeGenWorkflow(ctx workflow.Context, input shared.WorkflowInput) (*shared.WorkflowOutput, error) {
+func CodeGenWorkflow(ctx workflow.Context, input shared.WorkflowInput) (result *shared.WorkflowOutput, err error) {
   // Workflow options (timeouts, retries)
   ao := workflow.ActivityOptions{
     StartToCloseTimeout: time.Minute * 5, // Adjust as needed for LLM calls
@@ -24,9 +27,15 @@ func CodeGenWorkflow(ctx workflow.Context, input shared.WorkflowInput) (*shared.
     },
   }
   ctx = workflow.WithActivityOptions(ctx, ao)
+  usage := &usageTracker{budget: input.Budget}
+  ctx = workflow.WithValue(ctx, usageTrackerKey{}, usage)
+  // The web process charges runs that end without a result from this query.
+  if err := workflow.SetQueryHandler(ctx, shared.QueryUsage, func() (shared.UsageTotals, error) { return usage.Total, nil }); err != nil {
+    return nil, fmt.Errorf("failed to register usage query: %w", err)
+  }
 
   logger := workflow.GetLogger(ctx)
-  logger.Info("CodeGenWorkflow started", "Prompt", input.UserPrompt, "RepoURL", input.RepoURL)
+  logger.Info("CodeGenWorkflow started", "Prompt", input.UserPrompt, "RepoURL", input.RepoURL, "BranchStrategy", input.BranchStrategy)
   workflowID := workflow.GetInfo(ctx).WorkflowExecution.ID
 
   gitUsername := os.Getenv("GIT_USERNAME")
@@ -37,25 +46,41 @@ func CodeGenWorkflow(ctx workflow.Context, input shared.WorkflowInput) (*shared.
     // return nil, workflow.NewApplicationError("Configuration error: Git credentials not provided", "GIT_CREDS_MISSING", nil)
   }
 
+  useLLMCommitMessages := input.Settings.LLMCommitMessages
+  budget := input.Settings.Selection
+  agentLimits := input.Settings.Agent
+  maxRevisions := input.Settings.ReviewMaxRevisions // Self-review: extra generation attempts per step
+
   gitCreds := shared.GitCredentials{
     Username: gitUsername,
     Password: gitPassword,
   }
 
+  // Runs that need approval report whether they are waiting for it.
+  awaitingApproval := false
+  if err := workflow.SetQueryHandler(ctx, shared.QueryAwaitingApproval, func() (bool, error) { return awaitingApproval, nil }); err != nil {
+    return nil, fmt.Errorf("failed to register approval query: %w", err)
+  }
+
   // Activity input structs need the WorkflowID
   initGitInput := shared.InitGitActivityInput{
-    WorkflowID:   workflowID,
-    RepoURL:      input.RepoURL,
-    Credentials:  gitCreds,
+    WorkflowID:     workflowID,
+    RepoURL:        input.RepoURL,
+    Credentials:    gitCreds,
+    FollowUpBranch: input.FollowUpBranch,
+    OutputBranch:   input.BranchName,
+    CommitTrailers: requesterTrailers(input.Requester),
   }
-  err := workflow.ExecuteActivity(ctx, "InitGitActivity", initGitInput).Get(ctx, nil)
+  var initGitResult shared.InitGitActivityResult
+  err = workflow.ExecuteActivity(ctx, "InitGitActivity", initGitInput).Get(ctx, &initGitResult)
   if err != nil {
       logger.Error("Failed to initialize Git repository for workflow.", "Error", err)
       return nil, fmt.Errorf("git initialization failed: %w", err)
   }
-  // Ensure cleanup happens even if workflow fails mid-way
+  // Ensure cleanup happens even if workflow fails mid-way. A canceled run's context
+  // no longer runs activities, so cleanup uses a disconnected one.
   defer func() {
-    deferCtx := ctx
+    deferCtx, _ := workflow.NewDisconnectedContext(ctx)
     cleanupInput := shared.CleanupGitActivityInput{WorkflowID: workflowID}
     err := workflow.ExecuteActivity(deferCtx, activities.ActivityName_CleanupGit, cleanupInput).Get(deferCtx, nil)
     // Log error, but don't fail the workflow if cleanup fails
@@ -68,8 +93,30 @@ func CodeGenWorkflow(ctx workflow.Context, input shared.WorkflowInput) (*shared.
 
   // 1. Planning Agent
   var plannedSteps []string
-  planActivityInput := input.UserPrompt // Direct input for this one
-  err = workflow.ExecuteActivity(ctx, "PlanStepsActivity", planActivityInput).Get(ctx, &plannedSteps)
+  promptOverrides := initGitResult.PromptOverrides
+  repoConfig := effectiveRepoConfig(initGitResult.RepoConfig)
+  planActivityInput := shared.PlanStepsActivityInput{
+    UserPrompt:      input.UserPrompt,
+    Conventions:     repoConfig.Conventions,
+    PromptOverrides: promptOverrides,
+  }
+  if input.FollowUpBranch != "" {
+    priorSteps := input.PriorPlan
+    if len(priorSteps) == 0 {
+      priorSteps = initGitResult.PriorSteps // Fall back to the steps recorded in commit messages
+    }
+    planActivityInput.FollowUp = &shared.FollowUpContext{
+      Branch:      input.FollowUpBranch,
+      PriorPrompt: input.PriorPrompt,
+      PriorSteps:  priorSteps,
+      PriorDiff:   initGitResult.PriorDiff,
+    }
+    logger.Info("Follow-up run on existing branch.", "Branch", input.FollowUpBranch, "PriorSteps", len(priorSteps))
+  }
+  var planResult shared.PlanStepsActivityResult
+  err = workflow.ExecuteActivity(ctx, "PlanStepsActivity", planActivityInput).Get(ctx, &planResult)
+  recordUsage(ctx, planResult.Usage, err)
+  plannedSteps = planResult.Steps
   if err != nil {
     logger.Error("Planning activity failed.", "Error", err)
     return nil, fmt.Errorf("planning failed: %w", err)
@@ -83,10 +130,131 @@ func CodeGenWorkflow(ctx workflow.Context, input shared.WorkflowInput) (*shared.
 
 
   // --- Loop through steps: Evaluate -> Generate -> Apply ---
+  var stepCommitMessages []string // Used to build the squash commit message
+  var contextReports []shared.ContextReport
+  var agentSteps []shared.AgentStepSummary
+  var changeLog []shared.StepChange // What each committed step changed, for later steps' prompts
+  var reviews []shared.StepReview
+  var rejectedWrites []shared.RejectedWrite // Writes refused by the write policy
+  var secretFindings []shared.SecretFinding
+  var injectionFindings []shared.InjectionFinding // Suspicious text in files shown to the generator
+  var scopeFindings []shared.ScopeFinding         // Generated changes outside the step's files
+  var lastCommitHash string
+
+  // A run that is canceled or runs out of budget reports how far it got instead
+  // of the interrupted activity's error, and pushes the steps it committed if the
+  // submitter asked for that.
+  stepsCompleted := 0
+  createdBranch := false // The output branch exists in the clone
+  defer func() {
+    canceled := err != nil && ctx.Err() != nil
+    overBudget := errors.Is(err, errBudgetExceeded)
+    if !canceled && !overBudget {
+      return
+    }
+    logger.Info("Run stopped early.", "Canceled", canceled, "StepsCompleted", stepsCompleted, "Error", err)
+    partial := &shared.WorkflowOutput{
+      SigningKeyFingerprint: initGitResult.SigningKeyFingerprint,
+      UserPrompt:            input.UserPrompt,
+      PlannedSteps:          plannedSteps,
+      RepoConfig:            repoConfig,
+      ContextReports:        contextReports,
+      AgentSteps:            agentSteps,
+      ChangeLog:             changeLog,
+      Reviews:               reviews,
+      RejectedWrites:        rejectedWrites,
+      SecretFindings:        secretFindings,
+      RequestedBy:           input.Requester.ID,
+      InjectionFindings:     injectionFindings,
+      ScopeFindings:         scopeFindings,
+      Usage:                 &usage.RunUsage,
+      BudgetWarning:         usage.warning,
+    }
+    headline := fmt.Sprintf("Canceled after step %d of %d.", stepsCompleted, len(plannedSteps))
+    if canceled {
+      partial.Canceled = true
+    } else {
+      partial.BudgetExceeded = true
+      headline = fmt.Sprintf("Stopped after step %d of %d: %v.", stepsCompleted, len(plannedSteps), budgetReason(err))
+    }
+    cleanupCtx, _ := workflow.NewDisconnectedContext(ctx)
+    hasCredentials := gitUsername != "" && gitPassword != ""
+    result, err = finishPartial(cleanupCtx, workflowID, input, partial, headline, stepsCompleted, outputBranchName(ctx, input, repoConfig), createdBranch, hasCredentials), nil
+  }()
+
   for i, step := range plannedSteps {
     stepNum := i + 1
+    stepsCompleted = i
+    usage.step = stepNum
+    if ctx.Err() != nil {
+      return nil, ctx.Err()
+    }
     logger.Info("Starting step", "Number", stepNum, "Description", step)
 
+    if input.AgentMode == shared.AgentModeTools {
+      summary, err := runToolAgent(ctx, workflowID, step, input.UserPrompt, repoConfig.Conventions, changeLog, nil, agentLimits, promptOverrides)
+      if err != nil {
+        logger.Error("Tool-calling agent failed.", "Step", stepNum, "Error", err)
+        return nil, fmt.Errorf("agent failed for step %d: %w", stepNum, err)
+      }
+      summary.Step = stepNum
+      logger.Info("Agent finished step.", "Step", stepNum, "StopReason", summary.StopReason, "Iterations", summary.Iterations, "ToolCalls", summary.ToolCalls)
+
+      var pending shared.PendingChangesResult
+      if err := workflow.ExecuteActivity(ctx, activities.ActivityName_PendingChanges, shared.PendingChangesInput{WorkflowID: workflowID}).Get(ctx, &pending); err != nil {
+        return nil, fmt.Errorf("failed to read agent changes for step %d: %w", stepNum, err)
+      }
+      rejectedWrites = appendRejectedWrites(ctx, rejectedWrites, stepNum, pending.Rejected)
+      // The agent revises its staged changes in place until the reviewer approves.
+      for attempt := 1; input.SelfReview && len(pending.Written) > 0; attempt++ {
+        review, revision := selfReview(ctx, workflowID, stepNum, attempt, step, input.UserPrompt, repoConfig.Conventions, pending.Written, nil, nil, maxRevisions, promptOverrides)
+        if review != nil {
+          reviews = append(reviews, *review)
+        }
+        if revision == nil {
+          break
+        }
+        more, err := runToolAgent(ctx, workflowID, step, input.UserPrompt, repoConfig.Conventions, changeLog, revision, agentLimits, promptOverrides)
+        if err != nil {
+          logger.Error("Tool-calling agent failed during revision.", "Step", stepNum, "Error", err)
+          return nil, fmt.Errorf("agent revision failed for step %d: %w", stepNum, err)
+        }
+        summary.Iterations += more.Iterations
+        summary.ToolCalls += more.ToolCalls
+        summary.TotalTokens += more.TotalTokens
+        summary.StopReason = more.StopReason
+        if more.Summary != "" {
+          summary.Summary = more.Summary
+        }
+        pending = shared.PendingChangesResult{}
+        if err := workflow.ExecuteActivity(ctx, activities.ActivityName_PendingChanges, shared.PendingChangesInput{WorkflowID: workflowID}).Get(ctx, &pending); err != nil {
+          return nil, fmt.Errorf("failed to read agent changes for step %d: %w", stepNum, err)
+        }
+        rejectedWrites = appendRejectedWrites(ctx, rejectedWrites, stepNum, pending.Rejected)
+      }
+      agentSteps = append(agentSteps, *summary)
+      if len(pending.Written) == 0 && len(pending.Deleted) == 0 {
+        logger.Info("Agent made no file changes for this step.", "Step", stepNum)
+        continue
+      }
+      commitMsg := stepCommitMessage(ctx, workflowID, stepNum, len(plannedSteps), step, input.UserPrompt, pending.Written, useLLMCommitMessages, promptOverrides)
+      var commitResult shared.CommitPendingResult
+      commitInput := shared.CommitPendingInput{WorkflowID: workflowID, CommitMessage: commitMsg}
+      if err := workflow.ExecuteActivity(ctx, activities.ActivityName_CommitPending, commitInput).Get(ctx, &commitResult); err != nil {
+        logger.Error("Failed to commit agent changes.", "Step", stepNum, "Error", err)
+        return nil, fmt.Errorf("failed to commit changes for step %d: %w", stepNum, err)
+      }
+      rejectedWrites = appendRejectedWrites(ctx, rejectedWrites, stepNum, commitResult.Rejected)
+      commitHash := commitResult.CommitHash
+      logger.Info("Committed agent changes.", "Step", stepNum, "CommitHash", commitHash)
+      stepCommitMessages = append(stepCommitMessages, commitMsg)
+      if commitHash != "" && commitHash != lastCommitHash {
+        changeLog = append(changeLog, recordStepChange(ctx, workflowID, stepNum, step, summary.Summary, commitHash))
+        lastCommitHash = commitHash
+      }
+      continue
+    }
+
     // 2a. Evaluation Agent - Get all current files first
     listFilesInput := shared.ListFilesGitActivityInput{WorkflowID: workflowID}
     var allFiles []string
@@ -96,19 +264,59 @@ func CodeGenWorkflow(ctx workflow.Context, input shared.WorkflowInput) (*shared.
          return nil, fmt.Errorf("failed to list files for step %d: %w", stepNum, err)
      }
 
+    // Large repositories are narrowed to a few directories before file evaluation.
+    candidateFiles := allFiles
+    if len(allFiles) > budget.HierarchicalThreshold {
+      candidateFiles, err = selectCandidateFiles(ctx, workflowID, step, allFiles, budget, promptOverrides)
+      if err != nil {
+        logger.Error("Directory selection failed.", "Step", stepNum, "Error", err)
+        return nil, fmt.Errorf("directory selection failed for step %d: %w", stepNum, err)
+      }
+    }
+
+    // Search file contents for the step so the evaluator can rank beyond file names.
+    var searchHits []shared.SearchHit
+    if budget.SearchResults > 0 {
+      searchInput := shared.SearchFilesInput{WorkflowID: workflowID, Query: step, Limit: budget.SearchResults}
+      if err := workflow.ExecuteActivity(ctx, activities.ActivityName_SearchFiles, searchInput).Get(ctx, &searchHits); err != nil {
+        logger.Warn("Content search failed; evaluating by file names only.", "Step", stepNum, "Error", err)
+      }
+      candidateFiles = withSearchHits(candidateFiles, searchHits)
+    }
+
     // Now evaluate which files are relevant
     evalInput := shared.EvaluateFilesActivityInput{
       StepDescription: step,
-      AllFiles:        allFiles,
+      AllFiles:        candidateFiles,
+      SearchHits:      searchHits,
+      PriorChanges:    changeLog,
+      PromptOverrides: promptOverrides,
     }
     var evalResult shared.EvaluateFilesActivityResult // Pointer removed, Get populates directly
+    if err := checkBudget(ctx); err != nil {
+      return nil, fmt.Errorf("stopped before evaluating step %d: %w", stepNum, err)
+    }
     err = workflow.ExecuteActivity(ctx, "EvaluateFilesActivity", evalInput).Get(ctx, &evalResult)
+    recordUsage(ctx, evalResult.Usage, err)
     if err != nil {
       logger.Error("Evaluation activity failed.", "Step", stepNum, "Error", err)
       return nil, fmt.Errorf("evaluation failed for step %d: %w", stepNum, err)
     }
     logger.Info("Evaluation complete.", "Step", stepNum, "RelevantFiles", evalResult.RelevantFiles)
 
+    // Add files connected to the selection through the symbol index. They go last so
+    // the read budget drops them before anything the evaluator picked.
+    if len(evalResult.RelevantFiles) > 0 && budget.MaxRelatedFiles > 0 {
+      var related []string
+      relatedInput := shared.RelatedFilesInput{WorkflowID: workflowID, Files: evalResult.RelevantFiles, MaxFiles: budget.MaxRelatedFiles}
+      if err := workflow.ExecuteActivity(ctx, activities.ActivityName_RelatedFiles, relatedInput).Get(ctx, &related); err != nil {
+        logger.Warn("Symbol index lookup failed; continuing with evaluated files only.", "Step", stepNum, "Error", err)
+      } else if len(related) > 0 {
+        logger.Info("Added related files from symbol index.", "Step", stepNum, "RelatedFiles", related)
+        evalResult.RelevantFiles = append(evalResult.RelevantFiles, related...)
+      }
+    }
+
 
     // 2b. Read Relevant Files (using Git Activity)
     readFileContent := make(map[string]string) // Default to empty map
@@ -116,6 +324,8 @@ func CodeGenWorkflow(ctx workflow.Context, input shared.WorkflowInput) (*shared.
         readFilesInput := shared.ReadFilesGitActivityInput{
             WorkflowID: workflowID,
             FilePaths: evalResult.RelevantFiles,
+            MaxFiles:   budget.MaxFiles,
+            MaxBytes:   budget.MaxBytes,
         }
         err = workflow.ExecuteActivity(ctx, "ReadFilesGitActivity", readFilesInput).Get(ctx, &readFileContent)
         if err != nil {
@@ -128,17 +338,47 @@ func CodeGenWorkflow(ctx workflow.Context, input shared.WorkflowInput) (*shared.
     }
 
 
-    // 2c. Code Generation Agent
+    // 2c. Code Generation Agent, optionally revised until the self-review approves
     genCodeInput := shared.GenerateCodeActivityInput{
       StepDescription:      step,
       RelevantFilesContent: readFileContent,
+      FilePriority:         evalResult.RelevantFiles,
       OriginalUserPrompt:   input.UserPrompt, // Provide original context
+      Conventions:          repoConfig.Conventions,
+      PriorChanges:         changeLog,
+      PromptOverrides:      promptOverrides,
     }
-    var genCodeResult shared.GenerateCodeActivityResult // Pointer removed
-    err = workflow.ExecuteActivity(ctx, "GenerateCodeActivity", genCodeInput).Get(ctx, &genCodeResult)
-    if err != nil {
-      logger.Error("Code generation activity failed.", "Step", stepNum, "Error", err)
-      return nil, fmt.Errorf("code generation failed for step %d: %w", stepNum, err)
+    var genCodeResult shared.GenerateCodeActivityResult
+    for attempt := 1; ; attempt++ {
+      genCodeResult = shared.GenerateCodeActivityResult{}
+      if err := checkBudget(ctx); err != nil {
+        return nil, fmt.Errorf("stopped before generating step %d: %w", stepNum, err)
+      }
+      err = workflow.ExecuteActivity(ctx, "GenerateCodeActivity", genCodeInput).Get(ctx, &genCodeResult)
+      recordUsage(ctx, genCodeResult.Usage, err)
+      if err != nil {
+        logger.Error("Code generation activity failed.", "Step", stepNum, "Attempt", attempt, "Error", err)
+        return nil, fmt.Errorf("code generation failed for step %d: %w", stepNum, err)
+      }
+      if !input.SelfReview || len(genCodeResult.GeneratedFiles) == 0 {
+        break
+      }
+      review, revision := selfReview(ctx, workflowID, stepNum, attempt, step, input.UserPrompt, repoConfig.Conventions, genCodeResult.GeneratedFiles, readFileContent, evalResult.RelevantFiles, maxRevisions, promptOverrides)
+      if review != nil {
+        reviews = append(reviews, *review)
+      }
+      if revision == nil {
+        break
+      }
+      genCodeInput.Revision = revision
+    }
+    injectionFindings = appendInjectionFindings(ctx, injectionFindings, stepNum, genCodeResult.Injections)
+    if genCodeResult.Context != nil {
+      genCodeResult.Context.Step = stepNum
+      contextReports = append(contextReports, *genCodeResult.Context)
+      if reduced := genCodeResult.Context.Reduced(); len(reduced) > 0 {
+        logger.Info("Files reduced to fit the context window.", "Step", stepNum, "Files", reduced)
+      }
     }
      if len(genCodeResult.GeneratedFiles) == 0 {
          logger.Info("Code generation produced no file changes for this step.", "Step", stepNum)
@@ -147,32 +387,138 @@ func CodeGenWorkflow(ctx workflow.Context, input shared.WorkflowInput) (*shared.
      }
     logger.Info("Code generation complete.", "Step", stepNum, "FilesChanged", len(genCodeResult.GeneratedFiles))
 
+    // Flag changes to files the step did not select and the plan does not mention;
+    // they may come from instructions planted in repository content.
+    changedFiles := make([]string, 0, len(genCodeResult.GeneratedFiles))
+    for f := range genCodeResult.GeneratedFiles {
+      changedFiles = append(changedFiles, f)
+    }
+    for _, f := range services.CheckChangeScope(changedFiles, evalResult.RelevantFiles, allFiles, input.UserPrompt, step, plannedSteps) {
+      logger.Warn("Generated change outside the step's scope.", "Step", stepNum, "File", f.File, "Reason", f.Reason)
+      f.Step = stepNum
+      scopeFindings = append(scopeFindings, f)
+    }
+
 
     // 2d. Apply Changes (Write files and commit via Git Activity)
-    commitMsg := fmt.Sprintf("AI Agent: Apply step %d/%d: %s", stepNum, len(plannedSteps), step)
-    // Ensure commit message is concise if step description is long
-    if len(commitMsg) > 100 {
-        commitMsg = commitMsg[:97] + "..."
-    }
+    commitMsg := stepCommitMessage(ctx, workflowID, stepNum, len(plannedSteps), step, input.UserPrompt, genCodeResult.GeneratedFiles, useLLMCommitMessages, promptOverrides)
 
     applyInput := shared.WriteAndCommitInput{
         WorkflowID: workflowID,
         Changes: genCodeResult.GeneratedFiles,
         CommitMessage: commitMsg,
     }
-    var commitHash string
-    err = workflow.ExecuteActivity(ctx, "WriteFilesAndCommitActivity", applyInput).Get(ctx, &commitHash)
+    var writeResult shared.WriteAndCommitResult
+    err = workflow.ExecuteActivity(ctx, "WriteFilesAndCommitActivity", applyInput).Get(ctx, &writeResult)
     if err != nil {
       logger.Error("Failed to apply changes and commit.", "Step", stepNum, "Error", err)
       return nil, fmt.Errorf("failed to apply changes for step %d: %w", stepNum, err)
     }
+    rejectedWrites = appendRejectedWrites(ctx, rejectedWrites, stepNum, writeResult.Rejected)
+    for _, f := range writeResult.SecretFindings {
+      logger.Warn("Potential secret in step changes.", "Step", stepNum, "File", f.File, "Line", f.Line, "Rule", f.Rule)
+      f.Step = stepNum
+      secretFindings = append(secretFindings, f)
+    }
+    commitHash := writeResult.CommitHash
     logger.Info("Successfully applied and committed changes.", "Step", stepNum, "CommitHash", commitHash)
+    stepCommitMessages = append(stepCommitMessages, commitMsg)
+    if commitHash != "" && commitHash != lastCommitHash {
+      firstLine, _, _ := strings.Cut(commitMsg, "\n")
+      changeLog = append(changeLog, recordStepChange(ctx, workflowID, stepNum, step, firstLine, commitHash))
+      lastCommitHash = commitHash
+    }
   } // End of steps loop
+  stepsCompleted = len(plannedSteps)
+  usage.step = 0
+
+
+  // 2e. Apply Branch Strategy (squash or rebase the generated commits)
+  var strategyNote string
+  if input.BranchStrategy != "" && input.BranchStrategy != shared.BranchStrategyCommits {
+    strategyInput := shared.ApplyBranchStrategyInput{
+      WorkflowID:    workflowID,
+      Strategy:      input.BranchStrategy,
+      SquashMessage: squashCommitMessage(input.UserPrompt, stepCommitMessages),
+    }
+    var strategyResult shared.ApplyBranchStrategyResult
+    err = workflow.ExecuteActivity(ctx, activities.ActivityName_ApplyBranchStrategy, strategyInput).Get(ctx, &strategyResult)
+    if err != nil {
+      logger.Error("Failed to apply branch strategy.", "Strategy", input.BranchStrategy, "Error", err)
+      return nil, fmt.Errorf("failed to apply branch strategy %q: %w", input.BranchStrategy, err)
+    }
+    if len(strategyResult.Conflicts) > 0 {
+      logger.Warn("Rebase skipped due to conflicts with the latest base.", "Conflicts", strategyResult.Conflicts)
+      strategyNote = fmt.Sprintf(" Rebase onto latest base skipped; conflicting files: %s.", strings.Join(strategyResult.Conflicts, ", "))
+    } else {
+      logger.Info("Applied branch strategy.", "Strategy", input.BranchStrategy, "Head", strategyResult.HeadHash)
+      strategyNote = fmt.Sprintf(" Branch strategy: %s.", input.BranchStrategy)
+    }
+  }
+
+
+  // 2f. Pre-push Conflict Check against the latest base branch
+  var mergeCheck *shared.MergeCheckOutcome
+  if input.ConflictMode != shared.ConflictModeOff {
+    mergeCheck, err = checkMergeConflicts(ctx, workflowID, input, promptOverrides)
+    if err != nil {
+      logger.Warn("Pre-push conflict check failed; continuing without it.", "Error", err)
+    } else if len(mergeCheck.Unresolved) > 0 {
+      strategyNote += fmt.Sprintf(" Conflicts with latest base: %s.", strings.Join(mergeCheck.Unresolved, ", "))
+    } else if mergeCheck.MergeCommit != "" {
+      strategyNote += fmt.Sprintf(" Merged latest base (%d conflict(s) resolved).", len(mergeCheck.Resolved))
+    }
+  }
+
+  if len(rejectedWrites) > 0 {
+    strategyNote += fmt.Sprintf(" %d file write(s) rejected by the write policy.", len(rejectedWrites))
+  }
+  // 2g. Secret scan of everything the run changed. Findings from any step block the
+  // push, since intermediate commits are pushed too.
+  var branchFindings []shared.SecretFinding
+  if err := workflow.ExecuteActivity(ctx, activities.ActivityName_ScanBranch, shared.ScanBranchInput{WorkflowID: workflowID}).Get(ctx, &branchFindings); err != nil {
+    logger.Warn("Secret scan of the branch failed; the push activity scans again.", "Error", err)
+  }
+  secretFindings = mergeSecretFindings(secretFindings, branchFindings)
+  pushBlocked := len(secretFindings) > 0
+  if pushBlocked {
+    logger.Warn("Potential secrets found; the branch will not be pushed.", "Findings", len(secretFindings))
+    strategyNote += fmt.Sprintf(" Push blocked: %d potential secret(s) found.", len(secretFindings))
+  }
+  if len(injectionFindings) > 0 {
+    strategyNote += fmt.Sprintf(" %d possible prompt injection(s) in repository content.", len(injectionFindings))
+  }
+  if len(scopeFindings) > 0 {
+    strategyNote += fmt.Sprintf(" %d change(s) outside the planned files; review them carefully.", len(scopeFindings))
+  }
+  if usage.warning != "" {
+    strategyNote += fmt.Sprintf(" Budget warning: the run %s.", usage.warning)
+  }
 
+  output := &shared.WorkflowOutput{
+    SigningKeyFingerprint: initGitResult.SigningKeyFingerprint,
+    UserPrompt:            input.UserPrompt,
+    PlannedSteps:          plannedSteps,
+    MergeCheck:            mergeCheck,
+    RepoConfig:            repoConfig,
+    ContextReports:        contextReports,
+    AgentSteps:            agentSteps,
+    ChangeLog:             changeLog,
+    Reviews:               reviews,
+    RejectedWrites:        rejectedWrites,
+    SecretFindings:        secretFindings,
+    PushBlocked:           pushBlocked,
+    RequestedBy:           input.Requester.ID,
+    InjectionFindings:     injectionFindings,
+    ScopeFindings:         scopeFindings,
+    Usage:                 &usage.RunUsage,
+    BudgetWarning:         usage.warning,
+  }
+  output.PRDescription = pullRequestDescription(output)
 
   // 3. Create Final Branch
-  // Generate a unique branch name
-  branchName := fmt.Sprintf("%sai-%s", os.Getenv("BRANCH_PREFIX"), workflow.GetInfo(ctx).WorkflowExecution.RunID) // Use RunID for uniqueness
+  branchName := outputBranchName(ctx, input, repoConfig)
+  output.BranchName = branchName
   logger.Info("Attempting to create final branch.", "BranchName", branchName)
 
   createBranchInput := shared.CreateBranchInput{
@@ -185,35 +531,692 @@ func CodeGenWorkflow(ctx workflow.Context, input shared.WorkflowInput) (*shared.
       // Decide: should this be a fatal error for the workflow? Probably.
       return nil, fmt.Errorf("failed to create branch %s: %w", branchName, err)
   }
+  createdBranch = true
+
+  hasCredentials := gitUsername != "" && gitPassword != ""
+
+  // Runs submitted without the approve permission wait here until someone with it
+  // approves, so nothing is pushed unreviewed.
+  approvalTimedOut := false
+  if input.RequireApproval && hasCredentials && !pushBlocked {
+    logger.Info("Waiting for approval before pushing.", "BranchName", branchName)
+    awaitingApproval = true
+    approval, ok := awaitApproval(ctx, time.Duration(input.Settings.ApprovalTimeoutHours)*time.Hour)
+    awaitingApproval = false
+    if ok {
+      logger.Info("Run approved.", "ApprovedBy", approval.ApprovedBy)
+      output.ApprovedBy = approval.ApprovedBy
+      strategyNote += fmt.Sprintf(" Approved by %s.", approval.ApprovedBy)
+    } else if ctx.Err() != nil {
+      return nil, ctx.Err() // Canceled while waiting
+    } else {
+      logger.Warn("Approval timed out; the branch will not be pushed.")
+      approvalTimedOut = true
+    }
+  }
 
-  if gitUsername != "" && gitPassword != "" {
+  if hasCredentials && !pushBlocked && !approvalTimedOut {
     logger.Info("Attempting to push branch to remote.", "BranchName", branchName)
     pushInput := shared.PushBranchActivityInput{
-      WorkflowID: workflowID,
-      BranchName: branchName,
+      WorkflowID:     workflowID,
+      BranchName:     branchName,
+      ForceWithLease: input.ForceUpdate,
     }
     err = workflow.ExecuteActivity(ctx, activities.ActivityName_PushBranch, pushInput).Get(ctx, nil)
+    if err != nil && ctx.Err() != nil {
+      return nil, err // Canceled during the push
+    }
     if err != nil {
       logger.Error("Push branch activity failed.", "BranchName", branchName, "Error", err)
-      return &shared.WorkflowOutput{
-        BranchName: branchName,
-        Message:    fmt.Sprintf("Code generated on branch '%s', but failed to push to remote: %v", branchName, err),
-      }, nil
+      output.Message = fmt.Sprintf("Code generated on branch '%s', but failed to push to remote: %v.%s", branchName, err, strategyNote)
+      return output, nil
     }
     logger.Info("Successfully pushed branch to remote.", "BranchName", branchName)
-  } else {
+  } else if !hasCredentials {
     logger.Info("Skipping push operation as Git credentials were not provided.")
   }
 
   logger.Info("CodeGenWorkflow completed successfully.", "FinalBranch", branchName)
   finalMessage := fmt.Sprintf("Successfully generated code and created branch '%s'", branchName)
-  if gitUsername != "" && gitPassword != "" {
+  switch {
+  case pushBlocked:
+    finalMessage += "."
+  case approvalTimedOut:
+    finalMessage += ". Push skipped (approval timed out)."
+  case hasCredentials:
     finalMessage += " and pushed to remote."
-  } else {
+  default:
     finalMessage += ". Push skipped (no credentials)."
   }
-  return &shared.WorkflowOutput{
-    BranchName: branchName,
-    Message:    finalMessage,
-  }, nil
+  finalMessage += strategyNote
+  if initGitResult.SigningKeyFingerprint != "" {
+    finalMessage += fmt.Sprintf(" Commits signed with key %s.", initGitResult.SigningKeyFingerprint)
+  }
+  output.Message = finalMessage
+  return output, nil
+}
+
+// usageTracker sums a run's LLM usage. It travels in the workflow context so every
+// helper that runs an LLM activity can record into it.
+type usageTracker struct {
+  shared.RunUsage
+  step    int // Step in progress; 0 outside the steps
+  budget  shared.RunBudget
+  warning string // Set once usage passed the soft budget limit
+}
+
+type usageTrackerKey struct{}
+
+// errBudgetExceeded stops a run that has used up its RunBudget.
+var errBudgetExceeded = errors.New("run budget exceeded")
+
+// checkBudget returns an error wrapping errBudgetExceeded once the run has used
+// up its token or cost budget. Call it before every LLM activity.
+func checkBudget(ctx workflow.Context) error {
+  tracker, ok := ctx.Value(usageTrackerKey{}).(*usageTracker)
+  if !ok {
+    return nil
+  }
+  b, total := tracker.budget, tracker.Total
+  if b.MaxTokens > 0 && total.Tokens() >= b.MaxTokens {
+    return fmt.Errorf("%w: %d of %d tokens used", errBudgetExceeded, total.Tokens(), b.MaxTokens)
+  }
+  if b.MaxCostUSD > 0 && total.CostUSD >= b.MaxCostUSD {
+    return fmt.Errorf("%w: $%.2f of $%.2f spent", errBudgetExceeded, total.CostUSD, b.MaxCostUSD)
+  }
+  return nil
+}
+
+// budgetReason returns the errBudgetExceeded error in err's chain, without the
+// errors that wrap it.
+func budgetReason(err error) error {
+  for e := err; e != nil; e = errors.Unwrap(e) {
+    if next := errors.Unwrap(e); next == errBudgetExceeded {
+      return e
+    }
+  }
+  return errBudgetExceeded
+}
+
+// softBudgetWarning describes usage past the soft limit, or returns "".
+func softBudgetWarning(b shared.RunBudget, total shared.UsageTotals) string {
+  if b.SoftPercent <= 0 {
+    return ""
+  }
+  soft := float64(b.SoftPercent) / 100
+  if b.MaxTokens > 0 && float64(total.Tokens()) >= soft*float64(b.MaxTokens) {
+    return fmt.Sprintf("passed %d%% of the token budget (%d of %d tokens)", b.SoftPercent, total.Tokens(), b.MaxTokens)
+  }
+  if b.MaxCostUSD > 0 && total.CostUSD >= soft*b.MaxCostUSD {
+    return fmt.Sprintf("passed %d%% of the cost budget ($%.2f of $%.2f)", b.SoftPercent, total.CostUSD, b.MaxCostUSD)
+  }
+  return ""
+}
+
+// recordUsage adds an LLM activity's calls to the run's usage. A failed activity
+// reports the calls of its last attempt in its error details.
+func recordUsage(ctx workflow.Context, calls []shared.LLMUsage, err error) {
+  tracker, ok := ctx.Value(usageTrackerKey{}).(*usageTracker)
+  if !ok {
+    return
+  }
+  var appErr *temporal.ApplicationError
+  if err != nil && errors.As(err, &appErr) && appErr.HasDetails() {
+    var failed []shared.LLMUsage
+    if appErr.Details(&failed) == nil {
+      calls = append(calls, failed...)
+    }
+  }
+  tracker.Add(tracker.step, calls)
+  if tracker.warning == "" {
+    if tracker.warning = softBudgetWarning(tracker.budget, tracker.Total); tracker.warning != "" {
+      workflow.GetLogger(ctx).Warn("Run passed its soft budget limit.", "Usage", tracker.warning)
+    }
+  }
+}
+
+// outputBranchName returns the branch the run's commits end up on.
+func outputBranchName(ctx workflow.Context, input shared.WorkflowInput, repoConfig *shared.RepoConfig) string {
+  if input.BranchName != "" {
+    return input.BranchName
+  }
+  if input.FollowUpBranch != "" {
+    return input.FollowUpBranch // Keep iterating on the same branch
+  }
+  // Generate a unique branch name
+  return fmt.Sprintf("%sai-%s", repoConfig.BranchPrefix, workflow.GetInfo(ctx).WorkflowExecution.RunID) // Use RunID for uniqueness
+}
+
+// finishPartial completes the result of a run that was canceled or ran out of
+// budget, starting its message with headline. The steps it committed are pushed
+// only if the submitter asked for it, the run needed no approval and the secret
+// scan is clean; the branch strategy is not applied to them. ctx must be
+// disconnected from the canceled workflow context.
+func finishPartial(ctx workflow.Context, workflowID string, input shared.WorkflowInput, output *shared.WorkflowOutput, headline string, stepsCompleted int, branchName string, branchCreated, hasCredentials bool) *shared.WorkflowOutput {
+  output.StepsCompleted = stepsCompleted
+  message := headline
+  switch {
+  case len(output.ChangeLog) == 0:
+    message += " No changes were committed."
+  case !input.PushPartial:
+    message += fmt.Sprintf(" %d committed step(s) were not pushed.", len(output.ChangeLog))
+  case input.RequireApproval:
+    message += " The committed steps were not pushed, since the run needed approval."
+  case !hasCredentials:
+    message += " Push skipped (no credentials)."
+  default:
+    message += pushPartialRun(ctx, workflowID, input, output, branchName, branchCreated)
+  }
+  output.Message = message
+  output.PRDescription = pullRequestDescription(output)
+  return output
+}
+
+// pushPartialRun pushes the commits of a run that stopped early and describes the outcome.
+func pushPartialRun(ctx workflow.Context, workflowID string, input shared.WorkflowInput, output *shared.WorkflowOutput, branchName string, branchCreated bool) string {
+  logger := workflow.GetLogger(ctx)
+  if !branchCreated {
+    err := workflow.ExecuteActivity(ctx, activities.ActivityName_CreateBranch, shared.CreateBranchInput{WorkflowID: workflowID, BranchName: branchName}).Get(ctx, nil)
+    if err != nil {
+      logger.Error("Failed to create branch for partial run.", "BranchName", branchName, "Error", err)
+      return fmt.Sprintf(" Failed to create branch '%s' for the committed steps: %v.", branchName, err)
+    }
+  }
+  output.BranchName = branchName
+
+  var branchFindings []shared.SecretFinding
+  if err := workflow.ExecuteActivity(ctx, activities.ActivityName_ScanBranch, shared.ScanBranchInput{WorkflowID: workflowID}).Get(ctx, &branchFindings); err != nil {
+    logger.Warn("Secret scan of the branch failed; the push activity scans again.", "Error", err)
+  }
+  output.SecretFindings = mergeSecretFindings(output.SecretFindings, branchFindings)
+  if len(output.SecretFindings) > 0 {
+    output.PushBlocked = true
+    return fmt.Sprintf(" Push blocked: %d potential secret(s) found.", len(output.SecretFindings))
+  }
+
+  pushInput := shared.PushBranchActivityInput{WorkflowID: workflowID, BranchName: branchName, ForceWithLease: input.ForceUpdate}
+  if err := workflow.ExecuteActivity(ctx, activities.ActivityName_PushBranch, pushInput).Get(ctx, nil); err != nil {
+    logger.Error("Failed to push partial run.", "BranchName", branchName, "Error", err)
+    return fmt.Sprintf(" Failed to push the committed steps to '%s': %v.", branchName, err)
+  }
+  logger.Info("Pushed the committed steps of a partial run.", "BranchName", branchName)
+  return fmt.Sprintf(" Pushed the %d committed step(s) to branch '%s'.", len(output.ChangeLog), branchName)
+}
+
+// requesterTrailers returns the commit trailers naming who submitted the run.
+func requesterTrailers(requester shared.User) []string {
+  if requester.ID == "" {
+    return nil
+  }
+  name := requester.Name
+  if name == "" {
+    name = requester.ID
+  }
+  if requester.Email != "" {
+    name += " <" + requester.Email + ">"
+  }
+  return []string{"Requested-by: " + name}
+}
+
+// awaitApproval blocks until SignalApproveRun arrives or the timeout passes.
+// Approvals sent before the run started waiting are discarded: they were given
+// before there was anything to review.
+func awaitApproval(ctx workflow.Context, timeout time.Duration) (shared.RunApproval, bool) {
+  var approval shared.RunApproval
+  approved := false
+  signals := workflow.GetSignalChannel(ctx, shared.SignalApproveRun)
+  for signals.ReceiveAsync(&approval) {
+    workflow.GetLogger(ctx).Warn("Ignoring approval sent before the run was waiting for it.", "ApprovedBy", approval.ApprovedBy)
+  }
+  approval = shared.RunApproval{}
+  timerCtx, cancelTimer := workflow.WithCancel(ctx)
+  defer cancelTimer()
+  selector := workflow.NewSelector(ctx)
+  selector.AddReceive(signals, func(c workflow.ReceiveChannel, more bool) {
+    c.Receive(ctx, &approval)
+    approved = true
+  })
+  selector.AddFuture(workflow.NewTimer(timerCtx, timeout), func(workflow.Future) {})
+  selector.Select(ctx)
+  return approval, approved
+}
+
+// stepCommitMessage returns the template commit message for a step, or an LLM-written
+// one when enabled and it succeeds.
+func stepCommitMessage(ctx workflow.Context, workflowID string, stepNum, totalSteps int, step, userPrompt string, changes map[string]string, useLLM bool, promptOverrides shared.PromptOverrides) string {
+  commitMsg := fmt.Sprintf("AI Agent: Apply step %d/%d: %s", stepNum, totalSteps, step)
+  // Ensure commit message is concise if step description is long
+  if len(commitMsg) > 100 {
+    commitMsg = commitMsg[:97] + "..."
+  }
+  if useLLM {
+    if generatedMsg, err := generateCommitMessage(ctx, workflowID, step, userPrompt, changes, promptOverrides); err != nil {
+      workflow.GetLogger(ctx).Warn("Commit message generation failed, using template message.", "Step", stepNum, "Error", err)
+    } else {
+      commitMsg = generatedMsg
+    }
+  }
+  return commitMsg
+}
+
+// recordStepChange builds the change log entry for a committed step. If the commit
+// cannot be summarized, the entry still records the step without its files.
+func recordStepChange(ctx workflow.Context, workflowID string, stepNum int, step, summary, commitHash string) shared.StepChange {
+  change := shared.StepChange{Step: stepNum, Description: step, Summary: summary}
+  input := shared.SummarizeCommitInput{WorkflowID: workflowID, CommitHash: commitHash}
+  if err := workflow.ExecuteActivity(ctx, activities.ActivityName_SummarizeCommit, input).Get(ctx, &change.Files); err != nil {
+    workflow.GetLogger(ctx).Warn("Failed to summarize step commit for the change log.", "Step", stepNum, "Error", err)
+  }
+  return change
+}
+
+// selfReview asks the reviewer to critique a step's changes before they are committed.
+// It returns the review to record (nil if the review itself failed) and a revision
+// request if the changes were rejected and another attempt is allowed. A failed
+// review never blocks the step; it is committed unreviewed.
+func selfReview(ctx workflow.Context, workflowID string, stepNum, attempt int, step, userPrompt, conventions string, changes, contextFiles map[string]string, priority []string, maxRevisions int, promptOverrides shared.PromptOverrides) (*shared.StepReview, *shared.RevisionRequest) {
+  logger := workflow.GetLogger(ctx)
+  var diff string
+  diffInput := shared.DiffChangesGitActivityInput{WorkflowID: workflowID, Changes: changes}
+  if err := workflow.ExecuteActivity(ctx, activities.ActivityName_DiffChangesGit, diffInput).Get(ctx, &diff); err != nil {
+    logger.Warn("Failed to diff step changes for review; committing unreviewed.", "Step", stepNum, "Error", err)
+    return nil, nil
+  }
+  if diff == "" {
+    return nil, nil
+  }
+
+  reviewInput := shared.ReviewCodeActivityInput{
+    StepDescription:      step,
+    OriginalUserPrompt:   userPrompt,
+    Conventions:          conventions,
+    Diff:                 diff,
+    RelevantFilesContent: contextFiles,
+    FilePriority:         priority,
+    PromptOverrides:      promptOverrides,
+  }
+  if err := checkBudget(ctx); err != nil {
+    logger.Warn("Skipping self-review; the run is over its budget.", "Step", stepNum, "Error", err)
+    return nil, nil
+  }
+  var reviewResult shared.ReviewCodeActivityResult
+  err := workflow.ExecuteActivity(ctx, activities.ActivityName_ReviewCode, reviewInput).Get(ctx, &reviewResult)
+  recordUsage(ctx, reviewResult.Usage, err)
+  if err != nil {
+    logger.Warn("Self-review failed; committing unreviewed.", "Step", stepNum, "Attempt", attempt, "Error", err)
+    return nil, nil
+  }
+  result := reviewResult.Review
+  review := &shared.StepReview{Step: stepNum, Attempt: attempt, ReviewResult: result}
+  logger.Info("Self-review complete.", "Step", stepNum, "Attempt", attempt, "Approved", result.Approved, "Findings", len(result.Findings))
+  if result.Approved {
+    return review, nil
+  }
+  if attempt > maxRevisions {
+    logger.Warn("Review findings remain after the revision limit; committing anyway.", "Step", stepNum, "Revisions", maxRevisions)
+    return review, nil
+  }
+  return review, &shared.RevisionRequest{Diff: diff, Summary: result.Summary, Findings: result.Findings}
+}
+
+// runToolAgent lets the tool-calling agent work on one step. Every model turn and
+// every tool call is its own activity, so the loop is durable and replayable. The
+// loop ends when the model replies without tool calls or a limit is reached; the
+// changes it made stay staged in the worktree for the caller to commit. With a
+// revision, the agent fixes the review findings in its staged changes.
+func runToolAgent(ctx workflow.Context, workflowID, step, userPrompt, conventions string, priorChanges []shared.StepChange, revision *shared.RevisionRequest, limits shared.AgentLimits, promptOverrides shared.PromptOverrides) (*shared.AgentStepSummary, error) {
+  logger := workflow.GetLogger(ctx)
+  summary := &shared.AgentStepSummary{StopReason: "max iterations"}
+  var history []shared.AgentMessage
+  for summary.Iterations < limits.MaxIterations {
+    if limits.MaxTokens > 0 && summary.TotalTokens >= limits.MaxTokens {
+      summary.StopReason = "token budget"
+      break
+    }
+    summary.Iterations++
+    turnInput := shared.AgentTurnActivityInput{
+      StepDescription:     step,
+      OriginalUserPrompt:  userPrompt,
+      Conventions:         conventions,
+      PriorChanges:        priorChanges,
+      Revision:            revision,
+      History:             history,
+      MaxIterations:       limits.MaxIterations,
+      VerificationEnabled: limits.VerificationEnabled,
+      PromptOverrides:     promptOverrides,
+    }
+    if err := checkBudget(ctx); err != nil {
+      return nil, err
+    }
+    var turn shared.AgentTurnActivityResult
+    err := workflow.ExecuteActivity(ctx, activities.ActivityName_AgentTurn, turnInput).Get(ctx, &turn)
+    recordUsage(ctx, turn.Usage, err)
+    if err != nil {
+      return nil, err
+    }
+    summary.TotalTokens += turn.TotalTokens
+    history = append(history, turn.Message)
+    if len(turn.Message.ToolCalls) == 0 {
+      summary.StopReason = "completed"
+      summary.Summary = turn.Message.Content
+      break
+    }
+    for _, call := range turn.Message.ToolCalls {
+      summary.ToolCalls++
+      var output string
+      toolInput := shared.AgentToolActivityInput{WorkflowID: workflowID, Call: call}
+      if err := workflow.ExecuteActivity(ctx, activities.ActivityName_AgentTool, toolInput).Get(ctx, &output); err != nil {
+        return nil, err
+      }
+      history = append(history, shared.AgentMessage{Role: "tool", Content: output, ToolCallID: call.ID})
+    }
+  }
+  if summary.StopReason != "completed" {
+    logger.Warn("Agent stopped before completing the step.", "Reason", summary.StopReason, "Iterations", summary.Iterations, "Tokens", summary.TotalTokens)
+  }
+  return summary, nil
+}
+
+// generateCommitMessage diffs the step's changes against HEAD and asks the LLM for a
+// Conventional Commits message. Callers fall back to the template message on error.
+func generateCommitMessage(ctx workflow.Context, workflowID string, step string, userPrompt string, changes map[string]string, promptOverrides shared.PromptOverrides) (string, error) {
+  diffInput := shared.DiffChangesGitActivityInput{
+    WorkflowID: workflowID,
+    Changes:    changes,
+  }
+  var diff string
+  if err := workflow.ExecuteActivity(ctx, activities.ActivityName_DiffChangesGit, diffInput).Get(ctx, &diff); err != nil {
+    return "", fmt.Errorf("failed to diff step changes: %w", err)
+  }
+  if diff == "" {
+    return "", fmt.Errorf("step changes produced an empty diff")
+  }
+
+  msgInput := shared.GenerateCommitMessageActivityInput{
+    StepDescription:    step,
+    Diff:               diff,
+    OriginalUserPrompt: userPrompt,
+    PromptOverrides:    promptOverrides,
+  }
+  if err := checkBudget(ctx); err != nil {
+    return "", err
+  }
+  var result shared.GenerateCommitMessageActivityResult
+  err := workflow.ExecuteActivity(ctx, activities.ActivityName_GenerateCommitMessage, msgInput).Get(ctx, &result)
+  recordUsage(ctx, result.Usage, err)
+  if err != nil {
+    return "", err
+  }
+  return result.Message, nil
+}
+
+// squashCommitMessage combines the per-step commit messages into a single message
+// for the squash branch strategy.
+func squashCommitMessage(userPrompt string, stepMessages []string) string {
+  subject := "AI Agent: " + strings.Join(strings.Fields(userPrompt), " ")
+  if len(subject) > 72 {
+    subject = subject[:69] + "..."
+  }
+  var body strings.Builder
+  for _, msg := range stepMessages {
+    firstLine, _, _ := strings.Cut(msg, "\n")
+    body.WriteString("- " + strings.TrimSpace(firstLine) + "\n")
+  }
+  return subject + "\n\n" + body.String()
+}
+
+// appendRejectedWrites records the writes the policy refused during a step.
+func appendRejectedWrites(ctx workflow.Context, all []shared.RejectedWrite, stepNum int, rejected []shared.RejectedWrite) []shared.RejectedWrite {
+  for _, r := range rejected {
+    workflow.GetLogger(ctx).Warn("Write rejected by the write policy.", "Step", stepNum, "Path", r.Path, "Reason", r.Reason)
+    r.Step = stepNum
+    all = append(all, r)
+  }
+  return all
+}
+
+// pullRequestDescription renders a Markdown description for a pull request of the
+// branch: the request, what each step changed, the self-review notes, writes the
+// policy rejected, potential secrets and prompt-injection warnings.
+func pullRequestDescription(out *shared.WorkflowOutput) string {
+  var b strings.Builder
+  b.WriteString("## Request\n\n" + strings.TrimSpace(out.UserPrompt) + "\n\n## Steps\n\n")
+  if out.Canceled {
+    fmt.Fprintf(&b, "The run was canceled after step %d of %d.\n\n", out.StepsCompleted, len(out.PlannedSteps))
+  } else if out.BudgetExceeded {
+    fmt.Fprintf(&b, "The run used up its budget and stopped after step %d of %d.\n\n", out.StepsCompleted, len(out.PlannedSteps))
+  }
+  changes := make(map[int]shared.StepChange, len(out.ChangeLog))
+  for _, c := range out.ChangeLog {
+    changes[c.Step] = c
+  }
+  for i, step := range out.PlannedSteps {
+    fmt.Fprintf(&b, "%d. %s", i+1, step)
+    if c, ok := changes[i+1]; ok && len(c.Files) > 0 {
+      var files []string
+      for _, f := range c.Files {
+        files = append(files, fmt.Sprintf("`%s` (%s)", f.Path, f.Status))
+      }
+      b.WriteString(" — " + strings.Join(files, ", "))
+    } else if !ok {
+      b.WriteString(" — no changes")
+    }
+    b.WriteString("\n")
+  }
+
+  // Only the last review of each step decides whether findings are still open.
+  last := make(map[int]int)
+  for i, r := range out.Reviews {
+    last[r.Step] = i
+  }
+  if len(out.Reviews) > 0 {
+    b.WriteString("\n## Self-review\n\n")
+  }
+  for i, r := range out.Reviews {
+    verdict := "changes requested, revised"
+    switch {
+    case r.Approved:
+      verdict = "approved"
+    case last[r.Step] == i:
+      verdict = "changes requested, **unresolved**"
+    }
+    fmt.Fprintf(&b, "- Step %d, attempt %d: %s", r.Step, r.Attempt, verdict)
+    if r.Summary != "" {
+      b.WriteString(" — " + r.Summary)
+    }
+    b.WriteString("\n")
+    for _, f := range r.Findings {
+      location := f.File
+      if f.Line > 0 {
+        location = fmt.Sprintf("%s:%d", f.File, f.Line)
+      }
+      fmt.Fprintf(&b, "  - [%s] `%s`: %s\n", f.Severity, location, f.Message)
+    }
+  }
+
+  if len(out.RejectedWrites) > 0 {
+    b.WriteString("\n## Rejected writes\n\n")
+  }
+  for _, r := range out.RejectedWrites {
+    fmt.Fprintf(&b, "- Step %d: `%s` — %s\n", r.Step, r.Path, r.Reason)
+  }
+
+  if len(out.SecretFindings) > 0 {
+    b.WriteString("\n## Potential secrets\n\n")
+  }
+  for _, f := range out.SecretFindings {
+    fmt.Fprintf(&b, "- `%s:%d` (%s): %s\n", f.File, f.Line, f.Rule, f.Match)
+  }
+
+  if len(out.ScopeFindings) > 0 {
+    b.WriteString("\n## Changes outside the plan\n\n")
+  }
+  for _, f := range out.ScopeFindings {
+    fmt.Fprintf(&b, "- Step %d: `%s` %s\n", f.Step, f.File, f.Reason)
+  }
+
+  if len(out.InjectionFindings) > 0 {
+    b.WriteString("\n## Possible prompt injection\n\nThese lines of repository content looked like instructions to the model:\n\n")
+  }
+  for _, f := range out.InjectionFindings {
+    fmt.Fprintf(&b, "- `%s:%d` (%s)\n", f.File, f.Line, f.Rule)
+  }
+  return b.String()
+}
+
+// appendInjectionFindings records a step's injection findings, skipping lines an
+// earlier step already reported because the same file was shown again.
+func appendInjectionFindings(ctx workflow.Context, all []shared.InjectionFinding, stepNum int, found []shared.InjectionFinding) []shared.InjectionFinding {
+  seen := make(map[string]bool, len(all))
+  for _, f := range all {
+    seen[fmt.Sprintf("%s:%d", f.File, f.Line)] = true
+  }
+  for _, f := range found {
+    if seen[fmt.Sprintf("%s:%d", f.File, f.Line)] {
+      continue
+    }
+    workflow.GetLogger(ctx).Warn("Possible prompt injection in repository content.", "Step", stepNum, "File", f.File, "Line", f.Line, "Rule", f.Rule)
+    f.Step = stepNum
+    all = append(all, f)
+  }
+  return all
+}
+
+// mergeSecretFindings adds the branch scan's findings to the per-step ones,
+// skipping those a step already reported.
+func mergeSecretFindings(stepFindings, branchFindings []shared.SecretFinding) []shared.SecretFinding {
+  seen := make(map[string]bool, len(stepFindings))
+  for _, f := range stepFindings {
+    seen[f.File+"\x00"+f.Rule+"\x00"+f.Match] = true
+  }
+  for _, f := range branchFindings {
+    if !seen[f.File+"\x00"+f.Rule+"\x00"+f.Match] {
+      stepFindings = append(stepFindings, f)
+    }
+  }
+  return stepFindings
+}
+
+// checkMergeConflicts compares the generated commits with the latest base branch. In
+// resolve mode it asks the generator to merge each conflicting file and, if every
+// conflict was resolved, records a merge commit of the latest base.
+func checkMergeConflicts(ctx workflow.Context, workflowID string, input shared.WorkflowInput, promptOverrides shared.PromptOverrides) (*shared.MergeCheckOutcome, error) {
+  logger := workflow.GetLogger(ctx)
+  var check shared.CheckMergeConflictsResult
+  err := workflow.ExecuteActivity(ctx, activities.ActivityName_CheckMergeConflicts, shared.CheckMergeConflictsInput{WorkflowID: workflowID}).Get(ctx, &check)
+  if err != nil {
+    return nil, err
+  }
+  outcome := &shared.MergeCheckOutcome{BaseMoved: check.BaseMoved, Conflicts: check.Conflicts}
+  if !check.BaseMoved {
+    logger.Info("Base branch has not moved since clone.")
+    return outcome, nil
+  }
+  if input.ConflictMode != shared.ConflictModeResolve {
+    outcome.Unresolved = check.Conflicts
+    return outcome, nil
+  }
+
+  resolutions := make(map[string]string)
+  for _, path := range check.Conflicts {
+    var file shared.ConflictFile
+    readInput := shared.ReadConflictFileInput{WorkflowID: workflowID, Path: path, UpstreamHash: check.UpstreamHash}
+    if err := workflow.ExecuteActivity(ctx, activities.ActivityName_ReadConflictFile, readInput).Get(ctx, &file); err != nil {
+      return nil, err
+    }
+    if err := checkBudget(ctx); err != nil {
+      return nil, err
+    }
+    var resolved shared.ResolveConflictActivityResult
+    resolveInput := shared.ResolveConflictActivityInput{File: file, OriginalUserPrompt: input.UserPrompt, PromptOverrides: promptOverrides}
+    err := workflow.ExecuteActivity(ctx, activities.ActivityName_ResolveConflict, resolveInput).Get(ctx, &resolved)
+    recordUsage(ctx, resolved.Usage, err)
+    if err != nil {
+      logger.Warn("Failed to resolve conflict.", "File", path, "Error", err)
+      outcome.Unresolved = append(outcome.Unresolved, path)
+      continue
+    }
+    resolutions[path] = resolved.Merged
+    outcome.Resolved = append(outcome.Resolved, path)
+  }
+  if len(outcome.Unresolved) > 0 {
+    // A partial merge would leave the branch inconsistent; push the commits as they are.
+    return outcome, nil
+  }
+
+  mergeInput := shared.MergeUpstreamInput{
+    WorkflowID:    workflowID,
+    UpstreamHash:  check.UpstreamHash,
+    Resolutions:   resolutions,
+    CommitMessage: "AI Agent: Merge latest base branch",
+  }
+  if err := workflow.ExecuteActivity(ctx, activities.ActivityName_MergeUpstream, mergeInput).Get(ctx, &outcome.MergeCommit); err != nil {
+    return nil, err
+  }
+  logger.Info("Merged latest base branch.", "MergeCommit", outcome.MergeCommit, "Resolved", outcome.Resolved)
+  return outcome, nil
+}
+
+// selectCandidateFiles narrows a large file list for evaluation: it summarizes the
+// directory tree, lets the model pick directories, and returns the files in them.
+// An empty pick means the step needs no existing files; a pick still too large for
+// a single evaluation prompt is trimmed to the threshold.
+func selectCandidateFiles(ctx workflow.Context, workflowID, step string, allFiles []string, budget shared.SelectionLimits, promptOverrides shared.PromptOverrides) ([]string, error) {
+  logger := workflow.GetLogger(ctx)
+  var summaries []shared.DirectorySummary
+  summarizeInput := shared.SummarizeDirectoriesInput{WorkflowID: workflowID, Files: allFiles}
+  if err := workflow.ExecuteActivity(ctx, activities.ActivityName_SummarizeDirectories, summarizeInput).Get(ctx, &summaries); err != nil {
+    return nil, err
+  }
+  if err := checkBudget(ctx); err != nil {
+    return nil, err
+  }
+  var selected shared.SelectDirectoriesActivityResult
+  selectInput := shared.SelectDirectoriesActivityInput{
+    StepDescription: step,
+    Directories:     summaries,
+    MaxDirectories:  budget.MaxDirectories,
+    PromptOverrides: promptOverrides,
+  }
+  err := workflow.ExecuteActivity(ctx, activities.ActivityName_SelectDirectories, selectInput).Get(ctx, &selected)
+  recordUsage(ctx, selected.Usage, err)
+  if err != nil {
+    return nil, err
+  }
+  dirs := selected.Directories
+  candidates := services.FilesInDirectories(allFiles, dirs)
+  if len(candidates) > budget.HierarchicalThreshold {
+    logger.Warn("Selected directories still hold too many files; truncating.", "Files", len(candidates), "Limit", budget.HierarchicalThreshold)
+    candidates = candidates[:budget.HierarchicalThreshold]
+  }
+  logger.Info("Directory selection complete.", "Directories", dirs, "CandidateFiles", len(candidates), "TotalFiles", len(allFiles))
+  return candidates, nil
+}
+
+// withSearchHits appends search hits missing from the candidate list, so files found
+// by content stay selectable after directory selection narrowed the list.
+func withSearchHits(candidates []string, hits []shared.SearchHit) []string {
+  present := make(map[string]struct{}, len(candidates))
+  for _, f := range candidates {
+    present[f] = struct{}{}
+  }
+  for _, hit := range hits {
+    if _, ok := present[hit.File]; !ok {
+      candidates = append(candidates, hit.File)
+      present[hit.File] = struct{}{}
+    }
+  }
+  return candidates
+}
+
+// effectiveRepoConfig fills unset .hammer.yaml values with the worker defaults.
+func effectiveRepoConfig(config *shared.RepoConfig) *shared.RepoConfig {
+  effective := shared.RepoConfig{}
+  if config != nil {
+    effective = *config
+  }
+  if effective.BranchPrefix == "" {
+    effective.BranchPrefix = os.Getenv("BRANCH_PREFIX")
+  }
+  return &effective
 }